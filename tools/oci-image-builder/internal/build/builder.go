@@ -7,17 +7,26 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
 
 	"oci-image-builder/internal/config"
 	"oci-image-builder/internal/logger"
+	"oci-image-builder/internal/progress"
+	"oci-image-builder/internal/provenance"
+	"oci-image-builder/internal/sbom"
+	"oci-image-builder/internal/tracing"
 )
 
 // BuildResult contains the result of a build operation.
 type BuildResult struct {
-	ImageName  string
-	OutputPath string
-	SizeBytes  int64
-	Error      error
+	ImageName      string
+	OutputPath     string
+	SBOMPath       string // Empty if SBOMs are disabled
+	ProvenancePath string // In-toto provenance statement
+	SizeBytes      int64
+	Error          error
 }
 
 // Builder handles building NixOS images.
@@ -25,14 +34,27 @@ type Builder struct {
 	Config    *config.Config
 	LocalOnly bool
 	Logger    *logger.Logger
+	Events    *progress.Bus
+	SBOM      *sbom.Generator
+
+	// Recorded in provenance statements.
+	RunID     string
+	GitCommit string
+	GitDirty  bool
 }
 
 // NewBuilder creates a new Builder instance.
 func NewBuilder(cfg *config.Config, localOnly bool) *Builder {
+	log := logger.New()
+	generator := sbom.NewGenerator(".")
+	generator.Logger = log
+
 	return &Builder{
 		Config:    cfg,
 		LocalOnly: localOnly,
-		Logger:    logger.New(),
+		Logger:    log,
+		Events:    progress.NewBus(),
+		SBOM:      generator,
 	}
 }
 
@@ -62,46 +84,100 @@ func CheckPrerequisites(needSSH bool) error {
 	return nil
 }
 
-// Build builds the specified images.
+// Build builds the specified images. On error, the results of images that
+// were built before the failure are returned alongside it.
 func (b *Builder) Build(ctx context.Context, imageNames []string) (map[string]BuildResult, error) {
 	results := make(map[string]BuildResult)
 
 	for _, name := range imageNames {
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+
 		imageDef := b.Config.GetImage(name)
 		if imageDef == nil {
 			return nil, fmt.Errorf("unknown image: %s", name)
 		}
 
-		var result BuildResult
+		var (
+			result     BuildResult
+			invocation provenance.Builder
+		)
 		result.ImageName = name
+		startedOn := time.Now()
+		b.Events.Emit(&progress.StageStarted{Header: progress.Header{Image: name}, Stage: progress.StageBuild})
+		buildCtx, span := tracing.Start(ctx, "build", tracing.Image(name),
+			attribute.String("nix.flake_target", imageDef.FlakeTarget))
 
 		// Choose build method based on architecture and LocalOnly flag
 		if imageDef.Arch == config.ArchAarch64 && !b.LocalOnly {
 			if b.Config.ARM64Builder != nil && b.Config.ARM64Builder.IsMacOS {
-				result.OutputPath, result.Error = b.buildRemoteMacOS(ctx, imageDef)
+				result.OutputPath, result.Error = b.buildRemoteMacOS(buildCtx, imageDef, &invocation)
 			} else {
-				result.OutputPath, result.Error = b.buildRemote(ctx, imageDef)
+				result.OutputPath, result.Error = b.buildRemote(buildCtx, imageDef, &invocation)
 			}
 		} else {
-			result.OutputPath, result.Error = b.buildLocal(ctx, imageDef)
+			result.OutputPath, result.Error = b.buildLocal(buildCtx, imageDef, &invocation)
+		}
+		if ext := b.Config.SBOM.Extension(); ext != "" && result.Error == nil {
+			result.SBOMPath, result.Error = b.writeSBOM(buildCtx, imageDef, ext)
+		}
+		if result.Error == nil {
+			result.ProvenancePath, result.Error = b.writeProvenance(buildCtx, imageDef, result.OutputPath, invocation, startedOn)
 		}
 
 		if result.Error != nil {
-			return nil, result.Error
+			tracing.End(span, result.Error)
+			b.Events.Emit(&progress.StageFailed{Header: progress.Header{Image: name}, Stage: progress.StageBuild, Err: result.Error})
+			return results, result.Error
 		}
 
 		// Get file size
 		if info, err := os.Stat(result.OutputPath); err == nil {
 			result.SizeBytes = info.Size()
 		}
+		span.SetAttributes(attribute.Int64("image.size_bytes", result.SizeBytes))
+		tracing.End(span, nil)
 
 		b.Logger.Logf("Build complete: %s (%d MB)", result.OutputPath, result.SizeBytes/(1024*1024))
+		b.Events.Emit(&progress.StageCompleted{Header: progress.Header{Image: name}, Stage: progress.StageBuild, Bytes: result.SizeBytes})
 		results[name] = result
 	}
 
 	return results, nil
 }
 
+// writeSBOM generates the SBOM of an image into result-<name><ext> and
+// returns its absolute path.
+func (b *Builder) writeSBOM(ctx context.Context, image *config.ImageDef, ext string) (string, error) {
+	data, err := b.SBOM.Generate(ctx, image.Name, image.FlakeTarget, b.Config.SBOM.Format)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate SBOM for %s: %w", image.Name, err)
+	}
+
+	path, err := filepath.Abs(fmt.Sprintf("result-%s%s", image.Name, ext))
+	if err != nil {
+		return "", fmt.Errorf("failed to write SBOM: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return "", fmt.Errorf("failed to write SBOM: %w", err)
+	}
+	b.Logger.Logf("SBOM written to %s", path)
+	return path, nil
+}
+
+// commandLog returns a logger for the output of an image's build
+// subprocesses. Each line goes to the Builder's logger and is emitted as a
+// BuildLogLine event.
+func (b *Builder) commandLog(imageName string) *logger.Logger {
+	log := logger.New()
+	log.SetLogFunc(func(line string) {
+		b.Logger.Log(line)
+		b.Events.Emit(&progress.BuildLogLine{Header: progress.Header{Image: imageName}, Line: line})
+	})
+	return log
+}
+
 // NeedsRemoteBuild returns true if any of the images require remote building.
 func (b *Builder) NeedsRemoteBuild(imageNames []string) bool {
 	if b.LocalOnly {
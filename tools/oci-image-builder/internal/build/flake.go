@@ -0,0 +1,54 @@
+package build
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// FlakeOutputs returns the names that can follow "#" in a flake reference
+// to flakeRef: packages and legacyPackages of any system, and top-level
+// outputs. It runs 'nix flake show --json --all-systems'.
+func FlakeOutputs(ctx context.Context, flakeRef string) (map[string]bool, error) {
+	if _, err := exec.LookPath("nix"); err != nil {
+		return nil, fmt.Errorf("nix not found in PATH. Install Nix from https://nixos.org/download")
+	}
+
+	cmd := exec.CommandContext(ctx, "nix", "flake", "show", "--json", "--all-systems",
+		"--extra-experimental-features", "nix-command flakes", flakeRef)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("nix flake show failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	var show map[string]json.RawMessage
+	if err := json.Unmarshal(out, &show); err != nil {
+		return nil, fmt.Errorf("failed to parse nix flake show output: %w", err)
+	}
+
+	outputs := make(map[string]bool)
+	for name, raw := range show {
+		outputs[name] = true
+		if name != "packages" && name != "legacyPackages" {
+			continue
+		}
+
+		var systems map[string]map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &systems); err != nil {
+			continue
+		}
+		for _, pkgs := range systems {
+			for pkg := range pkgs {
+				outputs[pkg] = true
+			}
+		}
+	}
+
+	return outputs, nil
+}
@@ -1,59 +1,30 @@
 package build
 
 import (
-	"bufio"
 	"context"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strings"
 
 	"oci-image-builder/internal/config"
+	"oci-image-builder/internal/provenance"
 )
 
-// buildLocal builds an image locally using nix build.
-func (b *Builder) buildLocal(ctx context.Context, image *config.ImageDef) (string, error) {
+// buildLocal builds an image locally using nix build, describing the build
+// in inv.
+func (b *Builder) buildLocal(ctx context.Context, image *config.ImageDef, inv *provenance.Builder) (string, error) {
 	outputLink := fmt.Sprintf("result-%s", image.Name)
 	target := fmt.Sprintf(".#%s", image.FlakeTarget)
 
+	out := b.commandLog(image.Name)
 	b.Logger.Logf("Building %s locally...", image.Name)
 	b.Logger.Logf("  Target: %s", target)
 	b.Logger.Logf("  Output: %s", outputLink)
 
-	cmd := exec.CommandContext(ctx, "nix", "build", target, "--out-link", outputLink)
-	cmd.Dir = "."
-
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		return "", fmt.Errorf("failed to create stderr pipe: %w", err)
-	}
-
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return "", fmt.Errorf("failed to create stdout pipe: %w", err)
-	}
-
-	if err := cmd.Start(); err != nil {
-		return "", fmt.Errorf("failed to start nix build: %w", err)
-	}
-
-	// Stream stderr (nix outputs progress to stderr)
-	go func() {
-		scanner := bufio.NewScanner(stderr)
-		for scanner.Scan() {
-			b.Logger.Log(scanner.Text())
-		}
-	}()
-
-	// Stream stdout
-	go func() {
-		scanner := bufio.NewScanner(stdout)
-		for scanner.Scan() {
-			b.Logger.Log(scanner.Text())
-		}
-	}()
-
-	if err := cmd.Wait(); err != nil {
+	args := []string{"build", target, "--out-link", outputLink}
+	*inv = provenance.Builder{Kind: provenance.BuilderLocal, Command: "nix " + strings.Join(args, " ")}
+	if err := runLogged(ctx, out, true, "nix", args...); err != nil {
 		return "", fmt.Errorf("nix build failed: %w", err)
 	}
 
@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 
 	"oci-image-builder/internal/config"
+	"oci-image-builder/internal/provenance"
 )
 
 // buildRemoteMacOS builds an image on a macOS ARM64 builder via its linux-builder VM.
@@ -16,7 +17,8 @@ import (
 // 3. Build inside VM
 // 4. Copy result from VM to Mac host
 // 5. Copy result from Mac host to local machine
-func (b *Builder) buildRemoteMacOS(ctx context.Context, image *config.ImageDef) (string, error) {
+// The build is described in inv.
+func (b *Builder) buildRemoteMacOS(ctx context.Context, image *config.ImageDef, inv *provenance.Builder) (_ string, err error) {
 	builder := b.Config.ARM64Builder
 	if builder == nil {
 		return "", fmt.Errorf("ARM64 builder not configured")
@@ -30,13 +32,29 @@ func (b *Builder) buildRemoteMacOS(ctx context.Context, image *config.ImageDef)
 	vmPort := builder.GetVMPort()
 	vmUser := builder.GetVMUser()
 	vmKeyPath := builder.GetVMKeyPath()
-
+	pidFile := remotePIDFile(image.Name)
+
+	// If canceled, stop the nix build inside the VM, then any Mac-side ssh/scp
+	// hops for this image. The [b] keeps pkill from matching its own shell.
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			b.stopRemote(ctx, sshTarget, fmt.Sprintf(
+				"ssh -o StrictHostKeyChecking=no -i %s -p %d %s@localhost "+
+					"'kill $(cat ~/build-%s/%s) 2>/dev/null; rm -f ~/build-%s/%s'; "+
+					"pkill -f '[b]uild-%s' 2>/dev/null; true",
+				vmKeyPath, vmPort, vmUser, image.Name, pidFile, image.Name, pidFile,
+				image.Name,
+			))
+		}
+	}()
+
+	out := b.commandLog(image.Name)
 	b.Logger.Logf("Building %s on macOS builder %s (via linux-builder VM)...", image.Name, builder.Host)
 
 	// Step 0: Clean up old builds to free disk space
 	b.Logger.Log("Cleaning up old builds...")
 	macCleanupCmd := fmt.Sprintf("rm -f %s/result-*-nixos.qcow2 2>/dev/null || true", builder.RepoPath)
-	if err := runSSHCommand(ctx, b.Logger, sshTarget, macCleanupCmd); err != nil {
+	if err := runSSHCommand(ctx, out, sshTarget, macCleanupCmd); err != nil {
 		b.Logger.Logf("  Mac cleanup warning (non-fatal): %v", err)
 	}
 
@@ -45,24 +63,13 @@ func (b *Builder) buildRemoteMacOS(ctx context.Context, image *config.ImageDef)
 			"'rm -rf ~/build-* 2>/dev/null; nix-collect-garbage -d 2>/dev/null || true'",
 		vmKeyPath, vmPort, vmUser,
 	)
-	if err := runSSHCommand(ctx, b.Logger, sshTarget, vmCleanupCmd); err != nil {
+	if err := runSSHCommand(ctx, out, sshTarget, vmCleanupCmd); err != nil {
 		b.Logger.Logf("  VM cleanup warning (non-fatal): %v", err)
 	}
 
 	// Step 1: Sync nix files to Mac host
 	b.Logger.Log("Syncing files to Mac host...")
-	rsyncArgs := []string{
-		"-az", "--delete", "-v",
-		"-e", "ssh -o BatchMode=yes",
-		"--include=flake.nix",
-		"--include=flake.lock",
-		"--include=nix/***",
-		"--exclude=*",
-		"./",
-		fmt.Sprintf("%s:%s/", sshTarget, builder.RepoPath),
-	}
-
-	if err := runCommand(ctx, b.Logger, "rsync", rsyncArgs...); err != nil {
+	if err := runCommand(ctx, out, "rsync", flakeSyncArgs(sshTarget, builder.RepoPath)...); err != nil {
 		return "", fmt.Errorf("rsync to Mac host failed: %w", err)
 	}
 
@@ -75,22 +82,24 @@ func (b *Builder) buildRemoteMacOS(ctx context.Context, image *config.ImageDef)
 		vmKeyPath, vmPort, builder.RepoPath, vmUser, image.Name,
 	)
 
-	if err := runSSHCommand(ctx, b.Logger, sshTarget, copyToVMCmd); err != nil {
+	if err := runSSHCommand(ctx, out, sshTarget, copyToVMCmd); err != nil {
 		return "", fmt.Errorf("failed to copy files into linux-builder VM: %w", err)
 	}
 
 	// Step 3: Build inside the linux-builder VM
 	b.Logger.Log("Running nix build inside linux-builder VM...")
-	innerCmd := fmt.Sprintf(
-		"cd ~/build-%s && nix build '.#%s' --out-link result-%s --max-jobs auto --extra-experimental-features nix-command --extra-experimental-features flakes",
-		image.Name, image.FlakeTarget, image.Name,
+	nixCmd := fmt.Sprintf(
+		"nix build '.#%s' --out-link result-%s --max-jobs auto --extra-experimental-features nix-command --extra-experimental-features flakes",
+		image.FlakeTarget, image.Name,
 	)
+	innerCmd := fmt.Sprintf("cd ~/build-%s && echo $$ > %s && exec %s", image.Name, pidFile, nixCmd)
+	*inv = provenance.Builder{Kind: provenance.BuilderMacOS, Host: builder.Host, Command: nixCmd}
 	buildInVMCmd := fmt.Sprintf(
 		"ssh -o StrictHostKeyChecking=no -i %s -p %d %s@localhost '%s'",
 		vmKeyPath, vmPort, vmUser, innerCmd,
 	)
 
-	if err := runSSHCommand(ctx, b.Logger, sshTarget, buildInVMCmd); err != nil {
+	if err := runSSHCommand(ctx, out, sshTarget, buildInVMCmd); err != nil {
 		return "", fmt.Errorf("nix build in linux-builder VM failed: %w", err)
 	}
 
@@ -101,7 +110,7 @@ func (b *Builder) buildRemoteMacOS(ctx context.Context, image *config.ImageDef)
 		vmKeyPath, vmPort, vmUser, image.Name, image.Name, builder.RepoPath, image.Name,
 	)
 
-	if err := runSSHCommand(ctx, b.Logger, sshTarget, copyFromVMCmd); err != nil {
+	if err := runSSHCommand(ctx, out, sshTarget, copyFromVMCmd); err != nil {
 		return "", fmt.Errorf("failed to copy image from linux-builder VM: %w", err)
 	}
 
@@ -112,7 +121,7 @@ func (b *Builder) buildRemoteMacOS(ctx context.Context, image *config.ImageDef)
 	}
 
 	scpSrc := fmt.Sprintf("%s:%s/result-%s-nixos.qcow2", sshTarget, builder.RepoPath, image.Name)
-	if err := runCommand(ctx, b.Logger, "scp", "-o", "BatchMode=yes", scpSrc, localOutput); err != nil {
+	if err := runCommand(ctx, out, "scp", "-o", "BatchMode=yes", scpSrc, localOutput); err != nil {
 		return "", fmt.Errorf("scp from Mac host failed: %w", err)
 	}
 
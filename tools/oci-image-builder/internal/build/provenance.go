@@ -0,0 +1,69 @@
+package build
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"oci-image-builder/internal/config"
+	"oci-image-builder/internal/git"
+	"oci-image-builder/internal/provenance"
+	"oci-image-builder/internal/signing"
+)
+
+// writeProvenance writes the in-toto provenance statement of an image build
+// into result-<name>.intoto.json and returns its absolute path. The flake's
+// locked inputs are read from flake.lock; if it cannot be read they are
+// left out with a warning. A dirty tree is named by its directory, not by
+// the remote and commit it differs from.
+func (b *Builder) writeProvenance(ctx context.Context, image *config.ImageDef, outputPath string, inv provenance.Builder, startedOn time.Time) (string, error) {
+	sum, _, err := signing.FileDigest(outputPath)
+	if err != nil {
+		return "", err
+	}
+
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", fmt.Errorf("failed to write provenance: %w", err)
+	}
+	var remote, commit string
+	if !b.GitDirty {
+		remote, _ = git.RemoteURL(ctx) // No remote: the flake is named by its directory
+		commit = b.GitCommit
+	}
+
+	inputs, err := provenance.ReadLockFile("flake.lock")
+	if err != nil {
+		b.Logger.Logf("  Warning: provenance will not include flake inputs: %v", err)
+	}
+
+	data, err := provenance.Generate(&provenance.Build{
+		Image:       image.Name,
+		Arch:        string(image.Arch),
+		FlakeTarget: image.FlakeTarget,
+		FlakeURL:    provenance.FlakeURL(remote, dir, commit),
+		GitCommit:   b.GitCommit,
+		GitDirty:    b.GitDirty,
+		Builder:     inv,
+		Inputs:      inputs,
+		QcowSHA256:  sum,
+		RunID:       b.RunID,
+		StartedOn:   startedOn,
+		FinishedOn:  time.Now(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to generate provenance for %s: %w", image.Name, err)
+	}
+
+	path, err := filepath.Abs(fmt.Sprintf("result-%s%s", image.Name, provenance.Extension))
+	if err != nil {
+		return "", fmt.Errorf("failed to write provenance: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return "", fmt.Errorf("failed to write provenance: %w", err)
+	}
+	b.Logger.Logf("Provenance written to %s", path)
+	return path, nil
+}
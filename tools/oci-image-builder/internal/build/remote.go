@@ -1,19 +1,29 @@
 package build
 
 import (
-	"bufio"
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
 
 	"oci-image-builder/internal/config"
 	"oci-image-builder/internal/logger"
+	"oci-image-builder/internal/provenance"
+	"oci-image-builder/internal/tracing"
 )
 
-// buildRemote builds an image on a remote Linux ARM64 builder via SSH.
-func (b *Builder) buildRemote(ctx context.Context, image *config.ImageDef) (string, error) {
+// buildRemote builds an image on a remote Linux ARM64 builder via SSH,
+// describing the build in inv.
+func (b *Builder) buildRemote(ctx context.Context, image *config.ImageDef, inv *provenance.Builder) (_ string, err error) {
 	builder := b.Config.ARM64Builder
 	if builder == nil {
 		return "", fmt.Errorf("ARM64 builder not configured")
@@ -22,42 +32,45 @@ func (b *Builder) buildRemote(ctx context.Context, image *config.ImageDef) (stri
 	sshTarget := fmt.Sprintf("%s@%s", builder.User, builder.Host)
 	outputLink := fmt.Sprintf("result-%s", image.Name)
 	localOutput := filepath.Join(outputLink, "nixos.qcow2")
+	pidFile := remotePIDFile(image.Name)
+
+	// If canceled, stop the remote nix build; killing the local ssh client
+	// does not reliably terminate it.
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			b.stopRemote(ctx, sshTarget, fmt.Sprintf(
+				"cd %s && kill $(cat %s) 2>/dev/null; rm -f %s",
+				builder.RepoPath, pidFile, pidFile,
+			))
+		}
+	}()
 
+	out := b.commandLog(image.Name)
 	b.Logger.Logf("Building %s on remote builder %s...", image.Name, builder.Host)
 
 	// Step 0: Clean up old builds to free disk space
 	b.Logger.Log("Cleaning up old builds on remote builder...")
 	cleanupCmd := fmt.Sprintf(
-		"cd %s && rm -f result-* 2>/dev/null; nix-collect-garbage -d 2>/dev/null || true",
+		"cd %s && rm -f result-* .oci-image-builder-*.pid 2>/dev/null; nix-collect-garbage -d 2>/dev/null || true",
 		builder.RepoPath,
 	)
-	if err := runSSHCommand(ctx, b.Logger, sshTarget, cleanupCmd); err != nil {
+	if err := runSSHCommand(ctx, out, sshTarget, cleanupCmd); err != nil {
 		b.Logger.Logf("  Cleanup warning (non-fatal): %v", err)
 	}
 
 	// Step 1: Sync nix files to remote builder
 	b.Logger.Log("Syncing files to remote builder...")
-	rsyncArgs := []string{
-		"-az", "--delete", "-v",
-		"-e", "ssh -o BatchMode=yes",
-		"--include=flake.nix",
-		"--include=flake.lock",
-		"--include=nix/***",
-		"--exclude=*",
-		"./",
-		fmt.Sprintf("%s:%s/", sshTarget, builder.RepoPath),
-	}
-
-	if err := runCommand(ctx, b.Logger, "rsync", rsyncArgs...); err != nil {
+	if err := runCommand(ctx, out, "rsync", flakeSyncArgs(sshTarget, builder.RepoPath)...); err != nil {
 		return "", fmt.Errorf("rsync to remote builder failed: %w", err)
 	}
 
 	// Step 2: Run nix build on remote
 	b.Logger.Log("Running nix build on remote builder...")
-	buildCmd := fmt.Sprintf("cd %s && nix build '.#%s' --out-link result-%s",
-		builder.RepoPath, image.FlakeTarget, image.Name)
+	nixCmd := fmt.Sprintf("nix build '.#%s' --out-link result-%s", image.FlakeTarget, image.Name)
+	buildCmd := fmt.Sprintf("cd %s && echo $$ > %s && exec %s", builder.RepoPath, pidFile, nixCmd)
+	*inv = provenance.Builder{Kind: provenance.BuilderRemote, Host: builder.Host, Command: nixCmd}
 
-	if err := runSSHCommand(ctx, b.Logger, sshTarget, buildCmd); err != nil {
+	if err := runSSHCommand(ctx, out, sshTarget, buildCmd); err != nil {
 		return "", fmt.Errorf("remote nix build failed: %w", err)
 	}
 
@@ -68,7 +81,7 @@ func (b *Builder) buildRemote(ctx context.Context, image *config.ImageDef) (stri
 	}
 
 	scpSrc := fmt.Sprintf("%s:%s/result-%s/nixos.qcow2", sshTarget, builder.RepoPath, image.Name)
-	if err := runCommand(ctx, b.Logger, "scp", "-o", "BatchMode=yes", scpSrc, localOutput); err != nil {
+	if err := runCommand(ctx, out, "scp", "-o", "BatchMode=yes", scpSrc, localOutput); err != nil {
 		return "", fmt.Errorf("scp failed to copy image: %w", err)
 	}
 
@@ -81,62 +94,135 @@ func (b *Builder) buildRemote(ctx context.Context, image *config.ImageDef) (stri
 	return resolved, nil
 }
 
-// runCommand runs a command and streams its output to the logger.
-func runCommand(ctx context.Context, log *logger.Logger, name string, args ...string) error {
-	cmd := exec.CommandContext(ctx, name, args...)
-	cmd.Env = os.Environ()
-
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		return fmt.Errorf("failed to create stderr pipe: %w", err)
+// flakeSyncArgs returns the rsync arguments that copy the flake files to
+// repoPath on an SSH target.
+func flakeSyncArgs(sshTarget, repoPath string) []string {
+	return []string{
+		"-az", "--delete", "-v",
+		"-e", "ssh -o BatchMode=yes",
+		"--include=flake.nix",
+		"--include=flake.lock",
+		"--include=nix/***",
+		"--exclude=*",
+		"./",
+		fmt.Sprintf("%s:%s/", sshTarget, repoPath),
 	}
+}
 
-	if err := cmd.Start(); err != nil {
-		return err
-	}
+// commandWaitDelay bounds how long a command's output is drained after the
+// process exits or is signaled, so orphaned children holding the output pipes
+// cannot hang the pipeline.
+const commandWaitDelay = 10 * time.Second
 
-	go func() {
-		scanner := bufio.NewScanner(stderr)
-		for scanner.Scan() {
-			log.Log(scanner.Text())
-		}
-	}()
+// remoteCleanupTimeout bounds the SSH commands used to stop remote builds
+// after cancellation.
+const remoteCleanupTimeout = 30 * time.Second
 
-	return cmd.Wait()
+// remotePIDFile returns the name of the file recording the PID of a running
+// remote nix build for an image.
+func remotePIDFile(imageName string) string {
+	return fmt.Sprintf(".oci-image-builder-%s.pid", imageName)
+}
+
+// stopRemote runs command over SSH to stop remote processes left behind by
+// a canceled build. It uses a fresh context because ctx is already done.
+func (b *Builder) stopRemote(ctx context.Context, target, command string) {
+	b.Logger.Log("Build canceled, stopping remote processes...")
+
+	cleanupCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), remoteCleanupTimeout)
+	defer cancel()
+
+	if err := runSSHCommand(cleanupCtx, b.Logger, target, command); err != nil {
+		b.Logger.Logf("  Remote cleanup warning: %v", err)
+	}
+}
+
+// runCommand runs a command and streams its stderr to the logger.
+func runCommand(ctx context.Context, log *logger.Logger, name string, args ...string) error {
+	return runLogged(ctx, log, false, name, args...)
 }
 
 // runSSHCommand runs a command over SSH and streams its output.
 func runSSHCommand(ctx context.Context, log *logger.Logger, target, command string) error {
-	cmd := exec.CommandContext(ctx, "ssh", "-o", "BatchMode=yes", target, command)
-	cmd.Env = os.Environ()
+	return runLogged(ctx, log, true, "ssh", "-o", "BatchMode=yes", target, command)
+}
 
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		return fmt.Errorf("failed to create stderr pipe: %w", err)
+// runLogged runs a command, streaming stderr (and stdout if withStdout is set)
+// to the logger line by line.
+func runLogged(ctx context.Context, log *logger.Logger, withStdout bool, name string, args ...string) error {
+	if !withStdout {
+		return runWithStdout(ctx, log, nil, name, args...)
 	}
+	stdout := &lineWriter{log: log}
+	defer stdout.Flush()
+	return runWithStdout(ctx, log, stdout, name, args...)
+}
 
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return fmt.Errorf("failed to create stdout pipe: %w", err)
+// commandOutput runs a command, streaming stderr to the logger, and returns
+// its trimmed stdout.
+func commandOutput(ctx context.Context, log *logger.Logger, name string, args ...string) (string, error) {
+	var stdout bytes.Buffer
+	err := runWithStdout(ctx, log, &stdout, name, args...)
+	return strings.TrimSpace(stdout.String()), err
+}
+
+// runWithStdout runs a command, streaming stderr to the logger line by line
+// and writing stdout to stdout if it is not nil. When ctx is canceled the
+// process receives SIGTERM so tools like nix and ssh can shut down cleanly.
+// Each command is traced as a span.
+func runWithStdout(ctx context.Context, log *logger.Logger, stdout io.Writer, name string, args ...string) (err error) {
+	ctx, span := tracing.Start(ctx, "exec "+name,
+		attribute.String("process.executable.name", name),
+		attribute.StringSlice("process.command_args", args))
+	defer func() {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			span.SetAttributes(attribute.Int("process.exit.code", exitErr.ExitCode()))
+		}
+		tracing.End(span, err)
+	}()
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Env = os.Environ()
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(syscall.SIGTERM)
 	}
+	cmd.WaitDelay = commandWaitDelay
 
-	if err := cmd.Start(); err != nil {
-		return err
+	stderr := &lineWriter{log: log}
+	defer stderr.Flush()
+	cmd.Stderr = stderr
+	if stdout != nil {
+		cmd.Stdout = stdout
 	}
 
-	go func() {
-		scanner := bufio.NewScanner(stderr)
-		for scanner.Scan() {
-			log.Log(scanner.Text())
-		}
-	}()
+	return cmd.Run()
+}
+
+// lineWriter is an io.Writer that sends each complete line to a logger.
+type lineWriter struct {
+	log *logger.Logger
+	buf []byte
+}
 
-	go func() {
-		scanner := bufio.NewScanner(stdout)
-		for scanner.Scan() {
-			log.Log(scanner.Text())
+// Write implements io.Writer.
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
 		}
-	}()
+		w.log.Log(string(bytes.TrimRight(w.buf[:i], "\r")))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
 
-	return cmd.Wait()
+// Flush logs any buffered partial line.
+func (w *lineWriter) Flush() {
+	if len(w.buf) > 0 {
+		w.log.Log(string(w.buf))
+		w.buf = nil
+	}
 }
@@ -0,0 +1,315 @@
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"oci-image-builder/internal/config"
+	"oci-image-builder/internal/logger"
+	"oci-image-builder/internal/signing"
+)
+
+// maxDiffoscopeLines bounds the diffoscope output kept in a ReproResult.
+const maxDiffoscopeLines = 200
+
+// ReproMode selects where the second build of a reproducibility check runs.
+type ReproMode string
+
+const (
+	ReproRebuild ReproMode = "rebuild" // Locally, with nix build --rebuild
+	ReproRemote  ReproMode = "remote"  // On the remote builder
+)
+
+// BuildOutput describes one build of an image in a reproducibility check.
+type BuildOutput struct {
+	Where      string            // "local", "local rebuild" or the builder host
+	OutPath    string            // Nix output path
+	NarHash    string            // NAR hash of OutPath
+	QcowSHA256 string            // SHA-256 of nixos.qcow2 in OutPath
+	Closure    map[string]string // NAR hashes of the closure, by store path
+}
+
+// PathDiff is a store path whose contents differ between two builds. A hash
+// is empty if the path is missing from that build's closure.
+type PathDiff struct {
+	Path   string
+	First  string
+	Second string
+}
+
+// ReproResult is the outcome of VerifyRepro.
+type ReproResult struct {
+	ImageName   string
+	First       BuildOutput
+	Second      BuildOutput
+	Differences []PathDiff
+	Diffoscope  string // diffoscope output for the differing qcow2 files, if run
+}
+
+// Reproducible reports whether both builds produced identical outputs.
+func (r *ReproResult) Reproducible() bool {
+	return r.First.QcowSHA256 == r.Second.QcowSHA256 &&
+		r.First.NarHash == r.Second.NarHash &&
+		len(r.Differences) == 0
+}
+
+// VerifyRepro builds an image twice and compares the outputs. The first
+// build is local. In ReproRebuild mode the image derivation is rebuilt with
+// 'nix build --rebuild' against the dependencies in the store; in
+// ReproRemote mode the image is built again on the remote builder and the
+// whole closures are compared.
+func (b *Builder) VerifyRepro(ctx context.Context, imageName string, mode ReproMode) (*ReproResult, error) {
+	image := b.Config.GetImage(imageName)
+	if image == nil {
+		return nil, fmt.Errorf("unknown image: %s", imageName)
+	}
+
+	out := b.commandLog(imageName)
+	target := fmt.Sprintf(".#%s", image.FlakeTarget)
+	// Keep the output of the build that is uploaded in result-<name>
+	outputLink := fmt.Sprintf("result-%s-repro", image.Name)
+
+	b.Logger.Logf("Building %s locally...", imageName)
+	outPath, err := commandOutput(ctx, out, "nix", "build", target, "--out-link", outputLink, "--print-out-paths")
+	if err != nil {
+		return nil, fmt.Errorf("nix build failed: %w", err)
+	}
+	first, err := localBuildOutput(ctx, out, "local", lastLine(outPath))
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ReproResult{ImageName: imageName, First: *first}
+	switch mode {
+	case ReproRebuild:
+		err = b.rebuildLocal(ctx, result, target, outputLink)
+	case ReproRemote:
+		err = b.rebuildRemote(ctx, result, image)
+	default:
+		err = fmt.Errorf("unknown reproducibility mode %q", mode)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// rebuildLocal rebuilds the image derivation with --rebuild. Nix fails the
+// build if the output differs, keeping the new output next to the old one
+// with a .check suffix.
+func (b *Builder) rebuildLocal(ctx context.Context, result *ReproResult, target, outputLink string) error {
+	out := b.commandLog(result.ImageName)
+	b.Logger.Logf("Rebuilding %s locally...", result.ImageName)
+
+	buildErr := runLogged(ctx, out, true, "nix", "build", target, "--out-link", outputLink, "--rebuild", "--keep-failed")
+	if buildErr == nil {
+		// Nix checked that the outputs are identical
+		result.Second = result.First
+		result.Second.Where = "local rebuild"
+		return nil
+	}
+
+	checkPath := result.First.OutPath + ".check"
+	if ctx.Err() != nil {
+		return fmt.Errorf("nix build --rebuild failed: %w", buildErr)
+	}
+	if _, err := os.Stat(checkPath); err != nil {
+		return fmt.Errorf("nix build --rebuild failed: %w", buildErr)
+	}
+
+	narHash, err := commandOutput(ctx, out, "nix", "hash", "path", checkPath)
+	if err != nil {
+		return fmt.Errorf("failed to hash %s: %w", checkPath, err)
+	}
+	qcowHash, _, err := signing.FileDigest(filepath.Join(checkPath, "nixos.qcow2"))
+	if err != nil {
+		return err
+	}
+
+	result.Second = BuildOutput{
+		Where:      "local rebuild",
+		OutPath:    checkPath,
+		NarHash:    narHash,
+		QcowSHA256: qcowHash,
+	}
+	result.Differences = []PathDiff{{Path: result.First.OutPath, First: result.First.NarHash, Second: narHash}}
+
+	if _, err := exec.LookPath("diffoscope"); err == nil {
+		b.Logger.Log("Comparing the qcow2 files with diffoscope...")
+		result.Diffoscope = diffoscope(ctx, out,
+			filepath.Join(result.First.OutPath, "nixos.qcow2"),
+			filepath.Join(checkPath, "nixos.qcow2"))
+	}
+	return nil
+}
+
+// rebuildRemote builds the image on the remote builder and compares the
+// remote closure with the local one.
+func (b *Builder) rebuildRemote(ctx context.Context, result *ReproResult, image *config.ImageDef) (err error) {
+	builder := b.Config.ARM64Builder
+	if builder == nil {
+		return fmt.Errorf("ARM64 builder not configured")
+	}
+	if builder.IsMacOS {
+		return fmt.Errorf("remote reproducibility checks are not supported on macOS builders")
+	}
+
+	sshTarget := fmt.Sprintf("%s@%s", builder.User, builder.Host)
+	pidFile := remotePIDFile(image.Name)
+
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			b.stopRemote(ctx, sshTarget, fmt.Sprintf(
+				"cd %s && kill $(cat %s) 2>/dev/null; rm -f %s",
+				builder.RepoPath, pidFile, pidFile,
+			))
+		}
+	}()
+
+	out := b.commandLog(image.Name)
+	b.Logger.Logf("Building %s on remote builder %s...", image.Name, builder.Host)
+
+	b.Logger.Log("Syncing files to remote builder...")
+	if err := runCommand(ctx, out, "rsync", flakeSyncArgs(sshTarget, builder.RepoPath)...); err != nil {
+		return fmt.Errorf("rsync to remote builder failed: %w", err)
+	}
+
+	b.Logger.Log("Running nix build on remote builder...")
+	buildCmd := fmt.Sprintf("cd %s && echo $$ > %s && exec nix build '.#%s' --out-link result-%s-repro --print-out-paths",
+		builder.RepoPath, pidFile, image.FlakeTarget, image.Name)
+	outPath, err := commandOutput(ctx, out, "ssh", "-o", "BatchMode=yes", sshTarget, buildCmd)
+	if err != nil {
+		return fmt.Errorf("remote nix build failed: %w", err)
+	}
+	outPath = lastLine(outPath)
+
+	pathInfo, err := commandOutput(ctx, out, "ssh", "-o", "BatchMode=yes", sshTarget,
+		"nix path-info --recursive --json "+outPath)
+	if err != nil {
+		return fmt.Errorf("failed to get remote closure of %s: %w", outPath, err)
+	}
+	closure, err := parsePathInfo([]byte(pathInfo))
+	if err != nil {
+		return err
+	}
+
+	sum, err := commandOutput(ctx, out, "ssh", "-o", "BatchMode=yes", sshTarget,
+		"sha256sum "+outPath+"/nixos.qcow2")
+	if err != nil {
+		return fmt.Errorf("failed to hash remote qcow2: %w", err)
+	}
+	qcowHash, _, _ := strings.Cut(sum, " ")
+
+	result.Second = BuildOutput{
+		Where:      builder.Host,
+		OutPath:    outPath,
+		NarHash:    closure[outPath],
+		QcowSHA256: qcowHash,
+		Closure:    closure,
+	}
+	result.Differences = diffClosures(result.First.Closure, closure)
+	return nil
+}
+
+// localBuildOutput describes a local build output from its closure and
+// qcow2 file.
+func localBuildOutput(ctx context.Context, out *logger.Logger, where, outPath string) (*BuildOutput, error) {
+	pathInfo, err := commandOutput(ctx, out, "nix", "path-info", "--recursive", "--json", outPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get closure of %s: %w", outPath, err)
+	}
+	closure, err := parsePathInfo([]byte(pathInfo))
+	if err != nil {
+		return nil, err
+	}
+
+	qcowHash, _, err := signing.FileDigest(filepath.Join(outPath, "nixos.qcow2"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &BuildOutput{
+		Where:      where,
+		OutPath:    outPath,
+		NarHash:    closure[outPath],
+		QcowSHA256: qcowHash,
+		Closure:    closure,
+	}, nil
+}
+
+// parsePathInfo returns the NAR hashes from 'nix path-info --json' output,
+// by store path. Newer Nix versions print an object keyed by path, older
+// ones an array of entries with a path field.
+func parsePathInfo(data []byte) (map[string]string, error) {
+	type entry struct {
+		Path    string `json:"path"`
+		NarHash string `json:"narHash"`
+	}
+
+	hashes := make(map[string]string)
+
+	var byPath map[string]entry
+	if err := json.Unmarshal(data, &byPath); err == nil {
+		for path, e := range byPath {
+			hashes[path] = e.NarHash
+		}
+		return hashes, nil
+	}
+
+	var list []entry
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse nix path-info output: %w", err)
+	}
+	for _, e := range list {
+		hashes[e.Path] = e.NarHash
+	}
+	return hashes, nil
+}
+
+// diffClosures returns the store paths whose NAR hashes differ between two
+// closures, or that are in only one of them, sorted by path.
+func diffClosures(first, second map[string]string) []PathDiff {
+	var diffs []PathDiff
+	for path, hash := range first {
+		if second[path] != hash {
+			diffs = append(diffs, PathDiff{Path: path, First: hash, Second: second[path]})
+		}
+	}
+	for path, hash := range second {
+		if _, ok := first[path]; !ok {
+			diffs = append(diffs, PathDiff{Path: path, Second: hash})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Path < diffs[j].Path })
+	return diffs
+}
+
+// diffoscope returns diffoscope's text report for two files, truncated to
+// maxDiffoscopeLines lines.
+func diffoscope(ctx context.Context, out *logger.Logger, first, second string) string {
+	// diffoscope exits with status 1 when the files differ
+	report, err := commandOutput(ctx, out, "diffoscope", "--text", "-", first, second)
+	var exitErr *exec.ExitError
+	if err != nil && !(errors.As(err, &exitErr) && exitErr.ExitCode() == 1) {
+		out.Logf("  Warning: diffoscope failed: %v", err)
+	}
+
+	lines := strings.Split(report, "\n")
+	if len(lines) > maxDiffoscopeLines {
+		lines = append(lines[:maxDiffoscopeLines], fmt.Sprintf("... (%d more lines)", len(lines)-maxDiffoscopeLines))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// lastLine returns the last line of s.
+func lastLine(s string) string {
+	return s[strings.LastIndexByte(s, '\n')+1:]
+}
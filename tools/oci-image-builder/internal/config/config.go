@@ -3,11 +3,14 @@
 package config
 
 import (
+	"errors"
 	"fmt"
+	"net/url"
 	"os"
 	"path/filepath"
-
-	"github.com/pelletier/go-toml/v2"
+	"slices"
+	"sort"
+	"strings"
 )
 
 // Arch represents the target architecture for an image.
@@ -18,11 +21,50 @@ const (
 	ArchAarch64 Arch = "aarch64"
 )
 
+// EnvironmentTagKey is the freeform tag recording which environment an
+// image was imported for. Image listing and pruning only consider images
+// carrying the selected environment's tag.
+const EnvironmentTagKey = "oci-image-builder-env"
+
 // Config is the root configuration structure.
 type Config struct {
-	OCI          OCIConfig       `toml:"oci"`
-	ARM64Builder *ARM64Builder   `toml:"arm64_builder"`
-	Images       []ImageDef      `toml:"images"`
+	OCI          OCIConfig     `toml:"oci"`
+	Bucket       BucketConfig  `toml:"bucket"`
+	Import       ImportConfig  `toml:"import"`
+	Metrics      MetricsConfig `toml:"metrics"`
+	Tracing      TracingConfig `toml:"tracing"`
+	SBOM         SBOMConfig    `toml:"sbom"`
+	Signing      SigningConfig `toml:"signing"`
+	ARM64Builder *ARM64Builder `toml:"arm64_builder"`
+	Images       []ImageDef    `toml:"images"`
+	Hooks        []HookConfig  `toml:"hooks"`
+
+	// TfvarsPath, if set, is a terraform.tfvars file updated with the
+	// image OCIDs after a successful import.
+	TfvarsPath string `toml:"tfvars_path"`
+
+	// Named environments overriding parts of [oci], selected with --env
+	// or default_environment.
+	DefaultEnvironment string                 `toml:"default_environment"`
+	Environments       map[string]Environment `toml:"environments"`
+
+	// Environment is the name of the selected environment, if any.
+	Environment string `toml:"-"`
+
+	path      string              // Config file loaded, if any
+	sources   map[string]string   // Source of each non-default field, by key
+	positions map[string]position // Position of each key in the config file
+}
+
+// Environment overrides OCI settings for a deployment target such as prod
+// or staging. Empty fields keep the value from [oci].
+type Environment struct {
+	CompartmentOCID string            `toml:"compartment_ocid"`
+	BucketName      string            `toml:"bucket_name"`
+	Region          string            `toml:"region"`
+	Profile         string            `toml:"profile"`
+	Tags            map[string]string `toml:"tags"` // Merged over oci.tags
+	TfvarsPath      string            `toml:"tfvars_path"`
 }
 
 // OCIConfig contains OCI-specific configuration.
@@ -35,8 +77,209 @@ type OCIConfig struct {
 	PollIntervalSecs int    `toml:"poll_interval_secs"`
 	MaxWaitSecs      int    `toml:"max_wait_secs"`
 	InitialDelaySecs int    `toml:"initial_delay_secs"`
+
+	// Import wait backoff: the poll interval starts at PollIntervalSecs and is
+	// multiplied by BackoffFactor after each poll, up to MaxPollIntervalSecs.
+	// PollJitter randomizes each interval by up to that fraction (0.2 = ±20%).
+	MaxPollIntervalSecs int     `toml:"max_poll_interval_secs"`
+	BackoffFactor       float64 `toml:"backoff_factor"`
+	PollJitter          float64 `toml:"poll_jitter"`
+
+	// What to do with an in-flight multipart upload when the run is
+	// interrupted: "abort" (default) or "preserve" so resume can continue it.
+	UploadInterruptPolicy string `toml:"upload_interrupt_policy"`
+
+	// Freeform tags applied to imported images.
+	Tags map[string]string `toml:"tags"`
+}
+
+// BucketConfig controls how 'ensure-bucket' provisions the upload bucket.
+type BucketConfig struct {
+	// Create the bucket on first upload if it does not exist.
+	AutoCreate bool `toml:"auto_create"`
+
+	StorageTier string `toml:"storage_tier"` // "Standard" or "Archive", set on creation only
+	KMSKeyID    string `toml:"kms_key_id"`   // OCI Vault key OCID; Oracle-managed keys if empty
+
+	// Once an image is AVAILABLE its qcow2 object is moved under
+	// LifecyclePrefix, where a lifecycle rule applies LifecycleAction
+	// ("ARCHIVE" or "DELETE") after LifecycleDays. Empty action: no rule.
+	LifecycleAction string `toml:"lifecycle_action"`
+	LifecycleDays   int    `toml:"lifecycle_days"`
+	LifecyclePrefix string `toml:"lifecycle_prefix"`
+}
+
+// ImportConfig controls how uploaded objects are imported as images.
+type ImportConfig struct {
+	// "tuple" (default) imports by namespace, bucket and object name, which
+	// needs the bucket in the image's tenancy and region. "par" imports
+	// through a short-lived pre-authenticated request for the object, which
+	// is deleted once the import finishes.
+	Mode          string `toml:"mode"`
+	PARExpirySecs int    `toml:"par_expiry_secs"` // PAR lifetime; must cover the import
+
+	// Where the image is created, if not oci.region, oci.profile and
+	// oci.compartment_ocid. A different region or profile needs mode "par".
+	Region          string `toml:"region"`
+	Profile         string `toml:"profile"`
+	CompartmentOCID string `toml:"compartment_ocid"`
 }
 
+// Import modes for ImportConfig.
+const (
+	ImportModeTuple = "tuple"
+	ImportModePAR   = "par"
+)
+
+// MetricsConfig controls the Prometheus metrics exported at the end of each
+// run of 'all' and 'resume'. Nothing is exported if both targets are empty.
+type MetricsConfig struct {
+	TextfilePath   string `toml:"textfile_path"`   // node_exporter textfile collector file, ending in .prom
+	PushgatewayURL string `toml:"pushgateway_url"` // Pushgateway to push to, e.g. http://pushgateway:9091
+	Job            string `toml:"job"`             // Pushgateway job name
+}
+
+// TracingConfig controls the OpenTelemetry traces of 'all' and 'resume'
+// runs. Nothing is exported if the endpoint is empty.
+type TracingConfig struct {
+	Endpoint string `toml:"endpoint"` // OTLP/HTTP collector, e.g. http://localhost:4318 (/v1/traces is appended if there is no path)
+}
+
+// SBOM formats.
+const (
+	SBOMCycloneDX = "cyclonedx"
+	SBOMSPDX      = "spdx"
+	SBOMNone      = "none"
+)
+
+// SBOMConfig controls the software bill of materials produced for each
+// built image.
+type SBOMConfig struct {
+	Format string `toml:"format"` // cyclonedx, spdx or none (the default)
+}
+
+// Extension returns the file extension of SBOMs in the configured format,
+// or "" if SBOMs are disabled.
+func (s SBOMConfig) Extension() string {
+	switch s.Format {
+	case SBOMCycloneDX:
+		return ".cdx.json"
+	case SBOMSPDX:
+		return ".spdx.json"
+	}
+	return ""
+}
+
+// Signing algorithms for KMS keys.
+const (
+	SigningECDSASHA256 = "ECDSA_SHA_256"
+	SigningECDSASHA384 = "ECDSA_SHA_384"
+	SigningECDSASHA512 = "ECDSA_SHA_512"
+)
+
+// SigningConfig controls the signed manifests uploaded next to each qcow2
+// and checked before import. Either an ed25519 key or an OCI Vault key is
+// used; signing is off if neither is set.
+type SigningConfig struct {
+	KeyPath       string `toml:"key_path"`        // ed25519 private key, PKCS#8 PEM
+	PublicKeyPath string `toml:"public_key_path"` // ed25519 public key, PKIX PEM, to verify without the private key
+
+	KMSKeyID          string `toml:"kms_key_id"`          // OCI Vault asymmetric key OCID
+	KMSCryptoEndpoint string `toml:"kms_crypto_endpoint"` // The vault's cryptographic endpoint
+	KMSAlgorithm      string `toml:"kms_algorithm"`       // ECDSA_SHA_256, ECDSA_SHA_384 or ECDSA_SHA_512
+}
+
+// Enabled reports whether manifests are signed and verified.
+func (s SigningConfig) Enabled() bool {
+	return s.KeyPath != "" || s.PublicKeyPath != "" || s.KMSKeyID != ""
+}
+
+// ImageCompartment returns the compartment images are created in.
+func (c *Config) ImageCompartment() string {
+	if c.Import.CompartmentOCID != "" {
+		return c.Import.CompartmentOCID
+	}
+	return c.OCI.CompartmentOCID
+}
+
+// InstanceCompartments returns the distinct compartments instances launched
+// from the images may run in: oci.compartment_ocid, import.compartment_ocid
+// and those of every environment.
+func (c *Config) InstanceCompartments() []string {
+	var ids []string
+	add := func(id string) {
+		if id != "" && !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	add(c.ImageCompartment())
+	add(c.OCI.CompartmentOCID)
+	for _, name := range c.EnvironmentNames() {
+		add(c.Environments[name].CompartmentOCID)
+	}
+	return ids
+}
+
+// HookConfig runs a command or calls a webhook when pipeline events occur.
+// Exactly one of Command and URL is set.
+type HookConfig struct {
+	Name         string   `toml:"name"`          // Shown in the log; defaults to the command or URL host
+	Events       []string `toml:"events"`        // Events that fire the hook, all if empty
+	Command      string   `toml:"command"`       // Run with sh -c, the JSON payload on stdin
+	URL          string   `toml:"url"`           // POSTed the JSON payload
+	TimeoutSecs  int      `toml:"timeout_secs"`  // Default DefaultHookTimeoutSecs
+	FailPipeline bool     `toml:"fail_pipeline"` // Stop the run if the hook fails
+}
+
+// DefaultHookTimeoutSecs bounds a hook without timeout_secs.
+const DefaultHookTimeoutSecs = 60
+
+// Hook events.
+const (
+	HookRunStart       = "run_start"
+	HookBuildComplete  = "build_complete"
+	HookUploadComplete = "upload_complete"
+	HookImportComplete = "import_complete"
+	HookImageFailed    = "image_failed"
+	HookRunFailed      = "run_failed"
+	HookRunComplete    = "run_complete"
+)
+
+// HookEvents lists the events hooks can subscribe to.
+var HookEvents = []string{
+	HookRunStart, HookBuildComplete, HookUploadComplete, HookImportComplete,
+	HookImageFailed, HookRunFailed, HookRunComplete,
+}
+
+// DisplayName returns the name the hook is logged as. Webhooks without a
+// name are shown by host, since their URL may hold a token.
+func (h *HookConfig) DisplayName() string {
+	switch {
+	case h.Name != "":
+		return h.Name
+	case h.Command != "":
+		return h.Command
+	}
+	if u, err := url.Parse(h.URL); err == nil {
+		return u.Host
+	}
+	return "webhook"
+}
+
+// Storage tiers and lifecycle actions for BucketConfig.
+const (
+	StorageTierStandard    = "Standard"
+	StorageTierArchive     = "Archive"
+	LifecycleActionArchive = "ARCHIVE"
+	LifecycleActionDelete  = "DELETE"
+)
+
+// Upload interrupt policies.
+const (
+	UploadInterruptAbort    = "abort"
+	UploadInterruptPreserve = "preserve"
+)
+
 // ARM64Builder contains configuration for remote ARM64 builds.
 type ARM64Builder struct {
 	Host     string `toml:"host"`
@@ -87,10 +330,32 @@ type ImageDef struct {
 func DefaultConfig() *Config {
 	return &Config{
 		OCI: OCIConfig{
-			PollIntervalSecs: 30,
-			MaxWaitSecs:      1800,
-			InitialDelaySecs: 30,
-			Auth:             "api_key",
+			PollIntervalSecs:      30,
+			MaxWaitSecs:           1800,
+			InitialDelaySecs:      30,
+			MaxPollIntervalSecs:   120,
+			BackoffFactor:         1.5,
+			PollJitter:            0.2,
+			UploadInterruptPolicy: UploadInterruptAbort,
+			Auth:                  "api_key",
+		},
+		Bucket: BucketConfig{
+			StorageTier:     StorageTierStandard,
+			LifecycleDays:   30,
+			LifecyclePrefix: "imported/",
+		},
+		Import: ImportConfig{
+			Mode:          ImportModeTuple,
+			PARExpirySecs: 7200,
+		},
+		Metrics: MetricsConfig{
+			Job: "oci-image-builder",
+		},
+		SBOM: SBOMConfig{
+			Format: SBOMNone,
+		},
+		Signing: SigningConfig{
+			KMSAlgorithm: SigningECDSASHA256,
 		},
 		Images: []ImageDef{
 			{Name: "headscale", FlakeTarget: "oci-headscale-image", Arch: ArchX86_64, TerraformVar: "headscale_image_ocid"},
@@ -100,10 +365,18 @@ func DefaultConfig() *Config {
 	}
 }
 
-// Load loads configuration from the given path, or searches default locations.
-func Load(path string) (*Config, error) {
+// Load resolves the configuration in layers: defaults, the config file at
+// path (or found in the default locations) with the named environment
+// applied, OCI_IMAGE_BUILDER_* environment variables, and finally overrides,
+// typically from command-line flags. If env is empty, OCI_IMAGE_BUILDER_ENV
+// or default_environment is used when set.
+func Load(path, env string, overrides ...Override) (*Config, error) {
 	var configPath string
 
+	if path == "" {
+		path = os.Getenv(EnvConfigPath)
+	}
+
 	if path != "" {
 		configPath = path
 	} else {
@@ -125,56 +398,134 @@ func Load(path string) (*Config, error) {
 			}
 		}
 
-		if configPath == "" {
-			return nil, fmt.Errorf("config file not found. Run 'oci-image-builder init' to create one")
+	}
+
+	cfg := DefaultConfig()
+	var fileDiags []Diagnostic
+
+	// Without a config file everything must come from the environment or flags
+	if configPath != "" {
+		data, err := os.ReadFile(configPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file %s: %w", configPath, err)
+		}
+
+		cfg.path = configPath
+		unknown, err := cfg.decodeStrict(data)
+		if err != nil {
+			return nil, err
 		}
+		fileDiags = unknown
+		cfg.recordFileSources(data)
 	}
 
-	data, err := os.ReadFile(configPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read config file %s: %w", configPath, err)
+	if env == "" {
+		env = os.Getenv(EnvEnvironment)
+	}
+	// An unknown default_environment is reported by Validate with the rest
+	if err := cfg.UseEnvironment(env); err != nil && env != "" {
+		return nil, err
 	}
 
-	cfg := DefaultConfig()
-	if err := toml.Unmarshal(data, cfg); err != nil {
-		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	if err := cfg.applyEnvVars(); err != nil {
+		return nil, err
+	}
+	for _, o := range overrides {
+		if err := cfg.Set(o.Key, o.Value, o.Source); err != nil {
+			return nil, err
+		}
 	}
 
-	if err := cfg.Validate(); err != nil {
+	err := cfg.Validate()
+	if len(fileDiags) > 0 {
+		var verr *ValidationError
+		if errors.As(err, &verr) {
+			fileDiags = append(fileDiags, verr.Diagnostics...)
+		}
+		err = &ValidationError{Diagnostics: fileDiags}
+	}
+	if err != nil {
+		if configPath == "" {
+			return nil, fmt.Errorf("%w (no config file found; run 'oci-image-builder init' to create one)", err)
+		}
 		return nil, err
 	}
 
 	return cfg, nil
 }
 
-// Validate checks the configuration for required fields and consistency.
-func (c *Config) Validate() error {
-	if c.OCI.CompartmentOCID == "" {
-		return fmt.Errorf("oci.compartment_ocid is required")
+// UseEnvironment applies the overrides of the named environment, falling back
+// to default_environment when name is empty. With neither set the base [oci]
+// settings are used unchanged.
+func (c *Config) UseEnvironment(name string) error {
+	if name == "" {
+		name = c.DefaultEnvironment
 	}
-	if c.OCI.BucketName == "" {
-		return fmt.Errorf("oci.bucket_name is required")
+	if name == "" {
+		return nil
 	}
-	if c.OCI.Region == "" {
-		return fmt.Errorf("oci.region is required")
+
+	env, ok := c.Environments[name]
+	if !ok {
+		known := c.EnvironmentNames()
+		if len(known) == 0 {
+			return fmt.Errorf("unknown environment %q: no [environments] configured", name)
+		}
+		return fmt.Errorf("unknown environment %q (configured: %s)", name, strings.Join(known, ", "))
 	}
 
-	// Check if ARM64 builder is needed but not configured
-	hasARM64 := false
-	for _, img := range c.Images {
-		if img.Arch == ArchAarch64 {
-			hasARM64 = true
-			break
+	source := "environment " + name
+	override := func(key string, dst *string, value string) {
+		if value != "" {
+			*dst = value
+			c.setSource(key, source)
 		}
 	}
-	if hasARM64 && c.ARM64Builder == nil {
-		// Just warn, don't error - user might use --local-only
-		fmt.Fprintln(os.Stderr, "Warning: ARM64 images defined but arm64_builder not configured. Use --local-only for local builds.")
+	override("oci.compartment_ocid", &c.OCI.CompartmentOCID, env.CompartmentOCID)
+	override("oci.bucket_name", &c.OCI.BucketName, env.BucketName)
+	override("oci.region", &c.OCI.Region, env.Region)
+	override("oci.profile", &c.OCI.Profile, env.Profile)
+	override("tfvars_path", &c.TfvarsPath, env.TfvarsPath)
+
+	if len(env.Tags) > 0 {
+		tags := make(map[string]string, len(c.OCI.Tags)+len(env.Tags))
+		for k, v := range c.OCI.Tags {
+			tags[k] = v
+		}
+		for k, v := range env.Tags {
+			tags[k] = v
+		}
+		c.OCI.Tags = tags
+		c.setSource("oci.tags", source)
 	}
 
+	c.Environment = name
 	return nil
 }
 
+// EnvironmentNames returns the configured environment names, sorted.
+func (c *Config) EnvironmentNames() []string {
+	names := make([]string, 0, len(c.Environments))
+	for name := range c.Environments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ImageTags returns the freeform tags to apply to imported images,
+// including the environment tag when an environment is selected.
+func (c *Config) ImageTags() map[string]string {
+	tags := make(map[string]string, len(c.OCI.Tags)+1)
+	for k, v := range c.OCI.Tags {
+		tags[k] = v
+	}
+	if c.Environment != "" {
+		tags[EnvironmentTagKey] = c.Environment
+	}
+	return tags
+}
+
 // GetImage returns the image definition by name, or nil if not found.
 func (c *Config) GetImage(name string) *ImageDef {
 	for i := range c.Images {
@@ -197,6 +548,12 @@ func (c *Config) GetAllImageNames() []string {
 // DefaultConfigTemplate returns the template for a new config file.
 func DefaultConfigTemplate() string {
 	return `# OCI Image Builder Configuration
+#
+# Every field can be overridden with an OCI_IMAGE_BUILDER_* environment
+# variable named after its key (e.g. OCI_IMAGE_BUILDER_OCI_REGION for
+# oci.region, OCI_IMAGE_BUILDER_IMAGES_DERP_ARCH for the derp image's arch)
+# or with --set key=value. Run 'config show --resolved' to see the
+# effective value of each field and where it came from.
 
 [oci]
 # Required: Your OCI compartment OCID
@@ -214,11 +571,132 @@ region = "us-ashburn-1"
 # Authentication type: "api_key" (default) or "security_token"
 # auth = "api_key"
 
-# Polling settings for import status
+# Polling settings for import status. All pending imports are watched
+# concurrently; max_wait_secs is a single deadline for the whole wait.
 poll_interval_secs = 30
 max_wait_secs = 1800
 initial_delay_secs = 30
 
+# Exponential backoff between polls, capped at max_poll_interval_secs.
+# poll_jitter randomizes each interval by up to that fraction.
+max_poll_interval_secs = 120
+backoff_factor = 1.5
+poll_jitter = 0.2
+
+# In-flight multipart upload handling on Ctrl-C: "abort" discards the
+# uploaded parts, "preserve" keeps them so 'resume' can finish the upload.
+# upload_interrupt_policy = "abort"
+
+# Bucket provisioning, applied by 'ensure-bucket' (and on first upload with
+# auto_create). Versioning is always kept off.
+# [bucket]
+# auto_create = false
+# storage_tier = "Standard"
+# kms_key_id = "ocid1.key.oc1.iad.examplevault.examplekey"
+#
+# Once an image is AVAILABLE, move its qcow2 under lifecycle_prefix and
+# "ARCHIVE" or "DELETE" it after lifecycle_days. Object Storage needs an IAM
+# policy allowing it to manage objects for lifecycle rules to run.
+# lifecycle_action = "DELETE"
+# lifecycle_days = 30
+# lifecycle_prefix = "imported/"
+
+# Image import. mode = "par" imports through a short-lived pre-authenticated
+# request for the object instead of by bucket and object name, so the image
+# can be created in another region or tenancy. The request is deleted once
+# the import finishes.
+# [import]
+# mode = "tuple"
+# par_expiry_secs = 7200
+# region = "us-phoenix-1"
+# profile = "OTHER_TENANCY"
+# compartment_ocid = "ocid1.compartment.oc1..other"
+
+# Optional: Prometheus metrics (stage durations, upload size and throughput,
+# import wait, failures and image sizes), written at the end of each run of
+# 'all' and 'resume' to a node_exporter textfile collector file and/or
+# pushed to a Pushgateway.
+# [metrics]
+# textfile_path = "/var/lib/node_exporter/textfile/oci_image_builder.prom"
+# pushgateway_url = "http://pushgateway:9091"
+# job = "oci-image-builder"
+
+# Optional: OpenTelemetry traces of each run of 'all' and 'resume', exported
+# over OTLP/HTTP. Each run is a trace with a span per image and stage, and
+# spans for every ssh, rsync, scp and nix command, multipart part and OCI
+# API request, retries included. Spans are sent to /v1/traces on the
+# endpoint unless it has another path.
+# [tracing]
+# endpoint = "http://localhost:4318"
+
+# Optional: software bill of materials for each image, generated from the
+# derivations it is built from: package names, versions, licences (from the
+# flake's nixpkgs input), store paths and source URLs. It is written to
+# result-<image>.cdx.json (or .spdx.json), uploaded next to the qcow2 with
+# the same object name stem, and named in the image's oci-image-builder-sbom
+# tag. format is "cyclonedx", "spdx" or "none" (the default). Generating
+# one evaluates the image's full derivation graph and nixpkgs' metadata,
+# which is slow and memory hungry.
+# [sbom]
+# format = "cyclonedx"
+
+# Signed manifests. After upload, a manifest of the object name, SHA-256,
+# size, flake target and git commit is signed and uploaded next to the qcow2
+# as <object>.manifest.json and <object>.manifest.json.sig. import and
+# resume check the signature and the object's SHA-256 before creating the
+# image, and refuse unsigned or mismatched objects. Use an ed25519 key
+# (openssl genpkey -algorithm ed25519 -out signing.pem), or only its public
+# key on hosts that import but do not upload, or an OCI Vault ECDSA key.
+# Set one of key_path, public_key_path and kms_key_id.
+# [signing]
+# key_path = "/etc/oci-image-builder/signing.pem"
+# public_key_path = "/etc/oci-image-builder/signing.pub.pem"
+# kms_key_id = "ocid1.key.oc1.iad.xxxxx.yyyyy"
+# kms_crypto_endpoint = "https://xxxxx-crypto.kms.us-ashburn-1.oraclecloud.com"
+# kms_algorithm = "ECDSA_SHA_256"
+
+# Optional: freeform tags applied to imported images
+# [oci.tags]
+# project = "headscale"
+
+# Optional: terraform.tfvars file to update with image OCIDs after import
+# tfvars_path = "terraform/terraform.tfvars"
+
+# Optional: named environments, selected with --env. Each may override
+# compartment_ocid, bucket_name, region, profile, tags and tfvars_path.
+# Images are tagged with their environment, and list, prune and pipeline
+# state only see the selected environment.
+# default_environment = "staging"
+#
+# [environments.prod]
+# compartment_ocid = "ocid1.compartment.oc1..prod"
+# tfvars_path = "terraform/environments/prod/terraform.tfvars"
+#
+# [environments.staging]
+# compartment_ocid = "ocid1.compartment.oc1..staging"
+# bucket_name = "nixos-images-staging"
+# tfvars_path = "terraform/environments/staging/terraform.tfvars"
+# [environments.staging.tags]
+# environment = "staging"
+
+# Optional: hooks run on pipeline events with a JSON payload describing the
+# run, the image and the image OCIDs produced so far. Events: run_start,
+# build_complete, upload_complete, import_complete, image_failed, run_failed
+# and run_complete; all if events is omitted. A command runs with sh -c and
+# gets the payload on stdin, a url is POSTed it. A failing hook only logs a
+# warning unless fail_pipeline is set.
+# [[hooks]]
+# name = "chat"
+# events = ["import_complete", "image_failed"]
+# url = "https://chat.example.com/hooks/oci-image-builder"
+#
+# [[hooks]]
+# name = "tofu plan"
+# events = ["run_complete"]
+# command = "cd terraform && tofu plan -input=false"
+# timeout_secs = 600
+# fail_pipeline = true
+
 # ARM64 remote builder (required for aarch64 images unless using --local-only)
 # [arm64_builder]
 # host = "192.168.1.100"
@@ -0,0 +1,390 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+// EnvPrefix prefixes the environment variables that override config fields.
+// A field's variable is the prefix followed by its key in upper case with
+// dots replaced by underscores, e.g. OCI_IMAGE_BUILDER_OCI_REGION for
+// oci.region or OCI_IMAGE_BUILDER_IMAGES_DERP_FLAKE_TARGET for the derp
+// image's flake_target.
+const EnvPrefix = "OCI_IMAGE_BUILDER_"
+
+// Environment variables that select the config file and environment, like
+// the --config and --env flags.
+const (
+	EnvConfigPath  = EnvPrefix + "CONFIG"
+	EnvEnvironment = EnvPrefix + "ENV"
+)
+
+// Sources of a resolved config value, lowest precedence first.
+const (
+	SourceDefault = "default"
+	SourceFile    = "file"
+)
+
+// redacted replaces secret values in resolved config output.
+const redacted = "<redacted>"
+
+// secretWords mark a key as holding a secret when they appear in its name.
+var secretWords = []string{"secret", "token", "password", "passphrase", "credential", "private_key"}
+
+// Override sets a config field from a source above the config file.
+type Override struct {
+	Key    string // Field key, e.g. "oci.region"
+	Value  string
+	Source string // e.g. "flag --region"
+}
+
+// Field is a resolved config value and where it came from.
+type Field struct {
+	Key    string
+	Value  string // Formatted as in TOML, or redacted
+	Source string
+	Secret bool
+}
+
+// EnvVarName returns the environment variable that overrides key.
+func EnvVarName(key string) string {
+	return EnvPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(key))
+}
+
+// Path returns the config file the configuration was loaded from, or an
+// empty string if none was found.
+func (c *Config) Path() string {
+	return c.path
+}
+
+// Fields returns every config field with its effective value and source,
+// sorted by key. Secret values are redacted.
+func (c *Config) Fields() []Field {
+	var fields []Field
+	walkFields(reflect.ValueOf(c).Elem(), "", "", func(key string, v reflect.Value, sf reflect.StructField) {
+		secret := sf.Tag.Get("secret") == "true" || isSecretKey(key)
+		value := formatValue(v)
+		switch {
+		case secret && value != "":
+			value = redacted
+		case v.Kind() == reflect.Map:
+			value = strconv.Quote(formatTags(v.Interface().(map[string]string), true))
+		case v.Kind() == reflect.String:
+			value = strconv.Quote(value)
+		}
+		fields = append(fields, Field{Key: key, Value: value, Source: c.source(key), Secret: secret})
+	})
+
+	sort.SliceStable(fields, func(i, j int) bool { return fields[i].Key < fields[j].Key })
+	return fields
+}
+
+// Set parses value into the field named by key and records its source.
+func (c *Config) Set(key, value, source string) error {
+	var (
+		found  bool
+		setErr error
+	)
+	walkFields(reflect.ValueOf(c).Elem(), "", key, func(k string, v reflect.Value, sf reflect.StructField) {
+		if k != key {
+			return
+		}
+		found = true
+		setErr = parseValue(v, value)
+	})
+
+	if !found {
+		return fmt.Errorf("unknown config key %q (from %s)", key, source)
+	}
+	if setErr != nil {
+		return fmt.Errorf("invalid value for %s (from %s): %w", key, source, setErr)
+	}
+
+	c.setSource(key, source)
+	return nil
+}
+
+// applyEnvVars applies OCI_IMAGE_BUILDER_* overrides from the environment.
+func (c *Config) applyEnvVars() error {
+	var keys []string
+	walkFields(reflect.ValueOf(c).Elem(), "", "", func(key string, v reflect.Value, sf reflect.StructField) {
+		keys = append(keys, key)
+	})
+
+	for _, key := range keys {
+		name := EnvVarName(key)
+		if value, ok := os.LookupEnv(name); ok {
+			if err := c.Set(key, value, "env "+name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// recordFileSources marks the keys present in the config file data.
+func (c *Config) recordFileSources(data []byte) {
+	var raw map[string]any
+	if err := toml.Unmarshal(data, &raw); err != nil {
+		return
+	}
+
+	var visit func(prefix string, m map[string]any)
+	visit = func(prefix string, m map[string]any) {
+		for name, value := range m {
+			key := joinKey(prefix, name)
+			switch v := value.(type) {
+			case map[string]any:
+				if key == "environments" {
+					continue
+				}
+				if key == "oci.tags" {
+					c.setSource(key, SourceFile)
+					continue
+				}
+				visit(key, v)
+			case []any:
+				if key != "images" {
+					c.setSource(key, SourceFile)
+					continue
+				}
+				for _, item := range v {
+					img, ok := item.(map[string]any)
+					if !ok {
+						continue
+					}
+					if name, ok := img["name"].(string); ok {
+						visit("images."+name, img)
+					}
+				}
+			default:
+				c.setSource(key, SourceFile)
+			}
+		}
+	}
+	visit("", raw)
+}
+
+// source returns where the value of key came from.
+func (c *Config) source(key string) string {
+	if src, ok := c.sources[key]; ok {
+		return src
+	}
+	return SourceDefault
+}
+
+// setSource records where the value of key came from.
+func (c *Config) setSource(key, source string) {
+	if c.sources == nil {
+		c.sources = make(map[string]string)
+	}
+	c.sources[key] = source
+}
+
+// walkFields calls fn for every settable leaf field of v, keyed by its TOML
+// path. Images are keyed by name; environments and hooks are not walked
+// since they only feed the file layer. A nil section containing the key alloc is
+// allocated so that field can be set.
+func walkFields(v reflect.Value, prefix, alloc string, fn func(key string, v reflect.Value, sf reflect.StructField)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		name, _, _ := strings.Cut(sf.Tag.Get("toml"), ",")
+		if !sf.IsExported() || name == "" || name == "-" {
+			continue
+		}
+
+		key := joinKey(prefix, name)
+		fv := v.Field(i)
+
+		switch {
+		case key == "environments", key == "hooks":
+			continue
+		case key == "images":
+			for j := 0; j < fv.Len(); j++ {
+				img := fv.Index(j)
+				walkFields(img, "images."+img.FieldByName("Name").String(), alloc, func(k string, v reflect.Value, sf reflect.StructField) {
+					if sf.Name != "Name" {
+						fn(k, v, sf)
+					}
+				})
+			}
+		case fv.Kind() == reflect.Struct:
+			walkFields(fv, key, alloc, fn)
+		case fv.Kind() == reflect.Pointer:
+			if fv.IsNil() {
+				if !strings.HasPrefix(alloc, key+".") {
+					walkFields(reflect.New(fv.Type().Elem()).Elem(), key, "", fn)
+					continue
+				}
+				fv.Set(reflect.New(fv.Type().Elem()))
+			}
+			walkFields(fv.Elem(), key, alloc, fn)
+		default:
+			fn(key, fv, sf)
+		}
+	}
+}
+
+// parseValue parses s into the field v according to its kind.
+func parseValue(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("expected an integer, got %q", s)
+		}
+		v.SetInt(int64(n))
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("expected a number, got %q", s)
+		}
+		v.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("expected true or false, got %q", s)
+		}
+		v.SetBool(b)
+	case reflect.Map:
+		tags, err := parseTags(s)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(tags))
+	default:
+		return fmt.Errorf("unsupported field type %s", v.Type())
+	}
+	return nil
+}
+
+// formatValue formats the field v for display.
+func formatValue(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.String:
+		return v.String()
+	case reflect.Int:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'g', -1, 64)
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	case reflect.Map:
+		return formatTags(v.Interface().(map[string]string), false)
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// parseTags parses "key=value,key=value" into a tag map.
+func parseTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("expected key=value pairs separated by commas, got %q", pair)
+		}
+		tags[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return tags, nil
+}
+
+// formatTags formats a tag map as sorted "key=value" pairs, optionally
+// redacting values whose key looks secret.
+func formatTags(tags map[string]string, redact bool) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		v := tags[k]
+		if redact && isSecretKey(k) {
+			v = redacted
+		}
+		pairs[i] = k + "=" + v
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Lines of a config file, for RedactFile.
+var (
+	tableLine      = regexp.MustCompile(`^\s*\[\[?\s*([^\]]+?)\s*\]\]?`)
+	assignmentLine = regexp.MustCompile(`^(\s*)([A-Za-z0-9_."' -]+?)(\s*=\s*)("(?:[^"\\]|\\.)*"|'[^']*'|[^\s#]*)(.*)$`)
+)
+
+// RedactFile returns the contents of a config file with the values of keys
+// that look secret redacted, as in Fields. Comments and layout are kept.
+func RedactFile(data []byte) []byte {
+	lines := strings.Split(string(data), "\n")
+	out := make([]string, 0, len(lines))
+	table := ""
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		if m := tableLine.FindStringSubmatch(line); m != nil {
+			table = m[1]
+			out = append(out, line)
+			continue
+		}
+		m := assignmentLine.FindStringSubmatch(line)
+		if m == nil || !isSecretKey(joinKey(table, m[2])) {
+			out = append(out, line)
+			continue
+		}
+
+		// A multi-line string runs to its closing delimiter
+		value, rest := m[4]+m[5], m[5]
+		multiline := false
+		for _, delim := range []string{`"""`, "'''"} {
+			if strings.HasPrefix(value, delim) {
+				multiline = true
+				rest = strings.TrimPrefix(value, delim)
+				for !strings.Contains(rest, delim) && i+1 < len(lines) {
+					i++
+					rest = lines[i]
+				}
+				_, rest, _ = strings.Cut(rest, delim)
+			}
+		}
+		if !multiline && (m[4] == `""` || m[4] == "''") {
+			out = append(out, line)
+			continue
+		}
+		out = append(out, m[1]+m[2]+m[3]+strconv.Quote(redacted)+rest)
+	}
+	return []byte(strings.Join(out, "\n"))
+}
+
+// isSecretKey reports whether a key name suggests its value is a secret.
+func isSecretKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, word := range secretWords {
+		if strings.Contains(key, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// joinKey joins a parent key and a field name with a dot.
+func joinKey(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
@@ -0,0 +1,542 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/oracle/oci-go-sdk/v65/common"
+	"github.com/pelletier/go-toml/v2"
+	"github.com/pelletier/go-toml/v2/unstable"
+)
+
+var (
+	// compartmentOCIDPattern matches compartment and tenancy OCIDs, e.g.
+	// ocid1.compartment.oc1..aaaa. Tenancy OCIDs name the root compartment.
+	compartmentOCIDPattern = regexp.MustCompile(`^ocid1\.(compartment|tenancy)\.oc[0-9]+\.[a-z0-9-]*\.[a-z0-9]+$`)
+	keyOCIDPattern         = regexp.MustCompile(`^ocid1\.key\.oc[0-9]+\.[a-z0-9-]*\.[a-z0-9]+\.[a-z0-9]+$`)
+
+	bucketNamePattern   = regexp.MustCompile(`^[A-Za-z0-9._-]{1,256}$`)
+	terraformVarPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]*$`)
+)
+
+// Diagnostic is a single configuration problem.
+type Diagnostic struct {
+	File    string
+	Line    int // 0 if the position is unknown
+	Column  int
+	Key     string
+	Message string
+}
+
+// String formats the diagnostic as "file:line:col: key: message".
+func (d Diagnostic) String() string {
+	var sb strings.Builder
+	if d.File != "" && d.Line > 0 {
+		fmt.Fprintf(&sb, "%s:%d:%d: ", d.File, d.Line, d.Column)
+	} else if d.File != "" {
+		fmt.Fprintf(&sb, "%s: ", d.File)
+	}
+	if d.Key != "" {
+		sb.WriteString(d.Key + ": ")
+	}
+	sb.WriteString(d.Message)
+	return sb.String()
+}
+
+// ValidationError reports every problem found in a configuration.
+type ValidationError struct {
+	Diagnostics []Diagnostic
+}
+
+// Error implements the error interface.
+func (e *ValidationError) Error() string {
+	if len(e.Diagnostics) == 1 {
+		return e.Diagnostics[0].String()
+	}
+
+	lines := make([]string, len(e.Diagnostics))
+	for i, d := range e.Diagnostics {
+		lines[i] = "  " + d.String()
+	}
+	return fmt.Sprintf("invalid configuration (%d problems):\n%s", len(e.Diagnostics), strings.Join(lines, "\n"))
+}
+
+// position is a line and column in the config file.
+type position struct {
+	line, column int
+}
+
+// validator collects diagnostics for a configuration.
+type validator struct {
+	cfg   *Config
+	diags []Diagnostic
+}
+
+// report records a problem with the field key. at is the key used to look
+// up the field's position in the file; images are indexed there by position
+// in the array rather than by name.
+func (v *validator) report(key, at, format string, args ...any) {
+	d := Diagnostic{File: v.cfg.path, Key: key, Message: fmt.Sprintf(format, args...)}
+
+	switch src := v.cfg.source(key); src {
+	case SourceFile, SourceDefault:
+		// Fall back to the enclosing table, e.g. [oci] for a missing field
+		for k := at; k != ""; k = parentKey(k) {
+			if pos, ok := v.cfg.positions[k]; ok {
+				d.Line, d.Column = pos.line, pos.column
+				break
+			}
+		}
+	default:
+		d.File = ""
+		d.Message += fmt.Sprintf(" (set by %s)", src)
+	}
+
+	v.diags = append(v.diags, d)
+}
+
+// err returns the collected diagnostics as a *ValidationError, or nil.
+func (v *validator) err() error {
+	if len(v.diags) == 0 {
+		return nil
+	}
+	return &ValidationError{Diagnostics: v.diags}
+}
+
+// Validate checks the configuration and reports every problem found as a
+// *ValidationError.
+func (c *Config) Validate() error {
+	v := &validator{cfg: c}
+
+	v.compartment("oci.compartment_ocid", c.OCI.CompartmentOCID, true)
+	switch {
+	case c.OCI.BucketName == "":
+		v.report("oci.bucket_name", "oci.bucket_name", "is required")
+	case !bucketNamePattern.MatchString(c.OCI.BucketName):
+		v.report("oci.bucket_name", "oci.bucket_name", "invalid bucket name %q", c.OCI.BucketName)
+	}
+	v.region("oci.region", c.OCI.Region, true)
+
+	switch c.OCI.Auth {
+	case "api_key", "security_token":
+	default:
+		v.report("oci.auth", "oci.auth", "must be \"api_key\" or \"security_token\", got %q", c.OCI.Auth)
+	}
+	switch c.OCI.UploadInterruptPolicy {
+	case UploadInterruptAbort, UploadInterruptPreserve:
+	default:
+		v.report("oci.upload_interrupt_policy", "oci.upload_interrupt_policy", "must be %q or %q, got %q",
+			UploadInterruptAbort, UploadInterruptPreserve, c.OCI.UploadInterruptPolicy)
+	}
+
+	v.positive("oci.poll_interval_secs", c.OCI.PollIntervalSecs)
+	v.positive("oci.max_wait_secs", c.OCI.MaxWaitSecs)
+	v.positive("oci.max_poll_interval_secs", c.OCI.MaxPollIntervalSecs)
+	if c.OCI.InitialDelaySecs < 0 {
+		v.report("oci.initial_delay_secs", "oci.initial_delay_secs", "must not be negative, got %d", c.OCI.InitialDelaySecs)
+	}
+	if c.OCI.MaxPollIntervalSecs > 0 && c.OCI.MaxPollIntervalSecs < c.OCI.PollIntervalSecs {
+		v.report("oci.max_poll_interval_secs", "oci.max_poll_interval_secs",
+			"must be at least oci.poll_interval_secs (%d), got %d", c.OCI.PollIntervalSecs, c.OCI.MaxPollIntervalSecs)
+	}
+	if c.OCI.BackoffFactor < 1 {
+		v.report("oci.backoff_factor", "oci.backoff_factor", "must be at least 1, got %g", c.OCI.BackoffFactor)
+	}
+	if c.OCI.PollJitter < 0 || c.OCI.PollJitter > 1 {
+		v.report("oci.poll_jitter", "oci.poll_jitter", "must be between 0 and 1, got %g", c.OCI.PollJitter)
+	}
+
+	v.bucket()
+	v.importSettings()
+	v.metrics()
+	v.tracing()
+	switch c.SBOM.Format {
+	case SBOMCycloneDX, SBOMSPDX, SBOMNone:
+	default:
+		v.report("sbom.format", "sbom.format", "must be %q, %q or %q, got %q", SBOMCycloneDX, SBOMSPDX, SBOMNone, c.SBOM.Format)
+	}
+	v.signing()
+
+	if c.ARM64Builder != nil && c.ARM64Builder.Host == "" {
+		v.report("arm64_builder.host", "arm64_builder.host", "is required when [arm64_builder] is set")
+	}
+
+	v.images()
+	v.environments()
+	v.hooks()
+
+	// Check if ARM64 builder is needed but not configured
+	hasARM64 := false
+	for _, img := range c.Images {
+		if img.Arch == ArchAarch64 {
+			hasARM64 = true
+			break
+		}
+	}
+	if hasARM64 && c.ARM64Builder == nil {
+		// Just warn, don't error - user might use --local-only
+		fmt.Fprintln(os.Stderr, "Warning: ARM64 images defined but arm64_builder not configured. Use --local-only for local builds.")
+	}
+
+	return v.err()
+}
+
+// images checks image definitions for missing fields, unknown architectures
+// and duplicate names or terraform variables.
+func (v *validator) images() {
+	if len(v.cfg.Images) == 0 {
+		v.report("images", "images", "at least one [[images]] entry is required")
+	}
+
+	names := make(map[string]int)
+	vars := make(map[string]string)
+
+	for i, img := range v.cfg.Images {
+		at := fmt.Sprintf("images.%d", i)
+		key := "images." + img.Name
+		if img.Name == "" {
+			key = fmt.Sprintf("images[%d]", i)
+			v.report(key+".name", at+".name", "is required")
+		} else if first, ok := names[img.Name]; ok {
+			v.report(key+".name", at+".name", "duplicate image name %q (first defined as images[%d])", img.Name, first)
+		} else {
+			names[img.Name] = i
+		}
+
+		if img.FlakeTarget == "" {
+			v.report(key+".flake_target", at+".flake_target", "is required")
+		}
+
+		switch img.Arch {
+		case ArchX86_64, ArchAarch64:
+		case "":
+			v.report(key+".arch", at+".arch", "is required (%q or %q)", ArchX86_64, ArchAarch64)
+		default:
+			v.report(key+".arch", at+".arch", "unknown arch %q (expected %q or %q)", img.Arch, ArchX86_64, ArchAarch64)
+		}
+
+		tfVar := img.TerraformVar
+		if tfVar == "" {
+			tfVar = img.Name + "_image_ocid"
+		} else if !terraformVarPattern.MatchString(tfVar) {
+			v.report(key+".terraform_var", at+".terraform_var", "invalid terraform variable name %q", tfVar)
+		}
+		if other, ok := vars[tfVar]; ok {
+			v.report(key+".terraform_var", at+".terraform_var", "terraform variable %q is also used by image %q", tfVar, other)
+		} else {
+			vars[tfVar] = img.Name
+		}
+	}
+}
+
+// bucket checks the bucket provisioning settings.
+func (v *validator) bucket() {
+	b := v.cfg.Bucket
+
+	switch b.StorageTier {
+	case StorageTierStandard, StorageTierArchive:
+	default:
+		v.report("bucket.storage_tier", "bucket.storage_tier", "must be %q or %q, got %q",
+			StorageTierStandard, StorageTierArchive, b.StorageTier)
+	}
+	if b.KMSKeyID != "" && !keyOCIDPattern.MatchString(b.KMSKeyID) {
+		v.report("bucket.kms_key_id", "bucket.kms_key_id", "%q is not a Vault key OCID (ocid1.key.oc1.<region>.<vault>.<id>)", b.KMSKeyID)
+	}
+
+	switch b.LifecycleAction {
+	case "":
+		return
+	case LifecycleActionArchive, LifecycleActionDelete:
+	default:
+		v.report("bucket.lifecycle_action", "bucket.lifecycle_action", "must be %q or %q, got %q",
+			LifecycleActionArchive, LifecycleActionDelete, b.LifecycleAction)
+	}
+	v.positive("bucket.lifecycle_days", b.LifecycleDays)
+	if b.LifecyclePrefix == "" || !strings.HasSuffix(b.LifecyclePrefix, "/") {
+		v.report("bucket.lifecycle_prefix", "bucket.lifecycle_prefix", "must be a non-empty prefix ending in \"/\", got %q", b.LifecyclePrefix)
+	}
+}
+
+// importSettings checks the [import] section.
+func (v *validator) importSettings() {
+	im := v.cfg.Import
+
+	switch im.Mode {
+	case ImportModeTuple, ImportModePAR:
+	default:
+		v.report("import.mode", "import.mode", "must be %q or %q, got %q", ImportModeTuple, ImportModePAR, im.Mode)
+	}
+	v.positive("import.par_expiry_secs", im.PARExpirySecs)
+	v.region("import.region", im.Region, false)
+	v.compartment("import.compartment_ocid", im.CompartmentOCID, false)
+
+	if im.Mode != ImportModePAR {
+		if im.Region != "" && im.Region != v.cfg.OCI.Region {
+			v.report("import.region", "import.region", "importing into another region needs import.mode = %q", ImportModePAR)
+		}
+		if im.Profile != "" && im.Profile != v.cfg.OCI.Profile {
+			v.report("import.profile", "import.profile", "importing with another profile needs import.mode = %q", ImportModePAR)
+		}
+	}
+}
+
+// metrics checks the [metrics] section.
+func (v *validator) metrics() {
+	m := v.cfg.Metrics
+
+	if m.TextfilePath != "" && !strings.HasSuffix(m.TextfilePath, ".prom") {
+		v.report("metrics.textfile_path", "metrics.textfile_path", "must end in .prom for the textfile collector to read it, got %q", m.TextfilePath)
+	}
+	if m.PushgatewayURL != "" {
+		if !isHTTPURL(m.PushgatewayURL) {
+			v.report("metrics.pushgateway_url", "metrics.pushgateway_url", "must be an http or https URL, got %q", m.PushgatewayURL)
+		}
+		if m.Job == "" {
+			v.report("metrics.job", "metrics.job", "is required with metrics.pushgateway_url")
+		}
+	}
+}
+
+// tracing checks the [tracing] section.
+func (v *validator) tracing() {
+	if e := v.cfg.Tracing.Endpoint; e != "" && !isHTTPURL(e) {
+		v.report("tracing.endpoint", "tracing.endpoint", "must be an http or https URL, got %q", e)
+	}
+}
+
+// signing checks the [signing] section.
+func (v *validator) signing() {
+	s := v.cfg.Signing
+
+	if s.KeyPath != "" && s.PublicKeyPath != "" {
+		v.report("signing.public_key_path", "signing.public_key_path", "cannot be used with signing.key_path, whose public key is used")
+	}
+	if s.KMSKeyID == "" {
+		if s.KMSCryptoEndpoint != "" {
+			v.report("signing.kms_crypto_endpoint", "signing.kms_crypto_endpoint", "needs signing.kms_key_id")
+		}
+		return
+	}
+	if s.KeyPath != "" || s.PublicKeyPath != "" {
+		v.report("signing.kms_key_id", "signing.kms_key_id", "cannot be used with signing.key_path or signing.public_key_path")
+	}
+	if !keyOCIDPattern.MatchString(s.KMSKeyID) {
+		v.report("signing.kms_key_id", "signing.kms_key_id", "%q is not a Vault key OCID (ocid1.key.oc1.<region>.<vault>.<id>)", s.KMSKeyID)
+	}
+	if !isHTTPURL(s.KMSCryptoEndpoint) {
+		v.report("signing.kms_crypto_endpoint", "signing.kms_crypto_endpoint", "must be the vault's https crypto endpoint, got %q", s.KMSCryptoEndpoint)
+	}
+	switch s.KMSAlgorithm {
+	case SigningECDSASHA256, SigningECDSASHA384, SigningECDSASHA512:
+	default:
+		v.report("signing.kms_algorithm", "signing.kms_algorithm", "must be %q, %q or %q, got %q",
+			SigningECDSASHA256, SigningECDSASHA384, SigningECDSASHA512, s.KMSAlgorithm)
+	}
+}
+
+// environments checks environment names and overrides.
+func (v *validator) environments() {
+	for _, name := range v.cfg.EnvironmentNames() {
+		env := v.cfg.Environments[name]
+		key := "environments." + name
+
+		// Environment names become state directory names
+		if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+			v.report(key, key, "invalid environment name %q", name)
+			continue
+		}
+
+		v.compartment(key+".compartment_ocid", env.CompartmentOCID, false)
+		v.region(key+".region", env.Region, false)
+		if env.BucketName != "" && !bucketNamePattern.MatchString(env.BucketName) {
+			v.report(key+".bucket_name", key+".bucket_name", "invalid bucket name %q", env.BucketName)
+		}
+	}
+
+	if d := v.cfg.DefaultEnvironment; d != "" {
+		if _, ok := v.cfg.Environments[d]; !ok {
+			v.report("default_environment", "default_environment", "unknown environment %q", d)
+		}
+	}
+}
+
+// hooks checks [[hooks]] entries.
+func (v *validator) hooks() {
+	for i, h := range v.cfg.Hooks {
+		key := fmt.Sprintf("hooks[%d]", i)
+		at := fmt.Sprintf("hooks.%d", i)
+
+		switch {
+		case h.Command == "" && h.URL == "":
+			v.report(key, at, "needs a command or a url")
+		case h.Command != "" && h.URL != "":
+			v.report(key, at, "has both a command and a url, use one per hook")
+		case h.URL != "":
+			if !isHTTPURL(h.URL) {
+				v.report(key+".url", at+".url", "must be an http or https URL, got %q", h.URL)
+			}
+		}
+
+		for j, event := range h.Events {
+			if !slices.Contains(HookEvents, event) {
+				v.report(key+".events", fmt.Sprintf("%s.events.%d", at, j), "unknown event %q (expected one of %s)",
+					event, strings.Join(HookEvents, ", "))
+			}
+		}
+		if h.TimeoutSecs < 0 {
+			v.report(key+".timeout_secs", at+".timeout_secs", "must not be negative, got %d", h.TimeoutSecs)
+		}
+	}
+}
+
+// isHTTPURL reports whether s is an absolute http or https URL.
+func isHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// compartment checks a compartment OCID.
+func (v *validator) compartment(key, value string, required bool) {
+	switch {
+	case value == "":
+		if required {
+			v.report(key, key, "is required")
+		}
+	case !compartmentOCIDPattern.MatchString(value):
+		v.report(key, key, "%q is not a compartment or tenancy OCID (ocid1.compartment.oc1..<id>)", value)
+	}
+}
+
+// region checks a region name against the regions known to the OCI SDK.
+func (v *validator) region(key, value string, required bool) {
+	if value == "" {
+		if required {
+			v.report(key, key, "is required")
+		}
+		return
+	}
+	if _, err := common.StringToRegion(value).RealmID(); err != nil {
+		v.report(key, key, "unknown region %q (e.g. us-ashburn-1)", value)
+	}
+}
+
+// positive checks that an integer field is greater than zero.
+func (v *validator) positive(key string, value int) {
+	if value <= 0 {
+		v.report(key, key, "must be positive, got %d", value)
+	}
+}
+
+// CheckFlakeTargets reports images whose flake target is not among the
+// flake's outputs, as listed by build.FlakeOutputs.
+func (c *Config) CheckFlakeTargets(outputs map[string]bool) error {
+	v := &validator{cfg: c}
+	for i, img := range c.Images {
+		if img.FlakeTarget != "" && !outputs[img.FlakeTarget] {
+			v.report("images."+img.Name+".flake_target", fmt.Sprintf("images.%d.flake_target", i),
+				"flake output %q not found", img.FlakeTarget)
+		}
+	}
+	return v.err()
+}
+
+// decodeStrict decodes data into c. Unknown keys are returned as
+// diagnostics with their file positions so they can be reported along with
+// validation problems; type mismatches stop decoding and are returned as a
+// *ValidationError.
+func (c *Config) decodeStrict(data []byte) ([]Diagnostic, error) {
+	c.positions = indexPositions(data)
+
+	dec := toml.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(c)
+
+	var strictErr *toml.StrictMissingError
+	var decodeErr *toml.DecodeError
+	switch {
+	case err == nil:
+		return nil, nil
+	case errors.As(err, &strictErr):
+		diags := make([]Diagnostic, len(strictErr.Errors))
+		for i := range strictErr.Errors {
+			diags[i] = c.decodeDiagnostic(&strictErr.Errors[i], "unknown key")
+		}
+		return diags, nil
+	case errors.As(err, &decodeErr):
+		return nil, &ValidationError{Diagnostics: []Diagnostic{c.decodeDiagnostic(decodeErr, decodeErr.Error())}}
+	default:
+		return nil, fmt.Errorf("failed to parse config file %s: %w", c.path, err)
+	}
+}
+
+// decodeDiagnostic converts a TOML decode error into a diagnostic.
+func (c *Config) decodeDiagnostic(e *toml.DecodeError, message string) Diagnostic {
+	line, column := e.Position()
+	return Diagnostic{
+		File:    c.path,
+		Line:    line,
+		Column:  column,
+		Key:     strings.Join(e.Key(), "."),
+		Message: message,
+	}
+}
+
+// indexPositions maps each table and key in a TOML document to its
+// position. Entries of arrays of tables are keyed by index, e.g.
+// "images.0.name".
+func indexPositions(data []byte) map[string]position {
+	positions := make(map[string]position)
+
+	var p unstable.Parser
+	p.Reset(data)
+
+	record := func(key string, it unstable.Iterator) {
+		if it.Next() {
+			shape := p.Shape(it.Node().Raw)
+			positions[key] = position{line: shape.Start.Line, column: shape.Start.Column}
+		}
+	}
+
+	table := ""
+	counts := make(map[string]int)
+	for p.NextExpression() {
+		e := p.Expression()
+		switch e.Kind {
+		case unstable.Table:
+			table = nodeKey(e.Key())
+			record(table, e.Key())
+		case unstable.ArrayTable:
+			name := nodeKey(e.Key())
+			table = fmt.Sprintf("%s.%d", name, counts[name])
+			counts[name]++
+			record(table, e.Key())
+		case unstable.KeyValue:
+			record(joinKey(table, nodeKey(e.Key())), e.Key())
+		}
+	}
+
+	return positions
+}
+
+// nodeKey joins the parts of a dotted TOML key.
+func nodeKey(it unstable.Iterator) string {
+	var parts []string
+	for it.Next() {
+		parts = append(parts, string(it.Node().Data))
+	}
+	return strings.Join(parts, ".")
+}
+
+// parentKey returns the key of the table containing key.
+func parentKey(key string) string {
+	if i := strings.LastIndex(key, "."); i >= 0 {
+		return key[:i]
+	}
+	return ""
+}
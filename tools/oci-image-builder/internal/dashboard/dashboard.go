@@ -0,0 +1,484 @@
+// Package dashboard renders a full-screen terminal view of a pipeline run:
+// one row per image with its stage, elapsed time and progress, and a
+// scrollable log pane for the selected image.
+package dashboard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/term"
+
+	"oci-image-builder/internal/progress"
+	"oci-image-builder/internal/state"
+)
+
+// Limits and refresh rate of the dashboard.
+const (
+	maxLines        = 2000 // Log lines kept per pane
+	summaryLines    = 50   // Pipeline lines printed when the dashboard stops
+	refreshInterval = 250 * time.Millisecond
+)
+
+// Log lines are attributed to the image whose stage is running, from
+// progress events. Concurrent import waits prefix their lines with the
+// image name instead.
+var (
+	ansiPattern   = regexp.MustCompile(`\x1b\[[0-9;?]*[A-Za-z]`)
+	prefixPattern = regexp.MustCompile(`^\s*\[([^\]]+)\]`) // Only for known images, nix prints "[1/0/3 built]"
+)
+
+// Dashboard draws a live view of a run on the terminal, fed with progress
+// events by HandleEvent and the run's log by Log.
+type Dashboard struct {
+	snapshot func() *state.PipelineState
+	cancel   context.CancelFunc
+
+	mu       sync.Mutex
+	tty      *os.File
+	images   []*imageView
+	byName   map[string]*imageView
+	pipeline *imageView // Lines not attributed to an image
+	current  *imageView // Image whose stage is running, if any
+	selected int        // Pane shown: an image index, or len(images) for pipeline
+	scroll   int        // Lines scrolled up from the end of the pane
+	start    time.Time
+
+	termState  *term.State
+	stop       chan struct{}
+	renderDone chan struct{}
+}
+
+// imageView is the dashboard's view of one image.
+type imageView struct {
+	name  string
+	lines []string
+
+	activity      string // "building", "uploading", "importing", "failed" or "interrupted", from events
+	activitySince time.Time
+	failure       string
+	stage         state.Stage
+	stageSince    time.Time
+
+	buildLine     string
+	uploadTotal   int64
+	uploadSent    int64
+	uploadNew     int64 // Bytes sent by this run, excluding reused parts
+	importState   string
+	importPercent float32
+}
+
+// Enabled reports whether stdout is a terminal the dashboard can draw on.
+func Enabled() bool {
+	return term.IsTerminal(int(os.Stdout.Fd()))
+}
+
+// New creates a dashboard. snapshot returns the current run, or nil before
+// it starts; cancel is called when the user presses Ctrl-C, since the
+// terminal is in raw mode while the dashboard runs.
+func New(snapshot func() *state.PipelineState, cancel context.CancelFunc) *Dashboard {
+	return &Dashboard{
+		snapshot: snapshot,
+		cancel:   cancel,
+		byName:   make(map[string]*imageView),
+		pipeline: &imageView{name: "pipeline"},
+	}
+}
+
+// Start takes over the terminal until Stop is called. The run's log must
+// be sent to Log instead of stdout meanwhile.
+func (d *Dashboard) Start() {
+	d.tty = os.Stdout
+	d.start = time.Now()
+	d.stop = make(chan struct{})
+	d.renderDone = make(chan struct{})
+
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		if st, err := term.MakeRaw(int(os.Stdin.Fd())); err == nil {
+			d.termState = st
+			go d.readKeys()
+		}
+	}
+
+	fmt.Fprint(d.tty, "\x1b[?1049h\x1b[?25l") // Alternate screen, hide cursor
+
+	go d.renderLoop()
+}
+
+// Stop restores the terminal and prints a summary of each image followed
+// by the pipeline's last lines, such as the terraform variables.
+func (d *Dashboard) Stop() {
+	close(d.stop)
+	<-d.renderDone
+
+	fmt.Fprint(d.tty, "\x1b[?25h\x1b[?1049l") // Show cursor, main screen
+	if d.termState != nil {
+		term.Restore(int(os.Stdin.Fd()), d.termState)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.refresh()
+	for _, row := range d.rows(0) {
+		fmt.Fprintln(d.tty, row)
+	}
+
+	// Print the pipeline's output from its last section header on
+	tail := d.pipeline.lines
+	for i := len(tail) - 1; i >= 0; i-- {
+		if strings.HasPrefix(tail[i], "===") {
+			tail = tail[i:]
+			break
+		}
+	}
+	if len(tail) > summaryLines {
+		tail = tail[len(tail)-summaryLines:]
+	}
+	fmt.Fprintln(d.tty)
+	for _, line := range tail {
+		fmt.Fprintln(d.tty, line)
+	}
+}
+
+// Log adds a message from the run's log to the pane of the image whose
+// stage is running, or of the image named in its "[name]" prefix, or else
+// to the pipeline pane.
+func (d *Dashboard) Log(msg string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, line := range strings.Split(msg, "\n") {
+		line = ansiPattern.ReplaceAllString(strings.TrimRight(line, "\r"), "")
+
+		img := d.current
+		if m := prefixPattern.FindStringSubmatch(line); m != nil && d.byName[m[1]] != nil {
+			img = d.byName[m[1]]
+		}
+		if img == nil {
+			img = d.pipeline
+		}
+		img.append(line)
+	}
+}
+
+// HandleEvent updates an image's progress from a progress event.
+func (d *Dashboard) HandleEvent(e progress.Event) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	switch e := e.(type) {
+	case *progress.StageStarted:
+		img := d.image(e.Image)
+		img.setActivity(activities[e.Stage], e.Time)
+		img.failure = ""
+		d.current = img
+	case *progress.StageCompleted:
+		img := d.image(e.Image)
+		img.activity = ""
+		d.release(img)
+	case *progress.StageFailed:
+		img := d.image(e.Image)
+		d.release(img)
+		if errors.Is(e.Err, context.Canceled) {
+			img.setActivity("interrupted", e.Time)
+		} else {
+			img.setActivity("failed", e.Time)
+		}
+		img.failure = e.Err.Error()
+	case *progress.BuildLogLine:
+		if line := strings.TrimSpace(ansiPattern.ReplaceAllString(e.Line, "")); line != "" {
+			d.image(e.Image).buildLine = line
+		}
+	case *progress.UploadStarted:
+		img := d.image(e.Image)
+		img.uploadTotal, img.uploadSent, img.uploadNew = e.TotalBytes, 0, 0
+	case *progress.PartUploaded:
+		img := d.image(e.Image)
+		img.uploadSent = e.BytesSent
+		if !e.Reused {
+			img.uploadNew += e.PartBytes
+		}
+	case *progress.ImportStateChanged:
+		// Once initiated, imports are waited for concurrently
+		img := d.image(e.Image)
+		d.release(img)
+		img.importState, img.importPercent = e.State, e.PercentComplete
+		if e.WorkRequestStatus != "" {
+			img.importState = e.WorkRequestStatus
+		}
+	}
+}
+
+// release stops attributing unprefixed log lines to img.
+func (d *Dashboard) release(img *imageView) {
+	if d.current == img {
+		d.current = nil
+	}
+}
+
+// activities maps a stage to the activity shown while it runs.
+var activities = map[progress.Stage]string{
+	progress.StageBuild:  "building",
+	progress.StageUpload: "uploading",
+	progress.StageImport: "importing",
+}
+
+// image returns the view of the named image, adding it if needed.
+func (d *Dashboard) image(name string) *imageView {
+	if img, ok := d.byName[name]; ok {
+		return img
+	}
+	img := &imageView{name: name}
+	d.byName[name] = img
+	d.images = append(d.images, img)
+	return img
+}
+
+// refresh merges the run's image stages into the views. Images are shown
+// in run order, followed by any only seen in events.
+func (d *Dashboard) refresh() {
+	pstate := d.snapshot()
+	if pstate == nil {
+		return
+	}
+
+	now := time.Now()
+	ordered := make([]*imageView, 0, len(d.images))
+	inRun := make(map[string]bool, len(pstate.Images))
+	for _, s := range pstate.Images {
+		img := d.image(s.Name)
+		if img.stage != s.Stage {
+			img.stage, img.stageSince = s.Stage, now
+		}
+		ordered = append(ordered, img)
+		inRun[s.Name] = true
+	}
+	for _, img := range d.images {
+		if !inRun[img.name] {
+			ordered = append(ordered, img)
+		}
+	}
+	d.images = ordered
+}
+
+// setActivity records what events say the image is doing.
+func (v *imageView) setActivity(activity string, now time.Time) {
+	if v.activity != activity {
+		v.activity, v.activitySince = activity, now
+	}
+}
+
+// append adds a line to the view's log, dropping the oldest past maxLines.
+func (v *imageView) append(line string) {
+	v.lines = append(v.lines, line)
+	if len(v.lines) > maxLines {
+		v.lines = append([]string(nil), v.lines[len(v.lines)-maxLines:]...)
+	}
+}
+
+// status returns the stage shown for the image: its recorded stage once
+// settled, otherwise what events say it is doing.
+func (v *imageView) status() (string, time.Time) {
+	switch v.stage {
+	case state.StageComplete, state.StageError:
+		return string(v.stage), v.stageSince
+	}
+	if v.activity != "" {
+		return v.activity, v.activitySince
+	}
+	if v.stage == "" || v.stage == state.StagePending {
+		return string(state.StagePending), time.Time{}
+	}
+	return string(v.stage), v.stageSince
+}
+
+// detail returns the progress column for the image.
+func (v *imageView) detail(now time.Time) string {
+	status, since := v.status()
+	switch status {
+	case "building":
+		return v.buildLine
+	case "uploading":
+		if v.uploadTotal == 0 {
+			return ""
+		}
+		detail := fmt.Sprintf("%d/%d MB", v.uploadSent/(1024*1024), v.uploadTotal/(1024*1024))
+		if secs := now.Sub(since).Seconds(); secs > 0 && v.uploadNew > 0 {
+			rate := float64(v.uploadNew) / secs
+			eta := time.Duration(float64(v.uploadTotal-v.uploadSent) / rate * float64(time.Second))
+			detail += fmt.Sprintf("  %.1f MB/s  ETA %s", rate/(1024*1024), state.FormatDuration(eta))
+		}
+		return detail
+	case "importing":
+		if v.importState == "" {
+			return "import requested"
+		}
+		return fmt.Sprintf("%s %.0f%%", v.importState, v.importPercent)
+	case "failed", "interrupted":
+		return v.failure
+	}
+	return v.importState
+}
+
+// rows formats the image table. With a width, rows are truncated to it and
+// the selected row is highlighted.
+func (d *Dashboard) rows(width int) []string {
+	now := time.Now()
+	rows := []string{fmt.Sprintf("%-16s %-12s %-9s %s", "IMAGE", "STAGE", "ELAPSED", "PROGRESS")}
+	for i, img := range d.images {
+		status, since := img.status()
+		elapsed := "-"
+		if !since.IsZero() {
+			elapsed = state.FormatDuration(now.Sub(since).Truncate(time.Second))
+		}
+		row := fmt.Sprintf("%-16s %-12s %-9s %s", img.name, status, elapsed, img.detail(now))
+		if width > 0 {
+			row = truncate(row, width)
+			if i == d.selected {
+				row = "\x1b[7m" + row + "\x1b[0m"
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// renderLoop redraws the dashboard until Stop.
+func (d *Dashboard) renderLoop() {
+	defer close(d.renderDone)
+
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		d.render()
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// render draws one frame.
+func (d *Dashboard) render() {
+	width, height, err := term.GetSize(int(d.tty.Fd()))
+	if err != nil || width < 20 || height < 10 {
+		width, height = 80, 24
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.refresh()
+	if d.selected > len(d.images) {
+		d.selected = len(d.images)
+	}
+
+	var b strings.Builder
+	b.WriteString("\x1b[H")
+	line := func(s string) {
+		b.WriteString(truncate(s, width))
+		b.WriteString("\x1b[K\r\n")
+	}
+
+	header := "oci-image-builder"
+	if pstate := d.snapshot(); pstate != nil {
+		header += fmt.Sprintf("  run %s  stage %s", pstate.RunID, pstate.Stage)
+		if pstate.Environment != "" {
+			header += "  env " + pstate.Environment
+		}
+	}
+	line(fmt.Sprintf("%s  elapsed %s", header, state.FormatDuration(time.Since(d.start).Truncate(time.Second))))
+	line("")
+	for _, row := range d.rows(width) {
+		b.WriteString(row)
+		b.WriteString("\x1b[K\r\n")
+	}
+	if d.selected == len(d.images) {
+		line("\x1b[7mpipeline\x1b[0m")
+	} else {
+		line("pipeline")
+	}
+
+	pane := d.pipeline
+	if d.selected < len(d.images) {
+		pane = d.images[d.selected]
+	}
+	title := "── log: " + pane.name + " "
+	if d.scroll > 0 {
+		title += fmt.Sprintf("(scrolled %d lines) ", d.scroll)
+	}
+	line(title + strings.Repeat("─", max(0, width-len([]rune(title)))))
+
+	// Fill the rest of the screen with the pane, leaving the footer line
+	paneHeight := height - len(d.images) - 6
+	lines := pane.lines
+	d.scroll = min(d.scroll, max(0, len(lines)-paneHeight))
+	end := len(lines) - d.scroll
+	begin := max(0, end-paneHeight)
+	for i := 0; i < paneHeight; i++ {
+		if begin+i < end {
+			line(lines[begin+i])
+		} else {
+			line("")
+		}
+	}
+
+	b.WriteString(truncate("↑/↓ select  PgUp/PgDn scroll  End follow  Ctrl-C stop", width))
+	b.WriteString("\x1b[K")
+	fmt.Fprint(d.tty, b.String())
+}
+
+// readKeys handles keyboard input while the terminal is in raw mode.
+func (d *Dashboard) readKeys() {
+	buf := make([]byte, 16)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return
+		}
+		select {
+		case <-d.stop:
+			return
+		default:
+		}
+
+		key := string(buf[:n])
+		d.mu.Lock()
+		switch key {
+		case "\x03": // Ctrl-C, no longer a signal in raw mode
+			d.pipeline.append("Interrupt requested, stopping...")
+			d.cancel()
+		case "\x1b[A", "k":
+			d.selected = max(0, d.selected-1)
+			d.scroll = 0
+		case "\x1b[B", "j", "\t":
+			d.selected = min(len(d.images), d.selected+1)
+			d.scroll = 0
+		case "\x1b[5~":
+			d.scroll += 10
+		case "\x1b[6~":
+			d.scroll = max(0, d.scroll-10)
+		case "\x1b[F", "\x1b[4~", "G":
+			d.scroll = 0
+		}
+		d.mu.Unlock()
+	}
+}
+
+// truncate shortens s to width runes.
+func truncate(s string, width int) string {
+	r := []rune(s)
+	if len(r) <= width {
+		return s
+	}
+	return string(r[:width])
+}
@@ -0,0 +1,107 @@
+// Package git reads the state of the git checkout images are built from.
+package git
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Info describes a commit, or the checkout in the current directory.
+type Info struct {
+	Commit      string
+	ShortCommit string
+	Branch      string   // Empty if HEAD is detached or Info describes a commit
+	Tags        []string // Tags pointing at Commit
+	Dirty       bool     // Tracked files have uncommitted changes
+}
+
+// Inspect returns the state of the checkout in the current directory.
+// Untracked files do not make it dirty, since Nix flakes ignore them.
+func Inspect(ctx context.Context) (*Info, error) {
+	info, err := Describe(ctx, "HEAD")
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Branch, err = output(ctx, "rev-parse", "--abbrev-ref", "HEAD"); err != nil {
+		return nil, err
+	}
+	if info.Branch == "HEAD" {
+		info.Branch = ""
+	}
+
+	status, err := output(ctx, "status", "--porcelain", "--untracked-files=no")
+	if err != nil {
+		return nil, err
+	}
+	info.Dirty = status != ""
+
+	return info, nil
+}
+
+// Describe returns the full and short commit of rev and the tags pointing
+// at it.
+func Describe(ctx context.Context, rev string) (*Info, error) {
+	var info Info
+	var err error
+
+	if info.Commit, err = output(ctx, "rev-parse", "--verify", rev+"^{commit}"); err != nil {
+		return nil, err
+	}
+	info.ShortCommit = Short(info.Commit)
+
+	tags, err := output(ctx, "tag", "--points-at", info.Commit)
+	if err != nil {
+		return nil, err
+	}
+	info.Tags = strings.Fields(tags)
+
+	return &info, nil
+}
+
+// ErrNoCommit is returned by CheckPublishable when no commit is recorded.
+var ErrNoCommit = errors.New("not built from a git checkout")
+
+// CheckPublishable returns an error if info describes a dirty tree or an
+// untagged commit, which images are not published from by default.
+func (i *Info) CheckPublishable() error {
+	switch {
+	case i.Commit == "":
+		return ErrNoCommit
+	case i.Dirty:
+		return fmt.Errorf("working tree at %s had uncommitted changes", i.ShortCommit)
+	case len(i.Tags) == 0:
+		return fmt.Errorf("commit %s is not tagged", i.ShortCommit)
+	}
+	return nil
+}
+
+// Short abbreviates a full commit hash to git's default seven characters.
+func Short(commit string) string {
+	if len(commit) > 7 {
+		return commit[:7]
+	}
+	return commit
+}
+
+// RemoteURL returns the URL of the origin remote.
+func RemoteURL(ctx context.Context) (string, error) {
+	return output(ctx, "remote", "get-url", "origin")
+}
+
+// output runs a git command and returns its trimmed stdout.
+func output(ctx context.Context, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s failed: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
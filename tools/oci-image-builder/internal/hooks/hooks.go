@@ -0,0 +1,202 @@
+// Package hooks runs the commands and webhooks configured with [[hooks]]
+// when pipeline events occur.
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"oci-image-builder/internal/config"
+	"oci-image-builder/internal/logger"
+	"oci-image-builder/internal/state"
+)
+
+// maxResponseBytes bounds the webhook response body included in errors.
+const maxResponseBytes = 512
+
+// commandWaitDelay bounds how long a timed-out command may take to exit
+// after SIGTERM before it is killed.
+const commandWaitDelay = 5 * time.Second
+
+// Payload is the JSON document a hook receives.
+type Payload struct {
+	Event       string             `json:"event"`
+	RunID       string             `json:"run_id"`
+	Environment string             `json:"environment,omitempty"`
+	Time        time.Time          `json:"time"`
+	Image       *state.ImageState  `json:"image,omitempty"` // Image the event is about, if any
+	Images      []state.ImageState `json:"images"`          // All images of the run
+	ImageIDs    map[string]string  `json:"image_ids"`       // OCIDs produced so far, by image name
+	Error       string             `json:"error,omitempty"` // Failure of image_failed and run_failed
+}
+
+// NewPayload creates the payload for an event in a run. imageName may be
+// empty for run events; cause is the failure, if any.
+func NewPayload(event string, run *state.PipelineState, imageName string, cause error) *Payload {
+	p := &Payload{
+		Event:       event,
+		RunID:       run.RunID,
+		Environment: run.Environment,
+		Time:        time.Now(),
+		Images:      run.Images,
+		ImageIDs:    make(map[string]string),
+	}
+	for i := range run.Images {
+		img := &run.Images[i]
+		if img.ImageID != "" {
+			p.ImageIDs[img.Name] = img.ImageID
+		}
+		if img.Name == imageName {
+			p.Image = img
+		}
+	}
+	if cause != nil {
+		p.Error = cause.Error()
+	}
+	return p
+}
+
+// Runner fires the configured hooks.
+type Runner struct {
+	Hooks  []config.HookConfig
+	Logger *logger.Logger
+}
+
+// NewRunner creates a Runner for the given hooks.
+func NewRunner(hooks []config.HookConfig) *Runner {
+	return &Runner{
+		Hooks:  hooks,
+		Logger: logger.New(),
+	}
+}
+
+// SetLogFunc sets the logging function for hook output.
+func (r *Runner) SetLogFunc(fn func(string)) {
+	r.Logger.SetLogFunc(fn)
+}
+
+// Fire runs the hooks subscribed to the payload's event, one at a time.
+// A failing hook is logged as a warning; failures of hooks with
+// fail_pipeline set are also returned, joined with errors.Join.
+func (r *Runner) Fire(ctx context.Context, payload *Payload) error {
+	var body []byte
+	var errs []error
+
+	for _, hook := range r.Hooks {
+		if len(hook.Events) > 0 && !slices.Contains(hook.Events, payload.Event) {
+			continue
+		}
+
+		if body == nil {
+			var err error
+			if body, err = json.Marshal(payload); err != nil {
+				return fmt.Errorf("failed to encode hook payload: %w", err)
+			}
+		}
+
+		name := hook.DisplayName()
+		r.Logger.Logf("Running hook %s (%s)...", name, payload.Event)
+
+		if err := r.run(ctx, &hook, payload, body); err != nil {
+			err = fmt.Errorf("hook %s failed on %s: %w", name, payload.Event, err)
+			if hook.FailPipeline {
+				r.Logger.Logf("  Error: %v", err)
+				errs = append(errs, err)
+			} else {
+				r.Logger.Logf("  Warning: %v", err)
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// run runs one hook with its timeout.
+func (r *Runner) run(ctx context.Context, hook *config.HookConfig, payload *Payload, body []byte) error {
+	timeout := time.Duration(hook.TimeoutSecs) * time.Second
+	if timeout == 0 {
+		timeout = config.DefaultHookTimeoutSecs * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var err error
+	if hook.Command != "" {
+		err = r.runCommand(ctx, hook.Command, payload, body)
+	} else {
+		err = r.post(ctx, hook.URL, body)
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+	return err
+}
+
+// runCommand runs command with sh -c, passing the payload on stdin and the
+// event, run and image in OCI_IMAGE_BUILDER_HOOK_* variables.
+func (r *Runner) runCommand(ctx context.Context, command string, payload *Payload, body []byte) error {
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Env = append(os.Environ(),
+		config.EnvPrefix+"HOOK_EVENT="+payload.Event,
+		config.EnvPrefix+"HOOK_RUN_ID="+payload.RunID,
+	)
+	if payload.Image != nil {
+		cmd.Env = append(cmd.Env,
+			config.EnvPrefix+"HOOK_IMAGE="+payload.Image.Name,
+			config.EnvPrefix+"HOOK_IMAGE_ID="+payload.Image.ImageID,
+		)
+	}
+	// Stop the whole process group on timeout, not just the shell
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+	}
+	cmd.WaitDelay = commandWaitDelay
+
+	output, err := cmd.CombinedOutput()
+	for _, line := range strings.Split(strings.TrimRight(string(output), "\n"), "\n") {
+		if line != "" {
+			r.Logger.Logf("  %s", line)
+		}
+	}
+	return err
+}
+
+// post sends the payload to a webhook and checks for a 2xx response.
+func (r *Runner) post(ctx context.Context, target string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		// Leave the URL, which may hold a token, out of the log
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return urlErr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponseBytes))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+// Package metrics exports the statistics of a pipeline run as Prometheus
+// metrics, to a node_exporter textfile collector file or a Pushgateway.
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"oci-image-builder/internal/fsutil"
+	"oci-image-builder/internal/progress"
+	"oci-image-builder/internal/state"
+)
+
+// Prefix is prepended to every metric name.
+const Prefix = "oci_image_builder_"
+
+// contentType is the Prometheus text exposition format.
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Collector counts stage failures from progress events during a run and
+// formats them with the run's statistics.
+type Collector struct {
+	mu       sync.Mutex
+	failures map[failure]int
+}
+
+// failure identifies a failed stage of an image.
+type failure struct {
+	image string
+	stage progress.Stage
+}
+
+// NewCollector creates a Collector with no failures.
+func NewCollector() *Collector {
+	return &Collector{failures: make(map[failure]int)}
+}
+
+// HandleEvent counts StageFailed events. Interrupted stages are not
+// failures.
+func (c *Collector) HandleEvent(e progress.Event) {
+	f, ok := e.(*progress.StageFailed)
+	if !ok || errors.Is(f.Err, context.Canceled) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failures[failure{f.Image, f.Stage}]++
+}
+
+// Format returns the metrics for a run in the Prometheus text format.
+func (c *Collector) Format(run *state.PipelineState) []byte {
+	stats := run.Statistics()
+	env := run.Environment
+
+	var (
+		stageDuration = family{name: "stage_duration_seconds", typ: "gauge", help: "Duration of each pipeline stage of an image in the last run."}
+		importWait    = family{name: "import_wait_seconds", typ: "gauge", help: "Time from requesting an image import to the image being AVAILABLE in the last run."}
+		uploadBytes   = family{name: "upload_bytes", typ: "gauge", help: "Bytes uploaded for an image in the last run."}
+		throughput    = family{name: "upload_throughput_bytes_per_second", typ: "gauge", help: "Upload throughput of an image in the last run."}
+		imageSize     = family{name: "image_size_bytes", typ: "gauge", help: "Size of the built qcow2 image."}
+		failures      = family{name: "stage_failures", typ: "gauge", help: "Stage failures of an image in the last run."}
+		runDuration   = family{name: "run_duration_seconds", typ: "gauge", help: "Duration of the last run."}
+		runSuccess    = family{name: "run_success", typ: "gauge", help: "Whether the last run completed (1) or not (0)."}
+		runTimestamp  = family{name: "run_timestamp_seconds", typ: "gauge", help: "Unix time the last run started."}
+	)
+
+	for _, img := range stats.ImageStats {
+		for _, d := range []struct {
+			stage progress.Stage
+			secs  float64
+		}{
+			{progress.StageBuild, img.BuildDuration.Seconds()},
+			{progress.StageUpload, img.UploadDuration.Seconds()},
+			{progress.StageImport, img.ImportDuration.Seconds()},
+		} {
+			if d.secs > 0 {
+				stageDuration.add(d.secs, "environment", env, "image", img.Name, "stage", string(d.stage))
+			}
+		}
+		if img.ImportDuration > 0 {
+			importWait.add(img.ImportDuration.Seconds(), "environment", env, "image", img.Name)
+		}
+		if img.UploadThroughputMB > 0 {
+			throughput.add(img.UploadThroughputMB*1024*1024, "environment", env, "image", img.Name)
+		}
+	}
+
+	for _, img := range run.Images {
+		if img.Metrics.UploadSizeBytes > 0 {
+			uploadBytes.add(float64(img.Metrics.UploadSizeBytes), "environment", env, "image", img.Name)
+		}
+		if img.Metrics.BuildSizeBytes > 0 {
+			imageSize.add(float64(img.Metrics.BuildSizeBytes), "environment", env, "image", img.Name)
+		}
+	}
+
+	c.mu.Lock()
+	keys := make([]failure, 0, len(c.failures))
+	for k := range c.failures {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].image != keys[j].image {
+			return keys[i].image < keys[j].image
+		}
+		return keys[i].stage < keys[j].stage
+	})
+	for _, k := range keys {
+		failures.add(float64(c.failures[k]), "environment", env, "image", k.image, "stage", string(k.stage))
+	}
+	c.mu.Unlock()
+
+	success := 0.0
+	if run.Complete {
+		success = 1
+	}
+	runDuration.add(stats.TotalDuration.Seconds(), "environment", env)
+	runSuccess.add(success, "environment", env)
+	runTimestamp.add(float64(run.StartedAt.Unix()), "environment", env)
+
+	var buf bytes.Buffer
+	for _, f := range []*family{&stageDuration, &importWait, &uploadBytes, &throughput, &imageSize,
+		&failures, &runDuration, &runSuccess, &runTimestamp} {
+		f.write(&buf)
+	}
+	return buf.Bytes()
+}
+
+// family is a metric and its samples.
+type family struct {
+	name, typ, help string
+	samples         []string
+}
+
+// add adds a sample with label name/value pairs. Empty labels are left out.
+func (f *family) add(value float64, labels ...string) {
+	var pairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		if labels[i+1] != "" {
+			pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1])))
+		}
+	}
+
+	sample := Prefix + f.name
+	if len(pairs) > 0 {
+		sample += "{" + strings.Join(pairs, ",") + "}"
+	}
+	f.samples = append(f.samples, fmt.Sprintf("%s %g", sample, value))
+}
+
+// write writes the family in the text format, if it has samples.
+func (f *family) write(w io.Writer) {
+	if len(f.samples) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "# HELP %s%s %s\n", Prefix, f.name, f.help)
+	fmt.Fprintf(w, "# TYPE %s%s %s\n", Prefix, f.name, f.typ)
+	for _, s := range f.samples {
+		fmt.Fprintln(w, s)
+	}
+}
+
+// labelEscaper escapes label values as the text format requires.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// WriteTextfile writes metrics to a textfile collector file. The file is
+// replaced atomically so node_exporter never reads a partial file.
+func WriteTextfile(path string, data []byte) error {
+	if err := fsutil.WriteFileAtomic(path, data); err != nil {
+		return fmt.Errorf("failed to write metrics to %s: %w", path, err)
+	}
+	return nil
+}
+
+// Push replaces the metrics of job, grouped by environment if set, on a
+// Pushgateway.
+func Push(ctx context.Context, gatewayURL, job, environment string, data []byte) error {
+	target := strings.TrimSuffix(gatewayURL, "/") + "/metrics/job/" + url.PathEscape(job)
+	if environment != "" {
+		target += "/environment/" + url.PathEscape(environment)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, target, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to push metrics: %w", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to push metrics: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("failed to push metrics: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
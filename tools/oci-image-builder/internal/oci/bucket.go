@@ -0,0 +1,228 @@
+package oci
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/oracle/oci-go-sdk/v65/common"
+	"github.com/oracle/oci-go-sdk/v65/objectstorage"
+)
+
+// lifecycleRuleName names the lifecycle rule managed by EnsureBucket. Other
+// rules on the bucket are left alone.
+const lifecycleRuleName = "oci-image-builder-imported"
+
+// EnsureBucket makes sure the upload bucket exists and matches the [bucket]
+// settings: versioning off, the configured Vault key, and the lifecycle rule
+// for imported objects. If the bucket is missing it is created when create
+// is set, otherwise an error is returned.
+func (c *Client) EnsureBucket(ctx context.Context, create bool) error {
+	namespace, err := c.GetNamespace(ctx)
+	if err != nil {
+		return err
+	}
+
+	name := c.Config.OCI.BucketName
+	settings := c.Config.Bucket
+
+	resp, err := c.ObjectStorage.GetBucket(ctx, objectstorage.GetBucketRequest{
+		NamespaceName: common.String(namespace),
+		BucketName:    common.String(name),
+	})
+	switch {
+	case isNotFound(err) && !create:
+		return fmt.Errorf("bucket %s not found in namespace %s. Run 'ensure-bucket' or set bucket.auto_create", name, namespace)
+
+	case isNotFound(err):
+		c.Logger.Logf("Creating bucket %s (%s tier)...", name, settings.StorageTier)
+		details := objectstorage.CreateBucketDetails{
+			Name:             common.String(name),
+			CompartmentId:    common.String(c.Config.OCI.CompartmentOCID),
+			StorageTier:      objectstorage.CreateBucketDetailsStorageTierEnum(settings.StorageTier),
+			Versioning:       objectstorage.CreateBucketDetailsVersioningDisabled,
+			PublicAccessType: objectstorage.CreateBucketDetailsPublicAccessTypeNopublicaccess,
+			FreeformTags:     c.Config.ImageTags(),
+		}
+		if settings.KMSKeyID != "" {
+			details.KmsKeyId = common.String(settings.KMSKeyID)
+		}
+		if _, err := c.ObjectStorage.CreateBucket(ctx, objectstorage.CreateBucketRequest{
+			NamespaceName:       common.String(namespace),
+			CreateBucketDetails: details,
+		}); err != nil {
+			return fmt.Errorf("failed to create bucket %s: %w", name, err)
+		}
+
+	case err != nil:
+		return fmt.Errorf("failed to get bucket %s: %w", name, err)
+
+	default:
+		if err := c.updateBucket(ctx, namespace, resp.Bucket); err != nil {
+			return err
+		}
+	}
+
+	return c.ensureLifecycleRule(ctx, namespace)
+}
+
+// checkBucket verifies the upload bucket exists before uploading, creating
+// it with EnsureBucket if bucket.auto_create is set.
+func (c *Client) checkBucket(ctx context.Context, namespace string) error {
+	_, err := c.ObjectStorage.GetBucket(ctx, objectstorage.GetBucketRequest{
+		NamespaceName: common.String(namespace),
+		BucketName:    common.String(c.Config.OCI.BucketName),
+	})
+	switch {
+	case err == nil:
+		return nil
+	case isNotFound(err) && c.Config.Bucket.AutoCreate:
+		return c.EnsureBucket(ctx, true)
+	case isNotFound(err):
+		return fmt.Errorf("bucket %s not found in namespace %s. Run 'ensure-bucket' or set bucket.auto_create",
+			c.Config.OCI.BucketName, namespace)
+	default:
+		return fmt.Errorf("failed to get bucket %s: %w", c.Config.OCI.BucketName, err)
+	}
+}
+
+// updateBucket brings an existing bucket in line with the [bucket] settings
+// where Object Storage allows it.
+func (c *Client) updateBucket(ctx context.Context, namespace string, bucket objectstorage.Bucket) error {
+	settings := c.Config.Bucket
+	var details objectstorage.UpdateBucketDetails
+	changed := false
+
+	if string(bucket.StorageTier) != settings.StorageTier {
+		c.Logger.Logf("  Warning: bucket %s has storage tier %s, not %s; the tier cannot be changed after creation",
+			*bucket.Name, bucket.StorageTier, settings.StorageTier)
+	}
+
+	// Versioning can only be suspended once it has been enabled
+	if bucket.Versioning == objectstorage.BucketVersioningEnabled {
+		c.Logger.Logf("  Suspending versioning on bucket %s", *bucket.Name)
+		details.Versioning = objectstorage.UpdateBucketDetailsVersioningSuspended
+		changed = true
+	}
+
+	if settings.KMSKeyID != "" && (bucket.KmsKeyId == nil || *bucket.KmsKeyId != settings.KMSKeyID) {
+		c.Logger.Logf("  Setting encryption key on bucket %s", *bucket.Name)
+		details.KmsKeyId = common.String(settings.KMSKeyID)
+		changed = true
+	}
+
+	if !changed {
+		c.Logger.Logf("Bucket %s exists", *bucket.Name)
+		return nil
+	}
+
+	if _, err := c.ObjectStorage.UpdateBucket(ctx, objectstorage.UpdateBucketRequest{
+		NamespaceName:       common.String(namespace),
+		BucketName:          bucket.Name,
+		UpdateBucketDetails: details,
+	}); err != nil {
+		return fmt.Errorf("failed to update bucket %s: %w", *bucket.Name, err)
+	}
+	return nil
+}
+
+// ensureLifecycleRule adds, updates or removes the lifecycle rule for
+// imported objects, keeping any other rules on the bucket.
+func (c *Client) ensureLifecycleRule(ctx context.Context, namespace string) error {
+	settings := c.Config.Bucket
+	bucketName := common.String(c.Config.OCI.BucketName)
+
+	resp, err := c.ObjectStorage.GetObjectLifecyclePolicy(ctx, objectstorage.GetObjectLifecyclePolicyRequest{
+		NamespaceName: common.String(namespace),
+		BucketName:    bucketName,
+	})
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("failed to get lifecycle policy: %w", err)
+	}
+
+	var rules []objectstorage.ObjectLifecycleRule
+	found := false
+	for _, rule := range resp.Items {
+		if rule.Name != nil && *rule.Name == lifecycleRuleName {
+			found = true
+			continue
+		}
+		rules = append(rules, rule)
+	}
+
+	if settings.LifecycleAction == "" {
+		if !found {
+			return nil
+		}
+		c.Logger.Logf("  Removing lifecycle rule %s", lifecycleRuleName)
+	} else {
+		c.Logger.Logf("  Lifecycle rule: %s objects under %s after %d days",
+			strings.ToLower(settings.LifecycleAction), settings.LifecyclePrefix, settings.LifecycleDays)
+		rules = append(rules, objectstorage.ObjectLifecycleRule{
+			Name:       common.String(lifecycleRuleName),
+			Action:     common.String(settings.LifecycleAction),
+			TimeAmount: common.Int64(int64(settings.LifecycleDays)),
+			TimeUnit:   objectstorage.ObjectLifecycleRuleTimeUnitDays,
+			IsEnabled:  common.Bool(true),
+			Target:     common.String("objects"),
+			ObjectNameFilter: &objectstorage.ObjectNameFilter{
+				InclusionPrefixes: []string{settings.LifecyclePrefix},
+			},
+		})
+	}
+
+	if len(rules) == 0 {
+		if _, err := c.ObjectStorage.DeleteObjectLifecyclePolicy(ctx, objectstorage.DeleteObjectLifecyclePolicyRequest{
+			NamespaceName: common.String(namespace),
+			BucketName:    bucketName,
+		}); err != nil {
+			return fmt.Errorf("failed to delete lifecycle policy: %w", err)
+		}
+		return nil
+	}
+
+	if _, err := c.ObjectStorage.PutObjectLifecyclePolicy(ctx, objectstorage.PutObjectLifecyclePolicyRequest{
+		NamespaceName: common.String(namespace),
+		BucketName:    bucketName,
+		PutObjectLifecyclePolicyDetails: objectstorage.PutObjectLifecyclePolicyDetails{
+			Items: rules,
+		},
+	}); err != nil {
+		return fmt.Errorf("failed to set lifecycle policy: %w", err)
+	}
+	return nil
+}
+
+// retireObject moves the object of an AVAILABLE image under the lifecycle
+// prefix so the lifecycle rule archives or deletes it. It returns the new
+// object name, or objectName unchanged if no lifecycle action is configured.
+func (c *Client) retireObject(ctx context.Context, objectName string) (string, error) {
+	prefix := c.Config.Bucket.LifecyclePrefix
+	if c.Config.Bucket.LifecycleAction == "" || objectName == "" || strings.HasPrefix(objectName, prefix) {
+		return objectName, nil
+	}
+
+	namespace, err := c.GetNamespace(ctx)
+	if err != nil {
+		return objectName, err
+	}
+
+	newName := prefix + objectName
+	if _, err := c.ObjectStorage.RenameObject(ctx, objectstorage.RenameObjectRequest{
+		NamespaceName: common.String(namespace),
+		BucketName:    common.String(c.Config.OCI.BucketName),
+		RenameObjectDetails: objectstorage.RenameObjectDetails{
+			SourceName: common.String(objectName),
+			NewName:    common.String(newName),
+		},
+	}); err != nil {
+		return objectName, fmt.Errorf("failed to move %s under %s: %w", objectName, prefix, err)
+	}
+	return newName, nil
+}
+
+// isNotFound reports whether err is an OCI 404 response.
+func isNotFound(err error) bool {
+	serviceErr, ok := err.(common.ServiceError)
+	return ok && serviceErr.GetHTTPStatusCode() == 404
+}
@@ -9,15 +9,21 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/oracle/oci-go-sdk/v65/common"
 	"github.com/oracle/oci-go-sdk/v65/core"
 	"github.com/oracle/oci-go-sdk/v65/objectstorage"
+	"github.com/oracle/oci-go-sdk/v65/workrequests"
 	"golang.org/x/term"
 
 	"oci-image-builder/internal/config"
+	"oci-image-builder/internal/git"
 	"oci-image-builder/internal/logger"
+	"oci-image-builder/internal/progress"
+	"oci-image-builder/internal/signing"
+	"oci-image-builder/internal/tracing"
 )
 
 // Constants for upload configuration
@@ -31,47 +37,70 @@ const (
 type Client struct {
 	ObjectStorage objectstorage.ObjectStorageClient
 	Compute       core.ComputeClient
+	WorkRequests  workrequests.WorkRequestClient
 	Config        *config.Config
 	Namespace     string
 	Logger        *logger.Logger
+	Events        *progress.Bus
+
+	// LocalPaths overrides the qcow2 uploaded for an image, by image name,
+	// e.g. for images downloaded by 'export'. Others are read from
+	// result-<name>/nixos.qcow2.
+	LocalPaths map[string]string
+
+	// SBOMPaths holds the SBOMs uploaded with images whose qcow2 is in
+	// LocalPaths, by image name.
+	SBOMPaths map[string]string
+
+	// ProvenancePaths holds the provenance statements uploaded with images
+	// whose qcow2 is in LocalPaths, by image name.
+	ProvenancePaths map[string]string
+
+	// Signer signs the manifests of uploaded objects and verifies them
+	// before import. Nil if signing is not configured.
+	Signer  signing.Signer
+	canSign bool
+
+	// Checkouts holds the git checkout each image was built from, by image
+	// name. It is recorded in signed manifests, and its short commit is
+	// appended to object names.
+	Checkouts map[string]*git.Info
+
+	// AllowDirty imports objects whose signed manifest records a dirty tree
+	// or an untagged commit.
+	AllowDirty bool
+
+	updateMu       sync.Mutex
+	importUpdateFn func(ImportUpdate)
+	exportUpdateFn func(ExportedImage, bool)
+	namespaceMu    sync.Mutex
 }
 
-// NewClient creates a new OCI client with the given configuration.
+// NewClient creates a new OCI client with the given configuration. Object
+// Storage uses oci.profile and oci.region; Compute and Work Requests use
+// import.profile and import.region instead when set.
 func NewClient(cfg *config.Config) (*Client, error) {
-	provider, err := getConfigProvider(cfg, "")
+	clients, err := newClients(cfg.OCI.Profile)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create OCI config provider: %w", err)
+		return nil, err
 	}
-
-	// Try to create clients - this may fail if key is encrypted
-	objClient, computeClient, err := createClients(provider)
-	if err != nil {
-		// Check if it's an encrypted key error
-		if isEncryptedKeyError(err) {
-			profile := cfg.OCI.Profile
-			if profile == "" {
-				profile = "DEFAULT"
-			}
-
-			// Prompt for passphrase
-			passphrase, promptErr := promptForPassphrase(profile)
-			if promptErr != nil {
-				return nil, fmt.Errorf("failed to read passphrase: %w", promptErr)
-			}
-
-			// Retry with passphrase
-			provider, err = getConfigProvider(cfg, passphrase)
-			if err != nil {
-				return nil, fmt.Errorf("failed to create config provider with passphrase: %w", err)
-			}
-
-			objClient, computeClient, err = createClients(provider)
-			if err != nil {
-				return nil, fmt.Errorf("failed to create clients with passphrase: %w", err)
-			}
-		} else {
-			return nil, fmt.Errorf("failed to create OCI clients: %w", err)
+	objClient, computeClient, wrClient := clients.objectStorage, clients.compute, clients.workRequests
+	if p := cfg.Import.Profile; p != "" && p != cfg.OCI.Profile {
+		importClients, err := newClients(p)
+		if err != nil {
+			return nil, err
 		}
+		computeClient, wrClient = importClients.compute, importClients.workRequests
+	}
+
+	if cfg.OCI.Region != "" {
+		objClient.SetRegion(cfg.OCI.Region)
+		computeClient.SetRegion(cfg.OCI.Region)
+		wrClient.SetRegion(cfg.OCI.Region)
+	}
+	if cfg.Import.Region != "" {
+		computeClient.SetRegion(cfg.Import.Region)
+		wrClient.SetRegion(cfg.Import.Region)
 	}
 
 	// Set retry policies for long-running operations
@@ -82,32 +111,108 @@ func NewClient(cfg *config.Config) (*Client, error) {
 	computeClient.SetCustomClientConfiguration(common.CustomClientConfiguration{
 		RetryPolicy: &retryPolicy,
 	})
+	wrClient.SetCustomClientConfiguration(common.CustomClientConfiguration{
+		RetryPolicy: &retryPolicy,
+	})
 
 	// Remove timeout on ObjectStorage client for large file uploads
 	// The default 60s timeout is too short for uploading large parts (64MB each)
 	objClient.HTTPClient = &http.Client{}
 
+	// Trace each API request, including retries
+	objClient.HTTPClient = tracing.Dispatcher(objClient.HTTPClient)
+	computeClient.HTTPClient = tracing.Dispatcher(computeClient.HTTPClient)
+	wrClient.HTTPClient = tracing.Dispatcher(wrClient.HTTPClient)
+
+	signer, canSign, err := newSigner(cfg.Signing, clients.provider)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Client{
 		ObjectStorage: objClient,
 		Compute:       computeClient,
+		WorkRequests:  wrClient,
 		Config:        cfg,
 		Logger:        logger.New(),
+		Events:        progress.NewBus(),
+		Signer:        signer,
+		canSign:       canSign,
 	}, nil
 }
 
+// sdkClients are the OCI SDK clients for a profile and the provider they
+// were created from.
+type sdkClients struct {
+	objectStorage objectstorage.ObjectStorageClient
+	compute       core.ComputeClient
+	workRequests  workrequests.WorkRequestClient
+	provider      common.ConfigurationProvider
+}
+
+// newClients creates the OCI SDK clients for a ~/.oci/config profile,
+// prompting for the key passphrase if the key is encrypted.
+func newClients(profile string) (*sdkClients, error) {
+	provider, err := getConfigProvider(profile, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OCI config provider: %w", err)
+	}
+
+	// Try to create clients - this may fail if key is encrypted
+	clients, err := createClients(provider)
+	if err == nil {
+		return clients, nil
+	}
+	if !isEncryptedKeyError(err) {
+		return nil, fmt.Errorf("failed to create OCI clients: %w", err)
+	}
+
+	if profile == "" {
+		profile = "DEFAULT"
+	}
+
+	// Prompt for passphrase
+	passphrase, err := promptForPassphrase(profile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read passphrase: %w", err)
+	}
+
+	// Retry with passphrase
+	provider, err = getConfigProvider(profile, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create config provider with passphrase: %w", err)
+	}
+
+	clients, err = createClients(provider)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create clients with passphrase: %w", err)
+	}
+	return clients, nil
+}
+
 // createClients creates the OCI SDK clients from a provider.
-func createClients(provider common.ConfigurationProvider) (objectstorage.ObjectStorageClient, core.ComputeClient, error) {
+func createClients(provider common.ConfigurationProvider) (*sdkClients, error) {
 	objClient, err := objectstorage.NewObjectStorageClientWithConfigurationProvider(provider)
 	if err != nil {
-		return objectstorage.ObjectStorageClient{}, core.ComputeClient{}, err
+		return nil, err
 	}
 
 	computeClient, err := core.NewComputeClientWithConfigurationProvider(provider)
 	if err != nil {
-		return objectstorage.ObjectStorageClient{}, core.ComputeClient{}, err
+		return nil, err
+	}
+
+	wrClient, err := workrequests.NewWorkRequestClientWithConfigurationProvider(provider)
+	if err != nil {
+		return nil, err
 	}
 
-	return objClient, computeClient, nil
+	return &sdkClients{
+		objectStorage: objClient,
+		compute:       computeClient,
+		workRequests:  wrClient,
+		provider:      provider,
+	}, nil
 }
 
 // SetLogFunc sets the logging function for progress output.
@@ -117,6 +222,9 @@ func (c *Client) SetLogFunc(fn func(string)) {
 
 // GetNamespace retrieves and caches the Object Storage namespace.
 func (c *Client) GetNamespace(ctx context.Context) (string, error) {
+	c.namespaceMu.Lock()
+	defer c.namespaceMu.Unlock()
+
 	if c.Namespace != "" {
 		return c.Namespace, nil
 	}
@@ -131,9 +239,9 @@ func (c *Client) GetNamespace(ctx context.Context) (string, error) {
 	return c.Namespace, nil
 }
 
-// getConfigProvider creates the appropriate OCI configuration provider.
+// getConfigProvider creates the OCI configuration provider for a profile.
 // If passphrase is provided, it will use that for decrypting the key.
-func getConfigProvider(cfg *config.Config, passphrase string) (common.ConfigurationProvider, error) {
+func getConfigProvider(profile, passphrase string) (common.ConfigurationProvider, error) {
 	home, err := os.UserHomeDir()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get home directory: %w", err)
@@ -144,7 +252,6 @@ func getConfigProvider(cfg *config.Config, passphrase string) (common.Configurat
 		return nil, fmt.Errorf("OCI config not found at %s. Run 'oci setup config' to configure", ociConfigPath)
 	}
 
-	profile := cfg.OCI.Profile
 	if profile == "" {
 		profile = "DEFAULT"
 	}
@@ -214,20 +321,24 @@ func newRetryPolicy() common.RetryPolicy {
 
 // OciImage represents an OCI custom image.
 type OciImage struct {
-	ID             string
-	DisplayName    string
-	LifecycleState string
-	TimeCreated    *time.Time
+	ID                     string
+	DisplayName            string
+	LifecycleState         string
+	TimeCreated            *time.Time
+	FreeformTags           map[string]string
+	SizeMB                 int64
+	OperatingSystem        string
+	OperatingSystemVersion string
 }
 
-// ListImages lists custom images in the compartment.
+// ListImages lists custom images in the compartment whose display name
+// starts with prefix, newest first. When an environment is selected, only
+// images tagged for that environment are returned.
 func (c *Client) ListImages(ctx context.Context, prefix string) ([]OciImage, error) {
 	req := core.ListImagesRequest{
-		CompartmentId: common.String(c.Config.OCI.CompartmentOCID),
-	}
-
-	if prefix != "" {
-		req.DisplayName = common.String(prefix)
+		CompartmentId: common.String(c.Config.ImageCompartment()),
+		SortBy:        core.ListImagesSortByTimecreated,
+		SortOrder:     core.ListImagesSortOrderDesc,
 	}
 
 	var images []OciImage
@@ -239,17 +350,13 @@ func (c *Client) ListImages(ctx context.Context, prefix string) ([]OciImage, err
 		}
 
 		for _, img := range resp.Items {
-			var timeCreated *time.Time
-			if img.TimeCreated != nil {
-				t := img.TimeCreated.Time
-				timeCreated = &t
+			if env := c.Config.Environment; env != "" && img.FreeformTags[config.EnvironmentTagKey] != env {
+				continue
+			}
+			if img.DisplayName == nil || !strings.HasPrefix(*img.DisplayName, prefix) {
+				continue
 			}
-			images = append(images, OciImage{
-				ID:             *img.Id,
-				DisplayName:    *img.DisplayName,
-				LifecycleState: string(img.LifecycleState),
-				TimeCreated:    timeCreated,
-			})
+			images = append(images, newOciImage(img))
 		}
 
 		if resp.OpcNextPage == nil {
@@ -261,6 +368,94 @@ func (c *Client) ListImages(ctx context.Context, prefix string) ([]OciImage, err
 	return images, nil
 }
 
+// newOciImage converts an SDK image.
+func newOciImage(img core.Image) OciImage {
+	out := OciImage{
+		ID:             *img.Id,
+		LifecycleState: string(img.LifecycleState),
+		FreeformTags:   img.FreeformTags,
+	}
+	if img.DisplayName != nil {
+		out.DisplayName = *img.DisplayName
+	}
+	if img.TimeCreated != nil {
+		t := img.TimeCreated.Time
+		out.TimeCreated = &t
+	}
+	if img.SizeInMBs != nil {
+		out.SizeMB = *img.SizeInMBs
+	}
+	if img.OperatingSystem != nil {
+		out.OperatingSystem = *img.OperatingSystem
+	}
+	if img.OperatingSystemVersion != nil {
+		out.OperatingSystemVersion = *img.OperatingSystemVersion
+	}
+	return out
+}
+
+// ImageShapes returns the shapes an image is compatible with.
+func (c *Client) ImageShapes(ctx context.Context, imageID string) ([]string, error) {
+	req := core.ListImageShapeCompatibilityEntriesRequest{
+		ImageId: common.String(imageID),
+	}
+
+	var shapes []string
+	for {
+		resp, err := c.Compute.ListImageShapeCompatibilityEntries(ctx, req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list shapes of image %s: %w", truncateID(imageID), err)
+		}
+		for _, entry := range resp.Items {
+			if entry.Shape != nil {
+				shapes = append(shapes, *entry.Shape)
+			}
+		}
+		if resp.OpcNextPage == nil {
+			break
+		}
+		req.Page = resp.OpcNextPage
+	}
+	return shapes, nil
+}
+
+// InstancesByImage returns the display names of the instances in
+// compartmentID that were launched from each image, keyed by image OCID.
+// Terminated instances are ignored.
+func (c *Client) InstancesByImage(ctx context.Context, compartmentID string) (map[string][]string, error) {
+	req := core.ListInstancesRequest{
+		CompartmentId: common.String(compartmentID),
+	}
+
+	instances := make(map[string][]string)
+	for {
+		resp, err := c.Compute.ListInstances(ctx, req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list instances: %w", err)
+		}
+		for _, inst := range resp.Items {
+			switch inst.LifecycleState {
+			case core.InstanceLifecycleStateTerminated, core.InstanceLifecycleStateTerminating:
+				continue
+			}
+
+			imageID := inst.ImageId
+			if src, ok := inst.SourceDetails.(core.InstanceSourceViaImageDetails); ok && src.ImageId != nil {
+				imageID = src.ImageId
+			}
+			if imageID == nil || inst.DisplayName == nil {
+				continue
+			}
+			instances[*imageID] = append(instances[*imageID], *inst.DisplayName)
+		}
+		if resp.OpcNextPage == nil {
+			break
+		}
+		req.Page = resp.OpcNextPage
+	}
+	return instances, nil
+}
+
 // GetImageStatus returns the lifecycle state of an image.
 func (c *Client) GetImageStatus(ctx context.Context, imageID string) (string, error) {
 	req := core.GetImageRequest{
@@ -280,6 +475,18 @@ func (c *Client) GetImageStatus(ctx context.Context, imageID string) (string, er
 	return string(resp.LifecycleState), nil
 }
 
+// DeleteImage deletes a custom image.
+func (c *Client) DeleteImage(ctx context.Context, imageID string) error {
+	req := core.DeleteImageRequest{
+		ImageId: common.String(imageID),
+	}
+
+	if _, err := c.Compute.DeleteImage(ctx, req); err != nil {
+		return fmt.Errorf("failed to delete image %s: %w", truncateID(imageID), err)
+	}
+	return nil
+}
+
 // truncateID truncates an OCID for display.
 func truncateID(id string) string {
 	if len(id) > 20 {
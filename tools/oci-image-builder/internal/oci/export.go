@@ -0,0 +1,308 @@
+package oci
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/oracle/oci-go-sdk/v65/common"
+	"github.com/oracle/oci-go-sdk/v65/core"
+	"github.com/oracle/oci-go-sdk/v65/objectstorage"
+
+	"oci-image-builder/internal/config"
+)
+
+// DownloadPartSize is the size of each ranged request made by Download.
+const DownloadPartSize = 64 * 1024 * 1024
+
+// ExportedImage identifies an image export initiated by Export.
+type ExportedImage struct {
+	ImageID       string
+	DisplayName   string
+	ObjectName    string
+	WorkRequestID string
+	PARID         string // Write request used in import mode "par", until deleted
+}
+
+// SetExportUpdateFunc sets a function called whenever Export creates or
+// releases a write request or starts an export, so that an unfinished
+// export can be recorded and resumed. done reports that the export reached
+// a final state and has nothing left to resume. Calls are serialized.
+func (c *Client) SetExportUpdateFunc(fn func(image ExportedImage, done bool)) {
+	c.updateMu.Lock()
+	defer c.updateMu.Unlock()
+	c.exportUpdateFn = fn
+}
+
+// notifyExport delivers an export update to the configured function.
+func (c *Client) notifyExport(image ExportedImage, done bool) {
+	c.updateMu.Lock()
+	defer c.updateMu.Unlock()
+	if c.exportUpdateFn != nil {
+		c.exportUpdateFn(image, done)
+	}
+}
+
+// Export exports a custom image as a qcow2 object in the upload bucket and
+// waits for the export work request to finish. If objectName is empty the
+// object is named exports/<display name>.qcow2. In import mode "par" the
+// image is exported through a write pre-authenticated request, so it may
+// live in another region or tenancy than the bucket.
+//
+// prev is an unfinished export of the image recorded from earlier updates,
+// if any. If it has a work request for the same object Export waits for it
+// instead of starting another; otherwise its write request is released.
+func (c *Client) Export(ctx context.Context, imageID, objectName string, prev *ExportedImage) (*ExportedImage, error) {
+	if prev != nil && prev.WorkRequestID != "" && (objectName == "" || objectName == prev.ObjectName) {
+		image := *prev
+		c.Logger.Logf("Resuming export of %s to %s...", image.DisplayName, image.ObjectName)
+		c.Logger.Logf("  Work request: %s", image.WorkRequestID)
+		return c.finishExport(ctx, &image)
+	}
+	if prev != nil && prev.PARID != "" {
+		c.ReleasePAR(ctx, "", &prev.PARID)
+		c.notifyExport(*prev, true)
+	}
+
+	namespace, err := c.GetNamespace(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.checkBucket(ctx, namespace); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Compute.GetImage(ctx, core.GetImageRequest{ImageId: common.String(imageID)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get image %s: %w", truncateID(imageID), err)
+	}
+	if resp.LifecycleState != core.ImageLifecycleStateAvailable {
+		return nil, fmt.Errorf("image %s is %s, not AVAILABLE", truncateID(imageID), resp.LifecycleState)
+	}
+
+	image := &ExportedImage{ImageID: imageID, ObjectName: objectName}
+	if resp.DisplayName != nil {
+		image.DisplayName = *resp.DisplayName
+	}
+	if image.ObjectName == "" {
+		image.ObjectName = fmt.Sprintf("exports/%s.qcow2", image.DisplayName)
+	}
+
+	c.Logger.Logf("Exporting %s to %s...", image.DisplayName, image.ObjectName)
+	c.Logger.Logf("  Destination bucket: %s", c.Config.OCI.BucketName)
+
+	var destination core.ExportImageDetails
+	if c.Config.Import.Mode == config.ImportModePAR {
+		id, uri, err := c.createPAR(ctx, namespace, image.ObjectName,
+			objectstorage.CreatePreauthenticatedRequestDetailsAccessTypeObjectwrite)
+		if err != nil {
+			return nil, err
+		}
+		image.PARID = id
+		c.notifyExport(*image, false)
+		c.Logger.Logf("  Exporting via pre-authenticated request (expires in %ds)", c.Config.Import.PARExpirySecs)
+		destination = core.ExportImageViaObjectStorageUriDetails{
+			DestinationUri: common.String(uri),
+			ExportFormat:   core.ExportImageDetailsExportFormatQcow2,
+		}
+	} else {
+		destination = core.ExportImageViaObjectStorageTupleDetails{
+			NamespaceName: common.String(namespace),
+			BucketName:    common.String(c.Config.OCI.BucketName),
+			ObjectName:    common.String(image.ObjectName),
+			ExportFormat:  core.ExportImageDetailsExportFormatQcow2,
+		}
+	}
+
+	exportResp, err := c.Compute.ExportImage(ctx, core.ExportImageRequest{
+		ImageId:            common.String(imageID),
+		ExportImageDetails: destination,
+	})
+	if err == nil && exportResp.OpcWorkRequestId == nil {
+		err = errors.New("no work request returned")
+	}
+	if err != nil {
+		c.ReleasePAR(ctx, "", &image.PARID)
+		c.notifyExport(*image, true)
+		return nil, fmt.Errorf("export failed for %s: %w", image.DisplayName, err)
+	}
+	image.WorkRequestID = *exportResp.OpcWorkRequestId
+	c.notifyExport(*image, false)
+	c.Logger.Logf("  Work request: %s", image.WorkRequestID)
+
+	return c.finishExport(ctx, image)
+}
+
+// finishExport waits for the work request of an export. A write request is
+// only released once the export has finished with it; until then it stays
+// recorded so that the export can be resumed.
+func (c *Client) finishExport(ctx context.Context, image *ExportedImage) (*ExportedImage, error) {
+	finished, err := c.waitForWorkRequest(ctx, image.DisplayName, image.WorkRequestID)
+	if finished {
+		c.ReleasePAR(ctx, "", &image.PARID)
+		c.notifyExport(*image, true)
+	}
+	if err != nil {
+		if !finished {
+			err = fmt.Errorf("%w; run export again to resume", err)
+		}
+		return image, err
+	}
+
+	c.Logger.Logf("  Export complete: %s", image.ObjectName)
+	return image, nil
+}
+
+// waitForWorkRequest polls a work request until it succeeds or fails, using
+// the same backoff and deadline as WaitForImages. finished reports whether
+// the work request reached a final state.
+func (c *Client) waitForWorkRequest(ctx context.Context, name, workRequestID string) (finished bool, err error) {
+	strategy := NewWaitStrategy(&c.Config.OCI)
+	prefix := fmt.Sprintf("  [%s]", name)
+	interval := strategy.Interval
+	startTime := time.Now()
+
+	waitCtx, cancel := context.WithTimeout(ctx, strategy.Deadline)
+	defer cancel()
+
+	for {
+		if err := sleepContext(waitCtx, strategy.jittered(interval)); err != nil {
+			return false, c.waitError(waitCtx, name, startTime)
+		}
+		interval = strategy.next(interval)
+
+		wr, err := c.GetWorkRequest(waitCtx, workRequestID)
+		if err != nil {
+			if waitCtx.Err() != nil {
+				return false, c.waitError(waitCtx, name, startTime)
+			}
+			return false, fmt.Errorf("failed to get work request for %s: %w", name, err)
+		}
+
+		elapsedSecs := int(time.Since(startTime).Seconds())
+		switch wr.Status {
+		case "SUCCEEDED":
+			return true, nil
+		case "FAILED", "CANCELED", "CANCELING":
+			msgs, _ := c.GetWorkRequestErrors(waitCtx, workRequestID)
+			if len(msgs) > 0 {
+				return true, fmt.Errorf("work request for %s %s: %s", name, wr.Status, strings.Join(msgs, "; "))
+			}
+			return true, fmt.Errorf("work request for %s %s", name, wr.Status)
+		default:
+			c.Logger.Logf("%s Work request: %s (%.0f%%, %ds elapsed)", prefix, wr.Status, wr.PercentComplete, elapsedSecs)
+		}
+	}
+}
+
+// Download downloads an object from the upload bucket to destPath in
+// DownloadPartSize ranges. Data is written to destPath.part, which is kept
+// if the download is interrupted; a later Download of the same object
+// continues from it as long as the object is unchanged. It returns the
+// object size.
+func (c *Client) Download(ctx context.Context, objectName, destPath string) (int64, error) {
+	namespace, err := c.GetNamespace(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	head, err := c.ObjectStorage.HeadObject(ctx, objectstorage.HeadObjectRequest{
+		NamespaceName: common.String(namespace),
+		BucketName:    common.String(c.Config.OCI.BucketName),
+		ObjectName:    common.String(objectName),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get object %s: %w", objectName, err)
+	}
+	if head.ContentLength == nil || head.ETag == nil {
+		return 0, fmt.Errorf("object %s has no size or ETag", objectName)
+	}
+	totalBytes, etag := *head.ContentLength, *head.ETag
+
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return 0, fmt.Errorf("failed to create directory for %s: %w", destPath, err)
+	}
+
+	partPath := destPath + ".part"
+	etagPath := partPath + ".etag"
+
+	// Continue a previous download only if it was of the same object version
+	var offset int64
+	if prev, err := os.ReadFile(etagPath); err == nil && string(prev) == etag {
+		if info, err := os.Stat(partPath); err == nil {
+			offset = min(info.Size()/DownloadPartSize*DownloadPartSize, totalBytes)
+		}
+	}
+	if offset == 0 {
+		if err := os.WriteFile(etagPath, []byte(etag), 0644); err != nil {
+			return 0, fmt.Errorf("failed to write %s: %w", etagPath, err)
+		}
+	}
+
+	file, err := os.OpenFile(partPath, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open %s: %w", partPath, err)
+	}
+	defer file.Close()
+	if err := file.Truncate(offset); err != nil {
+		return 0, fmt.Errorf("failed to truncate %s: %w", partPath, err)
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("failed to seek %s: %w", partPath, err)
+	}
+
+	totalParts := (totalBytes + DownloadPartSize - 1) / DownloadPartSize
+	c.Logger.Logf("Downloading %s (%d MB) to %s...", objectName, totalBytes/(1024*1024), destPath)
+	if offset > 0 {
+		c.Logger.Logf("  Resuming at part %d/%d", offset/DownloadPartSize+1, totalParts)
+	}
+
+	for offset < totalBytes {
+		end := min(offset+DownloadPartSize, totalBytes) - 1
+		resp, err := c.ObjectStorage.GetObject(ctx, objectstorage.GetObjectRequest{
+			NamespaceName: common.String(namespace),
+			BucketName:    common.String(c.Config.OCI.BucketName),
+			ObjectName:    common.String(objectName),
+			IfMatch:       common.String(etag),
+			Range:         common.String(fmt.Sprintf("bytes=%d-%d", offset, end)),
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return 0, fmt.Errorf("download of %s interrupted, run export again to resume: %w", objectName, ctx.Err())
+			}
+			return 0, fmt.Errorf("failed to download %s: %w", objectName, err)
+		}
+
+		n, err := io.Copy(file, resp.Content)
+		resp.Content.Close()
+		if err == nil && n != end-offset+1 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			if errors.Is(err, context.Canceled) || ctx.Err() != nil {
+				return 0, fmt.Errorf("download of %s interrupted, run export again to resume: %w", objectName, ctx.Err())
+			}
+			return 0, fmt.Errorf("failed to download %s: %w", objectName, err)
+		}
+
+		offset += n
+		c.Logger.Logf("  Part %d/%d complete (%.1f%%)", (offset+DownloadPartSize-1)/DownloadPartSize, totalParts,
+			float64(offset)/float64(totalBytes)*100)
+	}
+
+	if err := file.Close(); err != nil {
+		return 0, fmt.Errorf("failed to write %s: %w", partPath, err)
+	}
+	if err := os.Rename(partPath, destPath); err != nil {
+		return 0, fmt.Errorf("failed to move %s to %s: %w", partPath, destPath, err)
+	}
+	os.Remove(etagPath)
+
+	c.Logger.Logf("  Download complete: %s", destPath)
+	return totalBytes, nil
+}
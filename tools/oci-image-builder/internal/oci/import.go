@@ -3,132 +3,211 @@ package oci
 import (
 	"context"
 	"fmt"
+	"path"
+	"regexp"
 	"time"
 
 	"github.com/oracle/oci-go-sdk/v65/common"
 	"github.com/oracle/oci-go-sdk/v65/core"
+	"github.com/oracle/oci-go-sdk/v65/objectstorage"
+	"go.opentelemetry.io/otel/attribute"
+
+	"oci-image-builder/internal/config"
+	"oci-image-builder/internal/git"
+	"oci-image-builder/internal/progress"
+	"oci-image-builder/internal/signing"
+	"oci-image-builder/internal/tracing"
 )
 
-// Import imports images from Object Storage as OCI Custom Images.
-func (c *Client) Import(ctx context.Context, objectNames []string) (map[string]string, error) {
+// ImportedImage identifies an image import initiated by Import.
+type ImportedImage struct {
+	ImageID       string
+	WorkRequestID string // opc-work-request-id returned by CreateImage
+	ObjectName    string // Source object; moved under bucket.lifecycle_prefix once AVAILABLE
+	PARID         string // Pre-authenticated request used in import mode "par", until deleted
+	ObjectETag    string // ETag of the source object when its signature was verified
+}
+
+// Import imports images from Object Storage as OCI Custom Images. An SBOM
+// or provenance statement uploaded next to an object is named in the
+// image's SBOMTagKey or ProvenanceTagKey tag. If signing is configured,
+// objects without a valid signed manifest or whose contents do not match it
+// are refused, as are objects whose manifest records a dirty tree or an
+// untagged commit unless AllowDirty is set. An object replaced before OCI
+// finished reading it fails the import in WaitForImages. Display names end
+// in the short commit the object was built from, if known. The returned map
+// is keyed by image name.
+func (c *Client) Import(ctx context.Context, objectNames []string) (map[string]ImportedImage, error) {
 	namespace, err := c.GetNamespace(ctx)
 	if err != nil {
 		return nil, err
 	}
 
 	timestamp := time.Now().Format("20060102-150405")
-	imageIDs := make(map[string]string)
+	images := make(map[string]ImportedImage)
 
 	for _, objectName := range objectNames {
 		imageName := extractImageName(objectName)
-		displayName := fmt.Sprintf("%s-nixos-%s", imageName, timestamp)
+
+		header := progress.Header{Image: imageName}
+		c.Events.Emit(&progress.StageStarted{Header: header, Stage: progress.StageImport})
+		importCtx, span := tracing.Start(ctx, "import", tracing.Image(imageName),
+			attribute.String("oci.object_name", objectName),
+			attribute.String("oci.import_mode", c.Config.Import.Mode))
 
 		c.Logger.Logf("Importing %s as OCI Custom Image...", objectName)
-		c.Logger.Logf("  Display name: %s", displayName)
 		c.Logger.Logf("  Source bucket: %s", c.Config.OCI.BucketName)
 
-		imageSource := core.ImageSourceViaObjectStorageTupleDetails{
-			NamespaceName:          common.String(namespace),
-			BucketName:             common.String(c.Config.OCI.BucketName),
-			ObjectName:             common.String(objectName),
-			SourceImageType:        core.ImageSourceDetailsSourceImageTypeQcow2,
-			OperatingSystem:        common.String("NixOS"),
-			OperatingSystemVersion: common.String("24.11"),
+		manifest, etag, err := c.verifyObject(importCtx, namespace, objectName)
+		if err == nil {
+			err = c.checkCheckout(importCtx, objectName, manifest)
+		}
+		if err != nil {
+			c.Logger.Logf("  %v", err)
+			tracing.End(span, err)
+			c.Events.Emit(&progress.StageFailed{Header: header, Stage: progress.StageImport, Err: err})
+			return nil, err
+		}
+
+		displayName := fmt.Sprintf("%s-nixos-%s", imageName, timestamp)
+		if commit := objectCommit(objectName, manifest); commit != "" {
+			displayName += "-" + commit
+		}
+		c.Logger.Logf("  Display name: %s", displayName)
+
+		tags := c.Config.ImageTags()
+		sbomObject, err := c.findSBOM(importCtx, namespace, objectName)
+		if err != nil {
+			tracing.End(span, err)
+			c.Events.Emit(&progress.StageFailed{Header: header, Stage: progress.StageImport, Err: err})
+			return nil, err
+		}
+		if sbomObject != "" {
+			c.Logger.Logf("  SBOM: %s", sbomObject)
+			tags[SBOMTagKey] = sbomObject
+		}
+		provenanceObject, err := c.findProvenance(importCtx, namespace, objectName)
+		if err != nil {
+			tracing.End(span, err)
+			c.Events.Emit(&progress.StageFailed{Header: header, Stage: progress.StageImport, Err: err})
+			return nil, err
+		}
+		if provenanceObject != "" {
+			c.Logger.Logf("  Provenance: %s", provenanceObject)
+			tags[ProvenanceTagKey] = provenanceObject
+		}
+
+		var (
+			imageSource core.ImageSourceDetails
+			parID       string
+		)
+		if c.Config.Import.Mode == config.ImportModePAR {
+			id, uri, err := c.createPAR(importCtx, namespace, objectName,
+				objectstorage.CreatePreauthenticatedRequestDetailsAccessTypeObjectread)
+			if err != nil {
+				tracing.End(span, err)
+				c.Events.Emit(&progress.StageFailed{Header: header, Stage: progress.StageImport, Err: err})
+				return nil, err
+			}
+			parID = id
+			c.notifyImport(ImportUpdate{ImageName: imageName, Image: ImportedImage{ObjectName: objectName, PARID: parID}, State: "PENDING"})
+			c.Logger.Logf("  Importing via pre-authenticated request (expires in %ds)", c.Config.Import.PARExpirySecs)
+			imageSource = core.ImageSourceViaObjectStorageUriDetails{
+				SourceUri:              common.String(uri),
+				SourceImageType:        core.ImageSourceDetailsSourceImageTypeQcow2,
+				OperatingSystem:        common.String("NixOS"),
+				OperatingSystemVersion: common.String("24.11"),
+			}
+		} else {
+			imageSource = core.ImageSourceViaObjectStorageTupleDetails{
+				NamespaceName:          common.String(namespace),
+				BucketName:             common.String(c.Config.OCI.BucketName),
+				ObjectName:             common.String(objectName),
+				SourceImageType:        core.ImageSourceDetailsSourceImageTypeQcow2,
+				OperatingSystem:        common.String("NixOS"),
+				OperatingSystemVersion: common.String("24.11"),
+			}
 		}
 
 		req := core.CreateImageRequest{
 			CreateImageDetails: core.CreateImageDetails{
-				CompartmentId:      common.String(c.Config.OCI.CompartmentOCID),
+				CompartmentId:      common.String(c.Config.ImageCompartment()),
 				DisplayName:        common.String(displayName),
 				ImageSourceDetails: imageSource,
 				LaunchMode:         core.CreateImageDetailsLaunchModeParavirtualized,
+				FreeformTags:       tags,
 			},
 		}
 
-		resp, err := c.Compute.CreateImage(ctx, req)
+		err = c.checkUnchanged(importCtx, namespace, objectName, etag)
+		var resp core.CreateImageResponse
+		if err == nil {
+			resp, err = c.Compute.CreateImage(importCtx, req)
+		}
 		if err != nil {
 			c.Logger.Logf("  Import failed: %v", err)
-			return nil, fmt.Errorf("import failed for %s: %w", imageName, err)
+			c.ReleasePAR(importCtx, "", &parID)
+			c.notifyImport(ImportUpdate{ImageName: imageName, Image: ImportedImage{ObjectName: objectName, PARID: parID}, State: "PENDING"})
+			err = fmt.Errorf("import failed for %s: %w", imageName, err)
+			tracing.End(span, err)
+			c.Events.Emit(&progress.StageFailed{Header: header, Stage: progress.StageImport, Err: err})
+			return nil, err
 		}
 
-		imageID := *resp.Id
-		c.Logger.Logf("  Import initiated: %s", imageID)
-		imageIDs[imageName] = imageID
-	}
-
-	return imageIDs, nil
-}
-
-// WaitForImages waits for all images to become available.
-func (c *Client) WaitForImages(ctx context.Context, imageIDs map[string]string) error {
-	initialDelay := time.Duration(c.Config.OCI.InitialDelaySecs) * time.Second
-	pollInterval := time.Duration(c.Config.OCI.PollIntervalSecs) * time.Second
-	maxWait := time.Duration(c.Config.OCI.MaxWaitSecs) * time.Second
-
-	for imageName, imageID := range imageIDs {
-		if err := c.waitForImage(ctx, imageName, imageID, initialDelay, pollInterval, maxWait); err != nil {
-			return err
+		image := ImportedImage{ImageID: *resp.Id, ObjectName: objectName, PARID: parID, ObjectETag: etag}
+		if resp.OpcWorkRequestId != nil {
+			image.WorkRequestID = *resp.OpcWorkRequestId
 		}
+		c.Logger.Logf("  Import initiated: %s", image.ImageID)
+		span.SetAttributes(attribute.String("oci.image_id", image.ImageID))
+		tracing.End(span, nil)
+		if image.WorkRequestID != "" {
+			c.Logger.Logf("  Work request: %s", image.WorkRequestID)
+		}
+		images[imageName] = image
+		c.notifyImport(ImportUpdate{ImageName: imageName, Image: image, State: "IMPORTING"})
+		c.Events.Emit(&progress.ImportStateChanged{
+			Header:        header,
+			ImageID:       image.ImageID,
+			WorkRequestID: image.WorkRequestID,
+			State:         "IMPORTING",
+		})
 	}
 
-	return nil
+	return images, nil
 }
 
-// waitForImage waits for a single image to become available.
-func (c *Client) waitForImage(ctx context.Context, imageName, imageID string, initialDelay, pollInterval, maxWait time.Duration) error {
-	c.Logger.Logf("Waiting for image %s to be available...", truncateID(imageID))
-	c.Logger.Logf("  Initial delay: %ds, poll interval: %ds, max wait: %ds",
-		int(initialDelay.Seconds()), int(pollInterval.Seconds()), int(maxWait.Seconds()))
-
-	// Initial delay
-	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	case <-time.After(initialDelay):
+// commitSuffix returns the suffix naming the commit an image was built from
+// in its object name, e.g. "-1a2b3c4", or "" if it is not known.
+func (c *Client) commitSuffix(imageName string) string {
+	checkout := c.Checkouts[imageName]
+	if checkout == nil || checkout.ShortCommit == "" {
+		return ""
 	}
+	return "-" + checkout.ShortCommit
+}
 
-	startTime := time.Now()
-
-	for {
-		elapsed := time.Since(startTime)
-		elapsedSecs := int(elapsed.Seconds())
-
-		status, err := c.GetImageStatus(ctx, imageID)
-		if err != nil {
-			return fmt.Errorf("failed to get status for %s: %w", imageName, err)
-		}
-
-		switch status {
-		case "AVAILABLE":
-			c.Logger.Logf("  Image is AVAILABLE (%ds elapsed)", elapsedSecs)
-			return nil
-
-		case "IMPORTING":
-			c.Logger.Logf("  Status: IMPORTING (%ds elapsed)", elapsedSecs)
-
-		case "NOT_FOUND":
-			c.Logger.Logf("  Status: NOT_FOUND - waiting for import to register (%ds elapsed)", elapsedSecs)
-
-		default:
-			return fmt.Errorf("unexpected state for image %s: %s", imageName, status)
-		}
-
-		if elapsed >= maxWait {
-			c.Logger.Logf("  Timeout waiting for image after %ds", elapsedSecs)
-			return fmt.Errorf("timeout waiting for image %s after %ds", imageName, elapsedSecs)
-		}
+// objectCommitPattern matches the timestamp and short commit Upload puts
+// at the end of object names.
+var objectCommitPattern = regexp.MustCompile(`-\d{8}-\d{6}-([0-9a-f]{4,40})\.qcow2$`)
 
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-time.After(pollInterval):
-		}
+// objectCommit returns the short commit an object was built from: the one
+// in its name, or else the one in its signed manifest, if any.
+func objectCommit(objectName string, manifest *signing.Manifest) string {
+	if m := objectCommitPattern.FindStringSubmatch(objectName); m != nil {
+		return m[1]
+	}
+	if manifest != nil {
+		return git.Short(manifest.GitCommit)
 	}
+	return ""
 }
 
-// extractImageName extracts the base image name from an object name.
-// e.g., "headscale-20240115-123456.qcow2" -> "headscale"
+// extractImageName extracts the base image name from an object name,
+// ignoring any prefix such as bucket.lifecycle_prefix.
+// e.g., "headscale-20240115-123456-1a2b3c4.qcow2" -> "headscale"
 func extractImageName(objectName string) string {
+	objectName = path.Base(objectName)
 	for i, c := range objectName {
 		if c == '-' {
 			return objectName[:i]
@@ -0,0 +1,77 @@
+package oci
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/oracle/oci-go-sdk/v65/common"
+	"github.com/oracle/oci-go-sdk/v65/objectstorage"
+)
+
+// createPAR creates a pre-authenticated request for an object and returns
+// its ID and full URL. It expires after import.par_expiry_secs.
+func (c *Client) createPAR(ctx context.Context, namespace, objectName string, access objectstorage.CreatePreauthenticatedRequestDetailsAccessTypeEnum) (string, string, error) {
+	expires := time.Now().Add(time.Duration(c.Config.Import.PARExpirySecs) * time.Second)
+
+	resp, err := c.ObjectStorage.CreatePreauthenticatedRequest(ctx, objectstorage.CreatePreauthenticatedRequestRequest{
+		NamespaceName: common.String(namespace),
+		BucketName:    common.String(c.Config.OCI.BucketName),
+		CreatePreauthenticatedRequestDetails: objectstorage.CreatePreauthenticatedRequestDetails{
+			Name:        common.String("oci-image-builder-" + objectName),
+			ObjectName:  common.String(objectName),
+			AccessType:  access,
+			TimeExpires: &common.SDKTime{Time: expires},
+		},
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("failed to create pre-authenticated request for %s: %w", objectName, err)
+	}
+
+	uri := *resp.AccessUri
+	if resp.FullPath != nil && *resp.FullPath != "" {
+		uri = *resp.FullPath
+	} else {
+		uri = c.ObjectStorage.Host + uri
+	}
+	return *resp.Id, uri, nil
+}
+
+// deletePAR deletes a pre-authenticated request created by createPAR. A
+// request that no longer exists is not an error.
+func (c *Client) deletePAR(ctx context.Context, parID string) error {
+	namespace, err := c.GetNamespace(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.ObjectStorage.DeletePreauthenticatedRequest(ctx, objectstorage.DeletePreauthenticatedRequestRequest{
+		NamespaceName: common.String(namespace),
+		BucketName:    common.String(c.Config.OCI.BucketName),
+		ParId:         common.String(parID),
+	})
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("failed to delete pre-authenticated request: %w", err)
+	}
+	return nil
+}
+
+// ReleasePAR deletes the pre-authenticated request of a finished or
+// abandoned import or export, if any, and clears *parID. Messages are
+// logged under imageName unless it is empty. Failures are only logged,
+// since the request expires on its own.
+func (c *Client) ReleasePAR(ctx context.Context, imageName string, parID *string) {
+	if *parID == "" {
+		return
+	}
+	prefix := "  "
+	if imageName != "" {
+		prefix = fmt.Sprintf("  [%s] ", imageName)
+	}
+	if err := c.deletePAR(context.WithoutCancel(ctx), *parID); err != nil {
+		c.Logger.Logf("%sWarning: %v", prefix, err)
+		return
+	}
+	c.Logger.Logf("%sDeleted pre-authenticated request", prefix)
+	*parID = ""
+}
@@ -0,0 +1,116 @@
+package oci
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"strings"
+	"time"
+
+	"github.com/oracle/oci-go-sdk/v65/common"
+	"github.com/oracle/oci-go-sdk/v65/core"
+)
+
+// PointerTagKey is the freeform tag marking the live image of an image
+// definition ("current") and the one it replaced ("previous"). Superseded
+// images have no pointer tag.
+const PointerTagKey = "oci-image-builder-pointer"
+
+// Pointer tag values.
+const (
+	PointerCurrent  = "current"
+	PointerPrevious = "previous"
+)
+
+// GetImage returns a custom image by OCID.
+func (c *Client) GetImage(ctx context.Context, imageID string) (*OciImage, error) {
+	resp, err := c.Compute.GetImage(ctx, core.GetImageRequest{ImageId: common.String(imageID)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get image %s: %w", truncateID(imageID), err)
+	}
+
+	img := newOciImage(resp.Image)
+	return &img, nil
+}
+
+// SetPointerTag sets the pointer tag of an image, or removes it if pointer
+// is empty. Other freeform tags are kept.
+func (c *Client) SetPointerTag(ctx context.Context, imageID, pointer string) error {
+	img, err := c.GetImage(ctx, imageID)
+	if err != nil {
+		return err
+	}
+	if img.FreeformTags[PointerTagKey] == pointer {
+		return nil
+	}
+
+	tags := maps.Clone(img.FreeformTags)
+	if tags == nil {
+		tags = make(map[string]string)
+	}
+	if pointer == "" {
+		delete(tags, PointerTagKey)
+	} else {
+		tags[PointerTagKey] = pointer
+	}
+
+	if _, err := c.Compute.UpdateImage(ctx, core.UpdateImageRequest{
+		ImageId:            common.String(imageID),
+		UpdateImageDetails: core.UpdateImageDetails{FreeformTags: tags},
+	}); err != nil {
+		return fmt.Errorf("failed to tag image %s: %w", truncateID(imageID), err)
+	}
+	return nil
+}
+
+// newestTagged returns the newest image whose display name starts with
+// prefix and whose pointer tag is pointer, or nil if there is none.
+func newestTagged(images []OciImage, prefix, pointer string) *OciImage {
+	var newest *OciImage
+	var newestTime time.Time
+	for i := range images {
+		img := &images[i]
+		if img.FreeformTags[PointerTagKey] != pointer || !strings.HasPrefix(img.DisplayName, prefix) {
+			continue
+		}
+		if img.TimeCreated != nil && (newest == nil || img.TimeCreated.After(newestTime)) {
+			newest, newestTime = img, *img.TimeCreated
+		}
+	}
+	return newest
+}
+
+// TaggedPointers returns the OCIDs of the images tagged current and previous
+// for an image name, or empty strings if none are tagged.
+func (c *Client) TaggedPointers(ctx context.Context, imageName string) (current, previous string, err error) {
+	images, err := c.ListImages(ctx, "")
+	if err != nil {
+		return "", "", err
+	}
+
+	prefix := imageName + "-nixos-"
+	if img := newestTagged(images, prefix, PointerCurrent); img != nil {
+		current = img.ID
+	}
+	if img := newestTagged(images, prefix, PointerPrevious); img != nil {
+		previous = img.ID
+	}
+	return current, previous, nil
+}
+
+// PointerTagged returns the images of an image name that have a pointer
+// tag, newest first.
+func (c *Client) PointerTagged(ctx context.Context, imageName string) ([]OciImage, error) {
+	images, err := c.ListImages(ctx, imageName+"-nixos-")
+	if err != nil {
+		return nil, err
+	}
+
+	var tagged []OciImage
+	for _, img := range images {
+		if img.FreeformTags[PointerTagKey] != "" {
+			tagged = append(tagged, img)
+		}
+	}
+	return tagged, nil
+}
@@ -0,0 +1,79 @@
+package oci
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/oracle/oci-go-sdk/v65/common"
+	"github.com/oracle/oci-go-sdk/v65/objectstorage"
+
+	"oci-image-builder/internal/provenance"
+)
+
+// ProvenanceTagKey is the freeform tag naming the provenance statement
+// object of an image in the upload bucket.
+const ProvenanceTagKey = "oci-image-builder-provenance"
+
+// ProvenanceObjectName returns the object name of the provenance statement
+// uploaded next to the qcow2 objectName.
+func ProvenanceObjectName(objectName string) string {
+	return strings.TrimSuffix(objectName, ".qcow2") + provenance.Extension
+}
+
+// provenancePath returns the provenance statement to upload with an image,
+// or "" if there is none. Images with an overridden qcow2 only use
+// ProvenancePaths; others use the result-<name> statement written by the
+// build, if any.
+func (c *Client) provenancePath(imageName string) string {
+	if _, ok := c.LocalPaths[imageName]; ok {
+		return c.ProvenancePaths[imageName]
+	}
+
+	path := fmt.Sprintf("result-%s%s", imageName, provenance.Extension)
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+// uploadProvenance uploads the provenance statement of an image, if it has
+// one, next to its qcow2 object and returns the statement's object name.
+func (c *Client) uploadProvenance(ctx context.Context, namespace, imageName, objectName string) (string, error) {
+	path := c.provenancePath(imageName)
+	if path == "" {
+		return "", nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read provenance of %s: %w", imageName, err)
+	}
+
+	provenanceObject := ProvenanceObjectName(objectName)
+	if err := c.putObject(ctx, namespace, provenanceObject, "application/vnd.in-toto+json", data); err != nil {
+		return "", fmt.Errorf("failed to upload provenance of %s: %w", imageName, err)
+	}
+
+	c.Logger.Logf("  Provenance uploaded: %s", provenanceObject)
+	return provenanceObject, nil
+}
+
+// findProvenance returns the provenance statement object uploaded next to a
+// qcow2 object, or "" if there is none.
+func (c *Client) findProvenance(ctx context.Context, namespace, objectName string) (string, error) {
+	provenanceObject := ProvenanceObjectName(objectName)
+	_, err := c.ObjectStorage.HeadObject(ctx, objectstorage.HeadObjectRequest{
+		NamespaceName: common.String(namespace),
+		BucketName:    common.String(c.Config.OCI.BucketName),
+		ObjectName:    common.String(provenanceObject),
+	})
+	if isNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to look up provenance of %s: %w", objectName, err)
+	}
+	return provenanceObject, nil
+}
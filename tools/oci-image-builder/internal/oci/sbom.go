@@ -0,0 +1,100 @@
+package oci
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/oracle/oci-go-sdk/v65/common"
+	"github.com/oracle/oci-go-sdk/v65/objectstorage"
+
+	"oci-image-builder/internal/config"
+)
+
+// SBOMTagKey is the freeform tag naming the SBOM object of an image in the
+// upload bucket.
+const SBOMTagKey = "oci-image-builder-sbom"
+
+// sbomExtensions are the extensions of SBOMs in each supported format.
+var sbomExtensions = []string{
+	config.SBOMConfig{Format: config.SBOMCycloneDX}.Extension(),
+	config.SBOMConfig{Format: config.SBOMSPDX}.Extension(),
+}
+
+// SBOMObjectName returns the object name of the SBOM at sbomPath uploaded
+// next to the qcow2 objectName: the same stem with the SBOM's extension.
+func SBOMObjectName(objectName, sbomPath string) string {
+	ext := path.Ext(sbomPath)
+	for _, e := range sbomExtensions {
+		if strings.HasSuffix(sbomPath, e) {
+			ext = e
+		}
+	}
+	return strings.TrimSuffix(objectName, ".qcow2") + ext
+}
+
+// sbomPath returns the SBOM to upload with an image, or "" if there is
+// none. Images with an overridden qcow2 only use SBOMPaths; others use the
+// result-<name> SBOM written by the build, if any.
+func (c *Client) sbomPath(imageName string) string {
+	if _, ok := c.LocalPaths[imageName]; ok {
+		return c.SBOMPaths[imageName]
+	}
+
+	ext := c.Config.SBOM.Extension()
+	if ext == "" {
+		return ""
+	}
+	sbomPath := fmt.Sprintf("result-%s%s", imageName, ext)
+	if _, err := os.Stat(sbomPath); err != nil {
+		return ""
+	}
+	return sbomPath
+}
+
+// uploadSBOM uploads the SBOM of an image, if it has one, next to its qcow2
+// object and returns the SBOM object name.
+func (c *Client) uploadSBOM(ctx context.Context, namespace, imageName, objectName string) (string, error) {
+	sbomPath := c.sbomPath(imageName)
+	if sbomPath == "" {
+		return "", nil
+	}
+
+	data, err := os.ReadFile(sbomPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read SBOM of %s: %w", imageName, err)
+	}
+
+	sbomObject := SBOMObjectName(objectName, sbomPath)
+	if err := c.putObject(ctx, namespace, sbomObject, "application/json", data); err != nil {
+		return "", fmt.Errorf("failed to upload SBOM of %s: %w", imageName, err)
+	}
+
+	c.Logger.Logf("  SBOM uploaded: %s", sbomObject)
+	return sbomObject, nil
+}
+
+// findSBOM returns the SBOM object uploaded next to a qcow2 object, or ""
+// if there is none.
+func (c *Client) findSBOM(ctx context.Context, namespace, objectName string) (string, error) {
+	stem := strings.TrimSuffix(objectName, ".qcow2")
+	resp, err := c.ObjectStorage.ListObjects(ctx, objectstorage.ListObjectsRequest{
+		NamespaceName: common.String(namespace),
+		BucketName:    common.String(c.Config.OCI.BucketName),
+		Prefix:        common.String(stem + "."),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to look up SBOM of %s: %w", objectName, err)
+	}
+
+	for _, obj := range resp.Objects {
+		for _, ext := range sbomExtensions {
+			if obj.Name != nil && *obj.Name == stem+ext {
+				return *obj.Name, nil
+			}
+		}
+	}
+	return "", nil
+}
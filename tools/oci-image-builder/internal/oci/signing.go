@@ -0,0 +1,347 @@
+package oci
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/oracle/oci-go-sdk/v65/common"
+	"github.com/oracle/oci-go-sdk/v65/keymanagement"
+	"github.com/oracle/oci-go-sdk/v65/objectstorage"
+
+	"oci-image-builder/internal/config"
+	"oci-image-builder/internal/git"
+	"oci-image-builder/internal/signing"
+	"oci-image-builder/internal/tracing"
+)
+
+// Manifest objects are named after their qcow2 object, and their signatures
+// after the manifest.
+const (
+	manifestSuffix  = ".manifest.json"
+	signatureSuffix = ".sig"
+)
+
+// maxManifestBytes bounds the manifest and signature objects read back.
+const maxManifestBytes = 64 * 1024
+
+// ManifestObjectName returns the name of the signed manifest of a qcow2
+// object. Its signature is the same name with ".sig" appended.
+func ManifestObjectName(objectName string) string {
+	return strings.TrimSuffix(objectName, ".qcow2") + manifestSuffix
+}
+
+// newSigner returns the signer configured in [signing], or nil if signing
+// is off, and whether it can sign as well as verify. KMS keys are used
+// through the vault's crypto endpoint with the same credentials as Object
+// Storage.
+func newSigner(cfg config.SigningConfig, provider common.ConfigurationProvider) (signing.Signer, bool, error) {
+	if !cfg.Enabled() {
+		return nil, false, nil
+	}
+
+	if cfg.KMSKeyID != "" {
+		client, err := keymanagement.NewKmsCryptoClientWithConfigurationProvider(provider, cfg.KMSCryptoEndpoint)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to create KMS crypto client: %w", err)
+		}
+		retryPolicy := newRetryPolicy()
+		client.SetCustomClientConfiguration(common.CustomClientConfiguration{
+			RetryPolicy: &retryPolicy,
+		})
+		client.HTTPClient = tracing.Dispatcher(client.HTTPClient)
+		return &kmsSigner{client: client, keyID: cfg.KMSKeyID, algorithm: cfg.KMSAlgorithm}, true, nil
+	}
+
+	signer, err := signing.LoadEd25519(cfg.KeyPath, cfg.PublicKeyPath)
+	return signer, cfg.KeyPath != "", err
+}
+
+// CheckCanSign returns an error if signing is configured but uploads cannot
+// be signed, because only signing.public_key_path is set. Manifests are
+// signed after the upload, so check this before uploading.
+func (c *Client) CheckCanSign() error {
+	if c.Signer != nil && !c.canSign {
+		return fmt.Errorf("cannot sign uploads with only signing.public_key_path set; set signing.key_path or signing.kms_key_id on hosts that upload")
+	}
+	return nil
+}
+
+// kmsSigner signs with an asymmetric OCI Vault key.
+type kmsSigner struct {
+	client    keymanagement.KmsCryptoClient
+	keyID     string
+	algorithm string
+}
+
+// Sign implements signing.Signer.
+func (s *kmsSigner) Sign(ctx context.Context, message []byte) (*signing.Signature, error) {
+	resp, err := s.client.Sign(ctx, keymanagement.SignRequest{
+		SignDataDetails: keymanagement.SignDataDetails{
+			KeyId:            common.String(s.keyID),
+			Message:          common.String(base64.StdEncoding.EncodeToString(message)),
+			MessageType:      keymanagement.SignDataDetailsMessageTypeRaw,
+			SigningAlgorithm: keymanagement.SignDataDetailsSigningAlgorithmEnum(s.algorithm),
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign with KMS key: %w", err)
+	}
+
+	value, err := base64.StdEncoding.DecodeString(*resp.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode KMS signature: %w", err)
+	}
+	return &signing.Signature{
+		Algorithm:    s.algorithm,
+		KeyID:        s.keyID,
+		KeyVersionID: *resp.KeyVersionId,
+		Value:        value,
+	}, nil
+}
+
+// Verify implements signing.Signer.
+func (s *kmsSigner) Verify(ctx context.Context, message []byte, sig *signing.Signature) error {
+	if sig.Algorithm != s.algorithm || sig.KeyID != s.keyID || sig.KeyVersionID == "" {
+		return fmt.Errorf("signed by %s key %s, expected %s key %s", sig.Algorithm, sig.KeyID, s.algorithm, s.keyID)
+	}
+
+	resp, err := s.client.Verify(ctx, keymanagement.VerifyRequest{
+		VerifyDataDetails: keymanagement.VerifyDataDetails{
+			KeyId:            common.String(s.keyID),
+			KeyVersionId:     common.String(sig.KeyVersionID),
+			Message:          common.String(base64.StdEncoding.EncodeToString(message)),
+			MessageType:      keymanagement.VerifyDataDetailsMessageTypeRaw,
+			Signature:        common.String(base64.StdEncoding.EncodeToString(sig.Value)),
+			SigningAlgorithm: keymanagement.VerifyDataDetailsSigningAlgorithmEnum(s.algorithm),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to verify with KMS key: %w", err)
+	}
+	if resp.IsSignatureValid == nil || !*resp.IsSignatureValid {
+		return signing.ErrBadSignature
+	}
+	return nil
+}
+
+// signObject uploads a signed manifest of an uploaded qcow2 object, hashing
+// the local file it was uploaded from. It does nothing if signing is off.
+func (c *Client) signObject(ctx context.Context, namespace, imageName, objectName string) error {
+	if c.Signer == nil {
+		return nil
+	}
+
+	sum, size, err := signing.FileDigest(c.localPath(imageName))
+	if err != nil {
+		return err
+	}
+	manifest := &signing.Manifest{
+		Image:      imageName,
+		ObjectName: objectName,
+		SHA256:     sum,
+		Size:       size,
+		CreatedAt:  time.Now().UTC(),
+	}
+	if checkout := c.Checkouts[imageName]; checkout != nil {
+		manifest.GitCommit = checkout.Commit
+		manifest.GitTags = checkout.Tags
+		manifest.GitDirty = checkout.Dirty
+	}
+	if image := c.Config.GetImage(imageName); image != nil {
+		manifest.FlakeTarget = image.FlakeTarget
+	}
+
+	data, err := signing.Encode(manifest)
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest of %s: %w", imageName, err)
+	}
+	sig, err := c.Signer.Sign(ctx, data)
+	if err != nil {
+		return fmt.Errorf("failed to sign manifest of %s: %w", imageName, err)
+	}
+	sigData, err := json.MarshalIndent(sig, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode signature of %s: %w", imageName, err)
+	}
+
+	manifestObject := ManifestObjectName(objectName)
+	if err := c.putObject(ctx, namespace, manifestObject, "application/json", data); err != nil {
+		return fmt.Errorf("failed to upload manifest of %s: %w", imageName, err)
+	}
+	if err := c.putObject(ctx, namespace, manifestObject+signatureSuffix, "application/json", sigData); err != nil {
+		return fmt.Errorf("failed to upload manifest signature of %s: %w", imageName, err)
+	}
+
+	c.Logger.Logf("  Manifest signed: %s (%s key %s)", manifestObject, sig.Algorithm, sig.KeyID)
+	return nil
+}
+
+// verifyObject checks the signed manifest of a qcow2 object and that the
+// object's SHA-256 and size match it. It returns the verified manifest and
+// the ETag of the object, or nil and "" if signing is off. Objects moved
+// under bucket.lifecycle_prefix are checked against the manifest uploaded
+// with them.
+func (c *Client) verifyObject(ctx context.Context, namespace, objectName string) (*signing.Manifest, string, error) {
+	if c.Signer == nil {
+		return nil, "", nil
+	}
+
+	manifestObject := ManifestObjectName(objectName)
+	if prefix := c.Config.Bucket.LifecyclePrefix; prefix != "" {
+		manifestObject = ManifestObjectName(strings.TrimPrefix(objectName, prefix))
+	}
+
+	data, err := c.readSmallObject(ctx, namespace, manifestObject)
+	if isNotFound(err) {
+		return nil, "", fmt.Errorf("refusing to import unsigned object %s: %s not found", objectName, manifestObject)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read %s: %w", manifestObject, err)
+	}
+	sigData, err := c.readSmallObject(ctx, namespace, manifestObject+signatureSuffix)
+	if isNotFound(err) {
+		return nil, "", fmt.Errorf("refusing to import unsigned object %s: %s not found", objectName, manifestObject+signatureSuffix)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read %s: %w", manifestObject+signatureSuffix, err)
+	}
+
+	var sig signing.Signature
+	if err := json.Unmarshal(sigData, &sig); err != nil {
+		return nil, "", fmt.Errorf("failed to parse signature of %s: %w", manifestObject, err)
+	}
+	if err := c.Signer.Verify(ctx, data, &sig); err != nil {
+		return nil, "", fmt.Errorf("refusing to import %s: manifest signature: %w", objectName, err)
+	}
+
+	var manifest signing.Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, "", fmt.Errorf("failed to parse %s: %w", manifestObject, err)
+	}
+	if path.Base(manifest.ObjectName) != path.Base(objectName) {
+		return nil, "", fmt.Errorf("refusing to import %s: manifest is for %s", objectName, manifest.ObjectName)
+	}
+
+	c.Logger.Logf("  Verifying SHA-256 of %s...", objectName)
+	resp, err := c.ObjectStorage.GetObject(ctx, objectstorage.GetObjectRequest{
+		NamespaceName: common.String(namespace),
+		BucketName:    common.String(c.Config.OCI.BucketName),
+		ObjectName:    common.String(objectName),
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to download %s: %w", objectName, err)
+	}
+	defer resp.Content.Close()
+
+	sum, size, err := signing.Digest(resp.Content)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to hash %s: %w", objectName, err)
+	}
+	if sum != manifest.SHA256 || size != manifest.Size {
+		return nil, "", fmt.Errorf("refusing to import %s: object has SHA-256 %s and %d bytes, manifest has %s and %d bytes",
+			objectName, sum, size, manifest.SHA256, manifest.Size)
+	}
+
+	c.Logger.Logf("  Verified: signed by %s key %s", sig.Algorithm, sig.KeyID)
+	if manifest.GitCommit != "" {
+		c.Logger.Logf("  Built from commit %s", manifest.GitCommit)
+	}
+	if resp.ETag == nil {
+		return &manifest, "", nil
+	}
+	return &manifest, *resp.ETag, nil
+}
+
+// checkCheckout refuses an object built from a dirty tree or an untagged
+// commit, unless AllowDirty is set. Signed objects are checked against their
+// manifest. Unsigned objects are checked by the commit in their name, looked
+// up in this clone; whether their tree was dirty is not recorded, so only
+// the upload's check of it applies.
+func (c *Client) checkCheckout(ctx context.Context, objectName string, manifest *signing.Manifest) error {
+	if c.AllowDirty {
+		return nil
+	}
+
+	checkout := &git.Info{}
+	if manifest != nil {
+		checkout.Commit = manifest.GitCommit
+		checkout.ShortCommit = git.Short(manifest.GitCommit)
+		checkout.Tags = manifest.GitTags
+		checkout.Dirty = manifest.GitDirty
+	} else if m := objectCommitPattern.FindStringSubmatch(objectName); m != nil {
+		info, err := git.Describe(ctx, m[1])
+		if err != nil {
+			return fmt.Errorf("refusing to import %s: commit %s is not in this clone: %w; use --allow-dirty to import it anyway", objectName, m[1], err)
+		}
+		checkout = info
+	}
+	if err := checkout.CheckPublishable(); err != nil {
+		return fmt.Errorf("refusing to import %s: %w; use --allow-dirty to import it anyway", objectName, err)
+	}
+	return nil
+}
+
+// checkUnchanged verifies that an object still has the ETag it had when it
+// was verified, so it cannot be replaced between verification and import.
+func (c *Client) checkUnchanged(ctx context.Context, namespace, objectName, etag string) error {
+	if etag == "" {
+		return nil
+	}
+
+	resp, err := c.ObjectStorage.HeadObject(ctx, objectstorage.HeadObjectRequest{
+		NamespaceName: common.String(namespace),
+		BucketName:    common.String(c.Config.OCI.BucketName),
+		ObjectName:    common.String(objectName),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to check %s: %w", objectName, err)
+	}
+	if resp.ETag == nil || *resp.ETag != etag {
+		return fmt.Errorf("refusing to import %s: object changed after verification", objectName)
+	}
+	return nil
+}
+
+// putObject uploads a small object in one request.
+func (c *Client) putObject(ctx context.Context, namespace, objectName, contentType string, data []byte) error {
+	_, err := c.ObjectStorage.PutObject(ctx, objectstorage.PutObjectRequest{
+		NamespaceName: common.String(namespace),
+		BucketName:    common.String(c.Config.OCI.BucketName),
+		ObjectName:    common.String(objectName),
+		ContentLength: common.Int64(int64(len(data))),
+		ContentType:   common.String(contentType),
+		PutObjectBody: io.NopCloser(bytes.NewReader(data)),
+	})
+	return err
+}
+
+// readSmallObject returns the contents of an object of at most
+// maxManifestBytes. Errors from Object Storage are returned unwrapped so
+// callers can check for 404s.
+func (c *Client) readSmallObject(ctx context.Context, namespace, objectName string) ([]byte, error) {
+	resp, err := c.ObjectStorage.GetObject(ctx, objectstorage.GetObjectRequest{
+		NamespaceName: common.String(namespace),
+		BucketName:    common.String(c.Config.OCI.BucketName),
+		ObjectName:    common.String(objectName),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Content.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Content, maxManifestBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxManifestBytes {
+		return nil, fmt.Errorf("%s is larger than %d bytes", objectName, maxManifestBytes)
+	}
+	return data, nil
+}
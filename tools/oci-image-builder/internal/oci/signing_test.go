@@ -0,0 +1,348 @@
+package oci
+
+import (
+	"cmp"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/oracle/oci-go-sdk/v65/common"
+	"github.com/oracle/oci-go-sdk/v65/objectstorage"
+
+	"oci-image-builder/internal/config"
+	"oci-image-builder/internal/logger"
+	"oci-image-builder/internal/signing"
+)
+
+const (
+	testNamespace = "ns"
+	testBucket    = "images"
+)
+
+// fakeObjectStorage serves GET and HEAD of objects in one bucket, like
+// Object Storage.
+type fakeObjectStorage struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeObjectStorage) put(name string, data []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[name] = data
+}
+
+func (f *fakeObjectStorage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	prefix := fmt.Sprintf("/n/%s/b/%s/o/", testNamespace, testBucket)
+	escaped, ok := strings.CutPrefix(r.URL.EscapedPath(), prefix)
+	name, err := url.PathUnescape(escaped)
+	if !ok || err != nil || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		http.Error(w, "unexpected request "+r.Method+" "+r.URL.Path, http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	data, found := f.objects[name]
+	f.mu.Unlock()
+	if !found {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"code":"ObjectNotFound","message":"The object '%s' does not exist"}`, name)
+		return
+	}
+
+	sum := sha256.Sum256(data)
+	w.Header().Set("ETag", hex.EncodeToString(sum[:8]))
+	w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+	if r.Method == http.MethodGet {
+		w.Write(data)
+	}
+}
+
+// newTestClient returns a client whose Object Storage is a fake served by
+// httptest, signing with a new ed25519 key.
+func newTestClient(t *testing.T) (*Client, *fakeObjectStorage) {
+	t.Helper()
+
+	fake := &fakeObjectStorage{objects: make(map[string][]byte)}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	// Requests are signed with an API key the fake ignores
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	provider := common.NewRawConfigurationProvider("ocid1.tenancy.oc1..test", "ocid1.user.oc1..test",
+		"us-ashburn-1", "00:00", string(keyPEM), nil)
+	storage, err := objectstorage.NewObjectStorageClientWithConfigurationProvider(provider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.Host = server.URL
+
+	cfg := config.DefaultConfig()
+	cfg.OCI.BucketName = testBucket
+
+	return &Client{
+		ObjectStorage: storage,
+		Config:        cfg,
+		Namespace:     testNamespace,
+		Logger:        logger.New(),
+		Signer:        newTestSigner(t),
+		canSign:       true,
+	}, fake
+}
+
+// newTestSigner returns an ed25519 signer with a new key.
+func newTestSigner(t *testing.T) signing.Signer {
+	t.Helper()
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "signing.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := signing.LoadEd25519(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// putSigned stores an object with a manifest of manifestObject signed by
+// signer, as signObject would.
+func putSigned(t *testing.T, fake *fakeObjectStorage, signer signing.Signer, objectName, manifestObject string, data []byte) {
+	t.Helper()
+	sum, size, err := signing.Digest(strings.NewReader(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := signing.Encode(&signing.Manifest{
+		Image:      "derp",
+		ObjectName: manifestObject,
+		SHA256:     sum,
+		Size:       size,
+		GitCommit:  "1a2b3c4d5e6f",
+		GitTags:    []string{"v1.0.0"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := signer.Sign(context.Background(), manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigData, err := json.Marshal(sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake.put(objectName, data)
+	fake.put(ManifestObjectName(manifestObject), manifest)
+	fake.put(ManifestObjectName(manifestObject)+signatureSuffix, sigData)
+}
+
+func TestVerifyObject(t *testing.T) {
+	const objectName = "derp-20240115-123456-1a2b3c4.qcow2"
+	image := []byte("qcow2 image contents")
+
+	tests := []struct {
+		name    string
+		object  string // Object verified, objectName if empty
+		setup   func(t *testing.T, c *Client, fake *fakeObjectStorage)
+		wantErr string
+	}{
+		{
+			name: "signed object",
+			setup: func(t *testing.T, c *Client, fake *fakeObjectStorage) {
+				putSigned(t, fake, c.Signer, objectName, objectName, image)
+			},
+		},
+		{
+			name:   "object moved for lifecycle cleanup",
+			object: "imported/" + objectName,
+			setup: func(t *testing.T, c *Client, fake *fakeObjectStorage) {
+				putSigned(t, fake, c.Signer, "imported/"+objectName, objectName, image)
+			},
+		},
+		{
+			name: "signing off",
+			setup: func(t *testing.T, c *Client, fake *fakeObjectStorage) {
+				c.Signer = nil
+				fake.put(objectName, image)
+			},
+		},
+		{
+			name: "no manifest",
+			setup: func(t *testing.T, c *Client, fake *fakeObjectStorage) {
+				fake.put(objectName, image)
+			},
+			wantErr: "refusing to import unsigned object " + objectName + ": derp-20240115-123456-1a2b3c4.manifest.json not found",
+		},
+		{
+			name: "no signature",
+			setup: func(t *testing.T, c *Client, fake *fakeObjectStorage) {
+				putSigned(t, fake, c.Signer, objectName, objectName, image)
+				delete(fake.objects, ManifestObjectName(objectName)+signatureSuffix)
+			},
+			wantErr: "refusing to import unsigned object " + objectName + ": derp-20240115-123456-1a2b3c4.manifest.json.sig not found",
+		},
+		{
+			name: "manifest edited after signing",
+			setup: func(t *testing.T, c *Client, fake *fakeObjectStorage) {
+				putSigned(t, fake, c.Signer, objectName, objectName, image)
+				manifest := string(fake.objects[ManifestObjectName(objectName)])
+				fake.put(ManifestObjectName(objectName), []byte(strings.Replace(manifest, "v1.0.0", "v2.0.0", 1)))
+			},
+			wantErr: "manifest signature: signature does not match",
+		},
+		{
+			name: "signed by another key",
+			setup: func(t *testing.T, c *Client, fake *fakeObjectStorage) {
+				putSigned(t, fake, newTestSigner(t), objectName, objectName, image)
+			},
+			wantErr: "manifest signature: signed by ed25519 key",
+		},
+		{
+			name:   "manifest of another object",
+			object: "derp-20240116-000000.qcow2",
+			setup: func(t *testing.T, c *Client, fake *fakeObjectStorage) {
+				putSigned(t, fake, c.Signer, objectName, objectName, image)
+				// A valid manifest and signature copied next to another object
+				fake.put("derp-20240116-000000.qcow2", image)
+				fake.put("derp-20240116-000000.manifest.json", fake.objects[ManifestObjectName(objectName)])
+				fake.put("derp-20240116-000000.manifest.json.sig", fake.objects[ManifestObjectName(objectName)+signatureSuffix])
+			},
+			wantErr: "manifest is for " + objectName,
+		},
+		{
+			name: "object replaced after signing",
+			setup: func(t *testing.T, c *Client, fake *fakeObjectStorage) {
+				putSigned(t, fake, c.Signer, objectName, objectName, image)
+				fake.put(objectName, []byte("other contents"))
+			},
+			wantErr: "object has SHA-256",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, fake := newTestClient(t)
+			tt.setup(t, c, fake)
+			object := tt.object
+			if object == "" {
+				object = objectName
+			}
+
+			manifest, etag, err := c.verifyObject(context.Background(), testNamespace, object)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("verifyObject() error = %v, want %q", err, tt.wantErr)
+				}
+				if manifest != nil || etag != "" {
+					t.Errorf("verifyObject() = %v, %q with an error", manifest, etag)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("verifyObject() error = %v", err)
+			}
+			if c.Signer == nil {
+				if manifest != nil || etag != "" {
+					t.Errorf("verifyObject() = %v, %q with signing off", manifest, etag)
+				}
+				return
+			}
+			if manifest == nil || manifest.GitCommit != "1a2b3c4d5e6f" {
+				t.Errorf("verifyObject() manifest = %+v", manifest)
+			}
+			if etag == "" {
+				t.Error("verifyObject() returned no ETag")
+			}
+			if err := c.checkUnchanged(context.Background(), testNamespace, object, etag); err != nil {
+				t.Errorf("checkUnchanged() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestCheckUnchanged(t *testing.T) {
+	c, fake := newTestClient(t)
+	fake.put("derp.qcow2", []byte("old"))
+	sum := sha256.Sum256([]byte("old"))
+	etag := hex.EncodeToString(sum[:8])
+
+	ctx := context.Background()
+	if err := c.checkUnchanged(ctx, testNamespace, "derp.qcow2", etag); err != nil {
+		t.Fatalf("checkUnchanged() error = %v", err)
+	}
+	fake.put("derp.qcow2", []byte("new"))
+	if err := c.checkUnchanged(ctx, testNamespace, "derp.qcow2", etag); err == nil || !strings.Contains(err.Error(), "changed after verification") {
+		t.Errorf("checkUnchanged() of a replaced object error = %v", err)
+	}
+}
+
+func TestCheckCheckout(t *testing.T) {
+	tests := []struct {
+		name       string
+		objectName string
+		manifest   *signing.Manifest
+		allowDirty bool
+		wantErr    string
+	}{
+		{name: "tagged", manifest: &signing.Manifest{GitCommit: "1a2b3c4d5e6f", GitTags: []string{"v1"}}},
+		{name: "untagged", manifest: &signing.Manifest{GitCommit: "1a2b3c4d5e6f"}, wantErr: "commit 1a2b3c4 is not tagged"},
+		{
+			name:     "dirty",
+			manifest: &signing.Manifest{GitCommit: "1a2b3c4d5e6f", GitTags: []string{"v1"}, GitDirty: true},
+			wantErr:  "working tree at 1a2b3c4 had uncommitted changes",
+		},
+		{name: "no commit", manifest: &signing.Manifest{}, wantErr: "not built from a git checkout"},
+		{name: "dirty allowed", manifest: &signing.Manifest{GitCommit: "1a2b3c4d5e6f", GitDirty: true}, allowDirty: true},
+		{name: "unsigned without commit", wantErr: "not built from a git checkout"},
+		{
+			name:       "unsigned with unknown commit",
+			objectName: "derp-20240115-123456-0000000.qcow2",
+			wantErr:    "commit 0000000 is not in this clone",
+		},
+		{name: "unsigned allowed", allowDirty: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Client{AllowDirty: tt.allowDirty}
+			objectName := cmp.Or(tt.objectName, "derp.qcow2")
+			err := c.checkCheckout(context.Background(), objectName, tt.manifest)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("checkCheckout() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("checkCheckout() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
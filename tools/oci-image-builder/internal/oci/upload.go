@@ -1,57 +1,126 @@
 package oci
 
 import (
+	"bytes"
 	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/oracle/oci-go-sdk/v65/common"
+	"github.com/oracle/oci-go-sdk/v65/objectstorage"
 	"github.com/oracle/oci-go-sdk/v65/objectstorage/transfer"
+	"go.opentelemetry.io/otel/attribute"
+
+	"oci-image-builder/internal/config"
+	"oci-image-builder/internal/progress"
+	"oci-image-builder/internal/tracing"
 )
 
-// Upload uploads images to Object Storage.
+// abortTimeout bounds the request that aborts an interrupted multipart upload.
+const abortTimeout = 30 * time.Second
+
+// ErrUploadNotFound is returned by ResumeUpload when the multipart upload no
+// longer exists in Object Storage (committed, aborted, or expired).
+var ErrUploadNotFound = errors.New("multipart upload not found")
+
+// UploadInterruptedError reports a multipart upload that was preserved when
+// the run was interrupted, so it can be finished later with ResumeUpload.
+type UploadInterruptedError struct {
+	ImageName  string
+	ObjectName string
+	UploadID   string
+	Err        error
+}
+
+// Error implements the error interface.
+func (e *UploadInterruptedError) Error() string {
+	return fmt.Sprintf("upload of %s interrupted, multipart upload %s preserved: %v", e.ImageName, e.UploadID, e.Err)
+}
+
+// Unwrap returns the underlying cancellation error.
+func (e *UploadInterruptedError) Unwrap() error {
+	return e.Err
+}
+
+// Upload uploads images to Object Storage, each with its SBOM and
+// provenance statement if it has them (see SBOMObjectName and
+// ProvenanceObjectName) and its signed manifest if signing is configured
+// (see ManifestObjectName). It returns the object names in the order of
+// imageNames; on error, the names of the uploads that completed are
+// returned alongside it. If ctx is canceled during a multipart upload, the
+// upload is aborted or preserved according to oci.upload_interrupt_policy;
+// a preserved upload is reported as an *UploadInterruptedError.
 func (c *Client) Upload(ctx context.Context, imageNames []string) ([]string, error) {
 	namespace, err := c.GetNamespace(ctx)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := c.checkBucket(ctx, namespace); err != nil {
+		return nil, err
+	}
+
 	timestamp := time.Now().Format("20060102-150405")
 	var objectNames []string
 
 	for _, name := range imageNames {
-		qcowPath := filepath.Join(fmt.Sprintf("result-%s", name), "nixos.qcow2")
+		qcowPath := c.localPath(name)
 
 		fileInfo, err := os.Stat(qcowPath)
 		if err != nil {
-			return nil, fmt.Errorf("image not found: %s (run build first)", qcowPath)
+			return objectNames, fmt.Errorf("image not found: %s (run build first)", qcowPath)
 		}
 
 		totalBytes := fileInfo.Size()
-		objectName := fmt.Sprintf("%s-%s.qcow2", name, timestamp)
+		objectName := fmt.Sprintf("%s-%s%s.qcow2", name, timestamp, c.commitSuffix(name))
 
+		header := progress.Header{Image: name}
+		c.Events.Emit(&progress.StageStarted{Header: header, Stage: progress.StageUpload})
 		c.Logger.Logf("Uploading %s (%d MB) to bucket '%s'...",
 			name, totalBytes/(1024*1024), c.Config.OCI.BucketName)
 		c.Logger.Logf("  Object name: %s", objectName)
 
+		totalParts := int((totalBytes + UploadPartSize - 1) / UploadPartSize)
+		c.Events.Emit(&progress.UploadStarted{Header: header, ObjectName: objectName, TotalBytes: totalBytes, TotalParts: totalParts})
+		uploadCtx, span := tracing.Start(ctx, "upload", tracing.Image(name),
+			attribute.String("oci.object_name", objectName),
+			attribute.Int64("upload.total_bytes", totalBytes),
+			attribute.Int("upload.total_parts", totalParts))
+
 		uploadManager := transfer.NewUploadManager()
 
-		// Progress callback for multipart upload parts
+		// Progress callback for multipart upload parts. Parts may complete
+		// in any order, so progress is the sum of the completed part sizes.
+		var (
+			sentMu    sync.Mutex
+			bytesSent int64
+		)
 		callback := func(part transfer.MultiPartUploadPart) {
 			if part.Err != nil {
 				c.Logger.Logf("  Part %d error: %v", part.PartNum, part.Err)
 				return
 			}
 
-			bytesSent := int64(part.PartNum) * (totalBytes / int64(part.TotalParts))
-			if part.PartNum == part.TotalParts {
-				bytesSent = totalBytes
-			}
-			percent := float64(bytesSent) / float64(totalBytes) * 100
+			sentMu.Lock()
+			bytesSent += part.Size
+			sent := bytesSent
+			sentMu.Unlock()
 
-			c.Logger.Logf("  Part %d/%d complete (%.1f%%)", part.PartNum, part.TotalParts, percent)
+			c.Events.Emit(&progress.PartUploaded{
+				Header:     header,
+				PartNum:    part.PartNum,
+				TotalParts: part.TotalParts,
+				PartBytes:  part.Size,
+				BytesSent:  sent,
+				TotalBytes: totalBytes,
+			})
 		}
 
 		req := transfer.UploadFileRequest{
@@ -70,9 +139,16 @@ func (c *Client) Upload(ctx context.Context, imageNames []string) ([]string, err
 			FilePath: qcowPath,
 		}
 
-		resp, err := uploadManager.UploadFile(ctx, req)
+		resp, err := uploadManager.UploadFile(uploadCtx, req)
 		if err != nil {
-			return nil, fmt.Errorf("upload failed for %s: %w", name, err)
+			if ctx.Err() != nil && resp.MultipartUploadResponse != nil && resp.UploadID != nil {
+				err = c.interruptUpload(uploadCtx, name, objectName, *resp.UploadID)
+			} else {
+				err = fmt.Errorf("upload failed for %s: %w", name, err)
+			}
+			tracing.End(span, err)
+			c.Events.Emit(&progress.StageFailed{Header: header, Stage: progress.StageUpload, Err: err})
+			return objectNames, err
 		}
 
 		if resp.Type == transfer.MultipartUpload {
@@ -80,9 +156,245 @@ func (c *Client) Upload(ctx context.Context, imageNames []string) ([]string, err
 		} else {
 			c.Logger.Logf("  Upload complete: %s", objectName)
 		}
+		_, err = c.uploadSBOM(uploadCtx, namespace, name, objectName)
+		if err == nil {
+			_, err = c.uploadProvenance(uploadCtx, namespace, name, objectName)
+		}
+		if err == nil {
+			err = c.signObject(uploadCtx, namespace, name, objectName)
+		}
+		if err != nil {
+			tracing.End(span, err)
+			c.Events.Emit(&progress.StageFailed{Header: header, Stage: progress.StageUpload, Err: err})
+			return objectNames, err
+		}
+		tracing.End(span, nil)
+		c.Events.Emit(&progress.StageCompleted{Header: header, Stage: progress.StageUpload, Bytes: totalBytes})
 
 		objectNames = append(objectNames, objectName)
 	}
 
 	return objectNames, nil
 }
+
+// localPath returns the qcow2 to upload for an image.
+func (c *Client) localPath(imageName string) string {
+	if path, ok := c.LocalPaths[imageName]; ok {
+		return path
+	}
+	return filepath.Join(fmt.Sprintf("result-%s", imageName), "nixos.qcow2")
+}
+
+// interruptUpload applies the configured interrupt policy to a multipart
+// upload whose context was canceled.
+func (c *Client) interruptUpload(ctx context.Context, imageName, objectName, uploadID string) error {
+	if c.Config.OCI.UploadInterruptPolicy == config.UploadInterruptPreserve {
+		c.Logger.Logf("  Upload interrupted, preserving multipart upload %s", uploadID)
+		return &UploadInterruptedError{
+			ImageName:  imageName,
+			ObjectName: objectName,
+			UploadID:   uploadID,
+			Err:        ctx.Err(),
+		}
+	}
+
+	c.Logger.Logf("  Upload interrupted, aborting multipart upload %s", uploadID)
+
+	abortCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), abortTimeout)
+	defer cancel()
+
+	req := objectstorage.AbortMultipartUploadRequest{
+		NamespaceName: common.String(c.Namespace),
+		BucketName:    common.String(c.Config.OCI.BucketName),
+		ObjectName:    common.String(objectName),
+		UploadId:      common.String(uploadID),
+	}
+	if _, err := c.ObjectStorage.AbortMultipartUpload(abortCtx, req); err != nil {
+		c.Logger.Logf("  Warning: failed to abort multipart upload: %v", err)
+	}
+
+	return fmt.Errorf("upload of %s interrupted: %w", imageName, ctx.Err())
+}
+
+// ResumeUpload finishes a multipart upload preserved by an earlier
+// interrupted run. Parts already in Object Storage whose MD5 matches the
+// local file are reused; the rest are uploaded before committing. The
+// image's SBOM and provenance statement, if any, and signed manifest are
+// uploaded afterwards.
+func (c *Client) ResumeUpload(ctx context.Context, imageName, objectName, uploadID string) error {
+	header := progress.Header{Image: imageName}
+	c.Events.Emit(&progress.StageStarted{Header: header, Stage: progress.StageUpload})
+	ctx, span := tracing.Start(ctx, "upload", tracing.Image(imageName),
+		attribute.String("oci.object_name", objectName),
+		attribute.String("oci.upload_id", uploadID))
+
+	totalBytes, err := c.resumeUpload(ctx, imageName, objectName, uploadID)
+	if err == nil {
+		_, err = c.uploadSBOM(ctx, c.Namespace, imageName, objectName)
+	}
+	if err == nil {
+		_, err = c.uploadProvenance(ctx, c.Namespace, imageName, objectName)
+	}
+	if err == nil {
+		err = c.signObject(ctx, c.Namespace, imageName, objectName)
+	}
+	tracing.End(span, err)
+	if err != nil {
+		c.Events.Emit(&progress.StageFailed{Header: header, Stage: progress.StageUpload, Err: err})
+		return err
+	}
+
+	c.Events.Emit(&progress.StageCompleted{Header: header, Stage: progress.StageUpload, Bytes: totalBytes})
+	return nil
+}
+
+// resumeUpload does the work of ResumeUpload and returns the object size.
+func (c *Client) resumeUpload(ctx context.Context, imageName, objectName, uploadID string) (int64, error) {
+	namespace, err := c.GetNamespace(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	qcowPath := c.localPath(imageName)
+	file, err := os.Open(qcowPath)
+	if err != nil {
+		return 0, fmt.Errorf("image not found: %s (run build first)", qcowPath)
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat %s: %w", qcowPath, err)
+	}
+	totalBytes := fileInfo.Size()
+	totalParts := int((totalBytes + UploadPartSize - 1) / UploadPartSize)
+
+	c.Logger.Logf("Resuming upload of %s to %s (multipart upload %s)...", imageName, objectName, uploadID)
+
+	existing, err := c.listUploadedParts(ctx, namespace, objectName, uploadID)
+	if err != nil {
+		return 0, err
+	}
+	c.Logger.Logf("  %d of %d parts already uploaded", len(existing), totalParts)
+
+	header := progress.Header{Image: imageName}
+	c.Events.Emit(&progress.UploadStarted{Header: header, ObjectName: objectName, TotalBytes: totalBytes, TotalParts: totalParts})
+
+	buf := make([]byte, UploadPartSize)
+	var parts []objectstorage.CommitMultipartUploadPartDetails
+	var bytesSent int64
+
+	for partNum := 1; partNum <= totalParts; partNum++ {
+		n, err := io.ReadFull(file, buf)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return 0, fmt.Errorf("failed to read %s: %w", qcowPath, err)
+		}
+		body := buf[:n]
+
+		sum := md5.Sum(body)
+		partMD5 := base64.StdEncoding.EncodeToString(sum[:])
+
+		partCtx, span := tracing.Start(ctx, fmt.Sprintf("upload part %d", partNum),
+			attribute.Int("upload.part_num", partNum),
+			attribute.Int("upload.part_bytes", n))
+
+		etag := ""
+		reused := false
+		if prev, ok := existing[partNum]; ok && prev.Md5 != nil && *prev.Md5 == partMD5 {
+			etag = *prev.Etag
+			reused = true
+		} else {
+			req := objectstorage.UploadPartRequest{
+				NamespaceName:  common.String(namespace),
+				BucketName:     common.String(c.Config.OCI.BucketName),
+				ObjectName:     common.String(objectName),
+				UploadId:       common.String(uploadID),
+				UploadPartNum:  common.Int(partNum),
+				ContentLength:  common.Int64(int64(n)),
+				ContentMD5:     common.String(partMD5),
+				UploadPartBody: io.NopCloser(bytes.NewReader(body)),
+			}
+			resp, err := c.ObjectStorage.UploadPart(partCtx, req)
+			if err != nil {
+				tracing.End(span, err)
+				if ctx.Err() != nil {
+					return 0, c.interruptUpload(ctx, imageName, objectName, uploadID)
+				}
+				return 0, fmt.Errorf("failed to upload part %d of %s: %w", partNum, imageName, err)
+			}
+			etag = *resp.ETag
+		}
+		span.SetAttributes(attribute.Bool("upload.part_reused", reused))
+		tracing.End(span, nil)
+
+		bytesSent += int64(n)
+		parts = append(parts, objectstorage.CommitMultipartUploadPartDetails{
+			PartNum: common.Int(partNum),
+			Etag:    common.String(etag),
+		})
+		c.Events.Emit(&progress.PartUploaded{
+			Header:     header,
+			PartNum:    partNum,
+			TotalParts: totalParts,
+			PartBytes:  int64(n),
+			BytesSent:  bytesSent,
+			TotalBytes: totalBytes,
+			Reused:     reused,
+		})
+	}
+
+	commitReq := objectstorage.CommitMultipartUploadRequest{
+		NamespaceName: common.String(namespace),
+		BucketName:    common.String(c.Config.OCI.BucketName),
+		ObjectName:    common.String(objectName),
+		UploadId:      common.String(uploadID),
+		CommitMultipartUploadDetails: objectstorage.CommitMultipartUploadDetails{
+			PartsToCommit: parts,
+		},
+	}
+	if _, err := c.ObjectStorage.CommitMultipartUpload(ctx, commitReq); err != nil {
+		if ctx.Err() != nil {
+			return 0, c.interruptUpload(ctx, imageName, objectName, uploadID)
+		}
+		return 0, fmt.Errorf("failed to commit upload of %s: %w", imageName, err)
+	}
+
+	c.Logger.Logf("  Upload complete (resumed): %s", objectName)
+	return totalBytes, nil
+}
+
+// listUploadedParts returns the parts already uploaded for a multipart
+// upload, keyed by part number.
+func (c *Client) listUploadedParts(ctx context.Context, namespace, objectName, uploadID string) (map[int]objectstorage.MultipartUploadPartSummary, error) {
+	req := objectstorage.ListMultipartUploadPartsRequest{
+		NamespaceName: common.String(namespace),
+		BucketName:    common.String(c.Config.OCI.BucketName),
+		ObjectName:    common.String(objectName),
+		UploadId:      common.String(uploadID),
+	}
+
+	parts := make(map[int]objectstorage.MultipartUploadPartSummary)
+
+	for {
+		resp, err := c.ObjectStorage.ListMultipartUploadParts(ctx, req)
+		if err != nil {
+			if serviceErr, ok := err.(common.ServiceError); ok && serviceErr.GetHTTPStatusCode() == 404 {
+				return nil, fmt.Errorf("%w: %s", ErrUploadNotFound, uploadID)
+			}
+			return nil, fmt.Errorf("failed to list uploaded parts: %w", err)
+		}
+
+		for _, part := range resp.Items {
+			if part.PartNumber != nil {
+				parts[*part.PartNumber] = part
+			}
+		}
+
+		if resp.OpcNextPage == nil {
+			break
+		}
+		req.Page = resp.OpcNextPage
+	}
+
+	return parts, nil
+}
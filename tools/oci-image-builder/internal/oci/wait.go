@@ -0,0 +1,312 @@
+package oci
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"oci-image-builder/internal/config"
+	"oci-image-builder/internal/progress"
+	"oci-image-builder/internal/tracing"
+)
+
+// WaitStrategy controls how WaitForImages polls pending imports.
+type WaitStrategy struct {
+	InitialDelay time.Duration // Delay before the first poll
+	Interval     time.Duration // First poll interval
+	MaxInterval  time.Duration // Upper bound for the backed-off interval
+	Factor       float64       // Interval multiplier applied after each poll
+	Jitter       float64       // Random fraction applied to each interval
+	Deadline     time.Duration // Overall deadline for all images
+}
+
+// NewWaitStrategy builds a WaitStrategy from the OCI configuration.
+func NewWaitStrategy(cfg *config.OCIConfig) WaitStrategy {
+	s := WaitStrategy{
+		InitialDelay: time.Duration(cfg.InitialDelaySecs) * time.Second,
+		Interval:     time.Duration(cfg.PollIntervalSecs) * time.Second,
+		MaxInterval:  time.Duration(cfg.MaxPollIntervalSecs) * time.Second,
+		Factor:       cfg.BackoffFactor,
+		Jitter:       cfg.PollJitter,
+		Deadline:     time.Duration(cfg.MaxWaitSecs) * time.Second,
+	}
+
+	if s.Interval <= 0 {
+		s.Interval = time.Second
+	}
+	if s.MaxInterval < s.Interval {
+		s.MaxInterval = s.Interval
+	}
+	if s.Factor < 1 {
+		s.Factor = 1
+	}
+	if s.Jitter < 0 {
+		s.Jitter = 0
+	} else if s.Jitter > 1 {
+		s.Jitter = 1
+	}
+
+	return s
+}
+
+// next returns the interval to use after an interval of d.
+func (s WaitStrategy) next(d time.Duration) time.Duration {
+	n := time.Duration(float64(d) * s.Factor)
+	if n > s.MaxInterval {
+		return s.MaxInterval
+	}
+	return n
+}
+
+// jittered randomizes d by up to ±Jitter so concurrent pollers spread out.
+func (s WaitStrategy) jittered(d time.Duration) time.Duration {
+	if s.Jitter == 0 {
+		return d
+	}
+	delta := (rand.Float64()*2 - 1) * s.Jitter * float64(d)
+	return d + time.Duration(delta)
+}
+
+// ImportUpdate describes a change in an import's progress.
+type ImportUpdate struct {
+	ImageName string
+	Image     ImportedImage
+	State     string       // PENDING, IMPORTING, AVAILABLE, or the state the import failed in
+	Err       *ImportError // Set when the import failed
+}
+
+// SetImportUpdateFunc sets a function called whenever an import is initiated,
+// becomes available, or fails. In import mode "par" it is also called with
+// state PENDING when the read request is created, before the image exists,
+// and again once a failed import has released it. Calls are serialized.
+func (c *Client) SetImportUpdateFunc(fn func(ImportUpdate)) {
+	c.updateMu.Lock()
+	defer c.updateMu.Unlock()
+	c.importUpdateFn = fn
+}
+
+// notifyImport delivers an import update to the configured function.
+func (c *Client) notifyImport(update ImportUpdate) {
+	c.updateMu.Lock()
+	defer c.updateMu.Unlock()
+	if c.importUpdateFn != nil {
+		c.importUpdateFn(update)
+	}
+}
+
+// WaitForImages watches all images concurrently until each becomes available
+// or fails. The configured max wait is a single deadline shared by all images.
+// If ctx is canceled the imports keep running in OCI and can be resumed; the
+// context error is returned. Failed imports are returned as *ImportError
+// values joined with errors.Join.
+func (c *Client) WaitForImages(ctx context.Context, images map[string]ImportedImage) error {
+	if len(images) == 0 {
+		return nil
+	}
+
+	strategy := NewWaitStrategy(&c.Config.OCI)
+
+	c.Logger.Logf("Waiting for %d image(s) to be available...", len(images))
+	c.Logger.Logf("  Initial delay: %ds, poll interval: %ds-%ds (x%.1f, ±%.0f%% jitter), deadline: %ds",
+		int(strategy.InitialDelay.Seconds()), int(strategy.Interval.Seconds()), int(strategy.MaxInterval.Seconds()),
+		strategy.Factor, strategy.Jitter*100, int(strategy.Deadline.Seconds()))
+
+	waitCtx, cancel := context.WithTimeout(ctx, strategy.Deadline)
+	defer cancel()
+
+	startTime := time.Now()
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+
+	for imageName, image := range images {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.waitForImage(waitCtx, imageName, image, strategy, startTime); err != nil {
+				c.Events.Emit(&progress.StageFailed{Header: progress.Header{Image: imageName}, Stage: progress.StageImport, Err: err})
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		c.Logger.Log("Wait interrupted; imports continue in OCI and can be resumed")
+		return err
+	}
+
+	return errors.Join(errs...)
+}
+
+// waitForImage waits for a single image to become available. When the
+// import's work request is known it is polled alongside the image lifecycle
+// state, since a failed import is reported on the work request first.
+func (c *Client) waitForImage(ctx context.Context, imageName string, image ImportedImage, strategy WaitStrategy, startTime time.Time) (err error) {
+	ctx, span := tracing.Start(ctx, "wait", tracing.Image(imageName),
+		attribute.String("oci.image_id", image.ImageID),
+		attribute.String("oci.work_request_id", image.WorkRequestID))
+	defer func() { tracing.End(span, err) }()
+
+	prefix := fmt.Sprintf("  [%s]", imageName)
+	header := progress.Header{Image: imageName}
+	interval := strategy.Interval
+
+	if err := sleepContext(ctx, strategy.InitialDelay); err != nil {
+		return c.waitError(ctx, imageName, startTime)
+	}
+
+	for {
+		elapsedSecs := int(time.Since(startTime).Seconds())
+		update := &progress.ImportStateChanged{
+			Header:        header,
+			ImageID:       image.ImageID,
+			WorkRequestID: image.WorkRequestID,
+		}
+
+		if image.WorkRequestID != "" {
+			wr, err := c.GetWorkRequest(ctx, image.WorkRequestID)
+			if err != nil {
+				if ctx.Err() != nil {
+					return c.waitError(ctx, imageName, startTime)
+				}
+				return fmt.Errorf("failed to get work request for %s: %w", imageName, err)
+			}
+
+			update.WorkRequestStatus = wr.Status
+			update.PercentComplete = wr.PercentComplete
+
+			switch wr.Status {
+			case "FAILED", "CANCELED", "CANCELING":
+				return c.failImport(ctx, imageName, image, "work request "+wr.Status)
+			case "ACCEPTED", "IN_PROGRESS":
+				c.Logger.Logf("%s Work request: %s (%.0f%%, %ds elapsed)", prefix, wr.Status, wr.PercentComplete, elapsedSecs)
+			}
+		}
+
+		status, err := c.GetImageStatus(ctx, image.ImageID)
+		if err != nil {
+			if ctx.Err() != nil {
+				return c.waitError(ctx, imageName, startTime)
+			}
+			return fmt.Errorf("failed to get status for %s: %w", imageName, err)
+		}
+		update.State = status
+		c.Events.Emit(update)
+
+		switch status {
+		case "AVAILABLE":
+			c.Logger.Logf("%s Image is AVAILABLE (%ds elapsed)", prefix, elapsedSecs)
+			if err := c.checkImportedObject(ctx, image); err != nil {
+				return c.rejectImport(ctx, imageName, image, err)
+			}
+			c.ReleasePAR(ctx, imageName, &image.PARID)
+			if retired, err := c.retireObject(ctx, image.ObjectName); err != nil {
+				c.Logger.Logf("%s Warning: %v", prefix, err)
+			} else if retired != image.ObjectName {
+				c.Logger.Logf("%s Moved %s to %s for lifecycle cleanup", prefix, image.ObjectName, retired)
+				image.ObjectName = retired
+			}
+			c.notifyImport(ImportUpdate{ImageName: imageName, Image: image, State: status})
+			c.Events.Emit(&progress.StageCompleted{Header: header, Stage: progress.StageImport})
+			return nil
+
+		case "IMPORTING":
+			c.Logger.Logf("%s Status: IMPORTING (%ds elapsed)", prefix, elapsedSecs)
+
+		case "NOT_FOUND":
+			c.Logger.Logf("%s Status: NOT_FOUND - waiting for import to register (%ds elapsed)", prefix, elapsedSecs)
+
+		default:
+			return c.failImport(ctx, imageName, image, "image "+status)
+		}
+
+		if err := sleepContext(ctx, strategy.jittered(interval)); err != nil {
+			return c.waitError(ctx, imageName, startTime)
+		}
+		interval = strategy.next(interval)
+	}
+}
+
+// failImport collects diagnostics for a failed import and reports it.
+func (c *Client) failImport(ctx context.Context, imageName string, image ImportedImage, state string) error {
+	importErr := c.importFailure(ctx, imageName, image, state)
+	c.ReleasePAR(ctx, imageName, &image.PARID)
+	c.notifyImport(ImportUpdate{ImageName: imageName, Image: image, State: state, Err: importErr})
+	return importErr
+}
+
+// checkImportedObject verifies that the source object of an available image
+// still has the ETag it had when its signature was verified. OCI reads the
+// object while the image is IMPORTING, well after CreateImage returns.
+func (c *Client) checkImportedObject(ctx context.Context, image ImportedImage) error {
+	if image.ObjectETag == "" {
+		return nil
+	}
+	namespace, err := c.GetNamespace(ctx)
+	if err != nil {
+		return err
+	}
+	return c.checkUnchanged(ctx, namespace, image.ObjectName, image.ObjectETag)
+}
+
+// rejectImport deletes an image whose source object failed verification
+// after import, and reports the failure.
+func (c *Client) rejectImport(ctx context.Context, imageName string, image ImportedImage, reason error) error {
+	prefix := fmt.Sprintf("  [%s]", imageName)
+	c.Logger.Logf("%s %v", prefix, reason)
+	if err := c.DeleteImage(ctx, image.ImageID); err != nil {
+		c.Logger.Logf("%s Warning: %v", prefix, err)
+	} else {
+		c.Logger.Logf("%s Deleted image %s", prefix, image.ImageID)
+	}
+	c.ReleasePAR(ctx, imageName, &image.PARID)
+
+	importErr := &ImportError{
+		ImageName:     imageName,
+		ImageID:       image.ImageID,
+		WorkRequestID: image.WorkRequestID,
+		State:         "REJECTED",
+		Errors:        []string{reason.Error()},
+	}
+	c.notifyImport(ImportUpdate{ImageName: imageName, Image: image, State: importErr.State, Err: importErr})
+	return importErr
+}
+
+// waitError converts a done wait context into the error for one image.
+func (c *Client) waitError(ctx context.Context, imageName string, startTime time.Time) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		elapsedSecs := int(time.Since(startTime).Seconds())
+		c.Logger.Logf("  [%s] Timeout waiting for image after %ds", imageName, elapsedSecs)
+		return fmt.Errorf("timeout waiting for image %s after %ds", imageName, elapsedSecs)
+	}
+	return ctx.Err()
+}
+
+// sleepContext sleeps for d or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,194 @@
+package oci
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/oracle/oci-go-sdk/v65/common"
+	"github.com/oracle/oci-go-sdk/v65/workrequests"
+)
+
+// maxWorkRequestLogLines limits how many trailing log entries are kept
+// when collecting diagnostics for a failed work request.
+const maxWorkRequestLogLines = 20
+
+// WorkRequestStatus is a snapshot of an OCI work request.
+type WorkRequestStatus struct {
+	ID              string
+	Status          string
+	PercentComplete float32
+}
+
+// ImportError describes a failed image import, including the errors and
+// log messages reported by the import's work request.
+type ImportError struct {
+	ImageName     string
+	ImageID       string
+	WorkRequestID string
+	State         string
+	Errors        []string
+	Logs          []string
+}
+
+// Error implements the error interface.
+func (e *ImportError) Error() string {
+	msg := fmt.Sprintf("import failed for image %s: %s", e.ImageName, e.State)
+	if len(e.Errors) > 0 {
+		msg += ": " + strings.Join(e.Errors, "; ")
+	}
+	return msg
+}
+
+// Detail returns a multi-line description of the failure suitable for
+// persisting in pipeline state.
+func (e *ImportError) Detail() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "import %s (image %s)", e.State, e.ImageID)
+	if e.WorkRequestID != "" {
+		fmt.Fprintf(&sb, "\nwork request: %s", e.WorkRequestID)
+	}
+	for _, msg := range e.Errors {
+		fmt.Fprintf(&sb, "\nerror: %s", msg)
+	}
+	for _, msg := range e.Logs {
+		fmt.Fprintf(&sb, "\nlog: %s", msg)
+	}
+	return sb.String()
+}
+
+// GetWorkRequest returns the current status of a work request.
+func (c *Client) GetWorkRequest(ctx context.Context, workRequestID string) (*WorkRequestStatus, error) {
+	req := workrequests.GetWorkRequestRequest{
+		WorkRequestId: common.String(workRequestID),
+	}
+
+	resp, err := c.WorkRequests.GetWorkRequest(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get work request %s: %w", truncateID(workRequestID), err)
+	}
+
+	status := &WorkRequestStatus{
+		ID:     workRequestID,
+		Status: string(resp.Status),
+	}
+	if resp.PercentComplete != nil {
+		status.PercentComplete = *resp.PercentComplete
+	}
+
+	return status, nil
+}
+
+// GetWorkRequestErrors returns all error messages reported by a work request.
+func (c *Client) GetWorkRequestErrors(ctx context.Context, workRequestID string) ([]string, error) {
+	req := workrequests.ListWorkRequestErrorsRequest{
+		WorkRequestId: common.String(workRequestID),
+		SortOrder:     workrequests.ListWorkRequestErrorsSortOrderAsc,
+	}
+
+	var messages []string
+
+	for {
+		resp, err := c.WorkRequests.ListWorkRequestErrors(ctx, req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list work request errors: %w", err)
+		}
+
+		for _, e := range resp.Items {
+			var code, message string
+			if e.Code != nil {
+				code = *e.Code
+			}
+			if e.Message != nil {
+				message = *e.Message
+			}
+			messages = append(messages, fmt.Sprintf("%s: %s", code, message))
+		}
+
+		if resp.OpcNextPage == nil {
+			break
+		}
+		req.Page = resp.OpcNextPage
+	}
+
+	return messages, nil
+}
+
+// GetWorkRequestLogs returns the log messages of a work request, keeping only
+// the most recent maxWorkRequestLogLines entries.
+func (c *Client) GetWorkRequestLogs(ctx context.Context, workRequestID string) ([]string, error) {
+	req := workrequests.ListWorkRequestLogsRequest{
+		WorkRequestId: common.String(workRequestID),
+		SortOrder:     workrequests.ListWorkRequestLogsSortOrderAsc,
+	}
+
+	var messages []string
+
+	for {
+		resp, err := c.WorkRequests.ListWorkRequestLogs(ctx, req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list work request logs: %w", err)
+		}
+
+		for _, entry := range resp.Items {
+			if entry.Message != nil {
+				messages = append(messages, *entry.Message)
+			}
+		}
+
+		if resp.OpcNextPage == nil {
+			break
+		}
+		req.Page = resp.OpcNextPage
+	}
+
+	if len(messages) > maxWorkRequestLogLines {
+		messages = messages[len(messages)-maxWorkRequestLogLines:]
+	}
+
+	return messages, nil
+}
+
+// importFailure builds an ImportError for a failed import, fetching and
+// logging the work request's errors and logs when a work request is known.
+func (c *Client) importFailure(ctx context.Context, imageName string, image ImportedImage, state string) *ImportError {
+	importErr := &ImportError{
+		ImageName:     imageName,
+		ImageID:       image.ImageID,
+		WorkRequestID: image.WorkRequestID,
+		State:         state,
+	}
+
+	c.Logger.Logf("  Import of %s failed: %s", imageName, state)
+
+	if image.WorkRequestID == "" {
+		c.Logger.Log("  No work request recorded for this import; no further diagnostics available")
+		return importErr
+	}
+
+	c.Logger.Logf("  Work request: %s", image.WorkRequestID)
+
+	errs, err := c.GetWorkRequestErrors(ctx, image.WorkRequestID)
+	if err != nil {
+		c.Logger.Logf("  Warning: %v", err)
+	}
+	importErr.Errors = errs
+
+	logs, err := c.GetWorkRequestLogs(ctx, image.WorkRequestID)
+	if err != nil {
+		c.Logger.Logf("  Warning: %v", err)
+	}
+	importErr.Logs = logs
+
+	for _, msg := range importErr.Errors {
+		c.Logger.Logf("  Error: %s", msg)
+	}
+	if len(importErr.Logs) > 0 {
+		c.Logger.Log("  Work request log:")
+		for _, msg := range importErr.Logs {
+			c.Logger.Logf("    %s", msg)
+		}
+	}
+
+	return importErr
+}
@@ -0,0 +1,125 @@
+// Package progress defines the typed progress events emitted by the build
+// and OCI packages and a bus that delivers them to subscribers.
+package progress
+
+import (
+	"sync"
+	"time"
+)
+
+// Stage identifies a per-image pipeline stage. The values match
+// state.PipelineStage.
+type Stage string
+
+const (
+	StageBuild  Stage = "build"
+	StageUpload Stage = "upload"
+	StageImport Stage = "import"
+)
+
+// Event is implemented by all progress events.
+type Event interface {
+	header() *Header
+}
+
+// Header holds the fields common to all events.
+type Header struct {
+	Image string    // Image name the event belongs to
+	Time  time.Time // Set by Bus.Emit
+}
+
+func (h *Header) header() *Header { return h }
+
+// StageStarted is emitted when an image enters a stage.
+type StageStarted struct {
+	Header
+	Stage Stage
+}
+
+// StageCompleted is emitted when an image finishes a stage. Bytes is the
+// build output size for StageBuild and the bytes uploaded for StageUpload.
+type StageCompleted struct {
+	Header
+	Stage Stage
+	Bytes int64
+}
+
+// StageFailed is emitted when a stage fails or is interrupted for an image.
+type StageFailed struct {
+	Header
+	Stage Stage
+	Err   error
+}
+
+// BuildLogLine is a line of output from a build subprocess.
+type BuildLogLine struct {
+	Header
+	Line string
+}
+
+// UploadStarted is emitted when an upload of TotalBytes in TotalParts parts
+// begins or is resumed.
+type UploadStarted struct {
+	Header
+	ObjectName string
+	TotalBytes int64
+	TotalParts int
+}
+
+// PartUploaded is emitted when a part is in Object Storage. BytesSent is
+// the exact number of bytes of all parts completed so far, whatever order
+// they completed in. Reused is set for parts kept from an interrupted
+// upload.
+type PartUploaded struct {
+	Header
+	PartNum    int
+	TotalParts int
+	PartBytes  int64
+	BytesSent  int64
+	TotalBytes int64
+	Reused     bool
+}
+
+// ImportStateChanged is emitted when an import is initiated and each time
+// it is polled.
+type ImportStateChanged struct {
+	Header
+	ImageID           string
+	WorkRequestID     string
+	State             string  // Image lifecycle state
+	WorkRequestStatus string  // Empty if the work request is unknown
+	PercentComplete   float32 // Work request progress
+}
+
+// Bus delivers events to subscribers synchronously, one event at a time.
+// A nil *Bus discards events.
+type Bus struct {
+	mu   sync.Mutex
+	subs []func(Event)
+}
+
+// NewBus creates a Bus with no subscribers.
+func NewBus() *Bus {
+	return &Bus{}
+}
+
+// Subscribe adds fn to the functions called for every event.
+func (b *Bus) Subscribe(fn func(Event)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs = append(b.subs, fn)
+}
+
+// Emit stamps e with the current time and delivers it to all subscribers.
+func (b *Bus) Emit(e Event) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e.header().Time = time.Now()
+	for _, fn := range b.subs {
+		fn(e)
+	}
+}
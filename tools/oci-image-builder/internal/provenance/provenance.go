@@ -0,0 +1,303 @@
+// Package provenance produces in-toto provenance statements, with SLSA v1
+// build provenance predicates, describing how an image was built.
+package provenance
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Builder kinds.
+const (
+	BuilderLocal  = "local"
+	BuilderRemote = "remote-linux"
+	BuilderMacOS  = "macos-linux-builder"
+)
+
+// Statement and predicate types.
+const (
+	StatementType = "https://in-toto.io/Statement/v1"
+	PredicateType = "https://slsa.dev/provenance/v1"
+	BuildType     = "https://oci-image-builder.invalid/buildtypes/nix-flake/v1"
+)
+
+// Extension is the file extension of provenance statements.
+const Extension = ".intoto.json"
+
+// builderIDPrefix identifies builders in runDetails.builder.id.
+const builderIDPrefix = "https://oci-image-builder.invalid/builders/"
+
+// Builder describes where and how an image was built.
+type Builder struct {
+	Kind    string // BuilderLocal, BuilderRemote or BuilderMacOS
+	Host    string // Remote builder or Mac host; empty for local builds
+	Command string // The nix build command run on the builder
+}
+
+// Build describes one build of an image.
+type Build struct {
+	Image       string
+	Arch        string
+	FlakeTarget string
+	FlakeURL    string // Where the flake came from, e.g. git+https://...?rev=...
+	GitCommit   string
+	GitDirty    bool // Tracked files had uncommitted changes, so GitCommit is not the source
+	Builder     Builder
+	Inputs      []Input // Locked flake inputs
+	QcowSHA256  string
+	RunID       string
+	StartedOn   time.Time
+	FinishedOn  time.Time
+}
+
+// Input is a locked flake input from flake.lock.
+type Input struct {
+	Name    string
+	URL     string // Flake reference of the locked input
+	Rev     string // Git revision, if any
+	NarHash string // SRI NAR hash, e.g. sha256-...
+}
+
+// Statement is an in-toto v1 statement.
+type Statement struct {
+	Type          string     `json:"_type"`
+	Subject       []Resource `json:"subject"`
+	PredicateType string     `json:"predicateType"`
+	Predicate     Predicate  `json:"predicate"`
+}
+
+// Resource is an in-toto resource descriptor.
+type Resource struct {
+	Name        string            `json:"name,omitempty"`
+	URI         string            `json:"uri,omitempty"`
+	Digest      map[string]string `json:"digest,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// Predicate is a SLSA v1 build provenance predicate.
+type Predicate struct {
+	BuildDefinition struct {
+		BuildType            string            `json:"buildType"`
+		ExternalParameters   map[string]string `json:"externalParameters"`
+		InternalParameters   map[string]string `json:"internalParameters"`
+		ResolvedDependencies []Resource        `json:"resolvedDependencies"`
+	} `json:"buildDefinition"`
+	RunDetails struct {
+		Builder struct {
+			ID string `json:"id"`
+		} `json:"builder"`
+		Metadata struct {
+			InvocationID string `json:"invocationId,omitempty"`
+			StartedOn    string `json:"startedOn"`
+			FinishedOn   string `json:"finishedOn"`
+		} `json:"metadata"`
+	} `json:"runDetails"`
+}
+
+// Generate returns the provenance statement of a build. The subject is the
+// image's qcow2, named <image>.qcow2. The commit is recorded in
+// internalParameters, and only attested as the source if the tree was clean.
+func Generate(b *Build) ([]byte, error) {
+	st := Statement{
+		Type: StatementType,
+		Subject: []Resource{{
+			Name:   b.Image + ".qcow2",
+			Digest: map[string]string{"sha256": b.QcowSHA256},
+		}},
+		PredicateType: PredicateType,
+	}
+
+	def := &st.Predicate.BuildDefinition
+	def.BuildType = BuildType
+	def.ExternalParameters = map[string]string{
+		"flake":       b.FlakeURL,
+		"flakeTarget": b.FlakeTarget,
+		"image":       b.Image,
+		"arch":        b.Arch,
+	}
+	def.InternalParameters = map[string]string{
+		"builder": b.Builder.Kind,
+		"command": b.Builder.Command,
+	}
+	if b.Builder.Host != "" {
+		def.InternalParameters["host"] = b.Builder.Host
+	}
+	if b.GitCommit != "" {
+		def.InternalParameters["gitCommit"] = b.GitCommit
+		def.InternalParameters["gitDirty"] = strconv.FormatBool(b.GitDirty)
+	}
+
+	def.ResolvedDependencies = []Resource{}
+	if b.GitCommit != "" {
+		source := Resource{Name: "source", URI: b.FlakeURL}
+		if !b.GitDirty {
+			source.Digest = map[string]string{"gitCommit": b.GitCommit}
+		}
+		def.ResolvedDependencies = append(def.ResolvedDependencies, source)
+	}
+	for _, in := range b.Inputs {
+		dep := Resource{Name: in.Name, URI: in.URL}
+		if in.Rev != "" {
+			dep.Digest = map[string]string{"gitCommit": in.Rev}
+		}
+		if in.NarHash != "" {
+			dep.Annotations = map[string]string{"narHash": in.NarHash}
+			if sum, ok := narSHA256(in.NarHash); ok {
+				if dep.Digest == nil {
+					dep.Digest = make(map[string]string)
+				}
+				dep.Digest["nixNarSha256"] = sum
+			}
+		}
+		def.ResolvedDependencies = append(def.ResolvedDependencies, dep)
+	}
+
+	run := &st.Predicate.RunDetails
+	run.Builder.ID = builderIDPrefix + b.Builder.Kind
+	if b.Builder.Host != "" {
+		run.Builder.ID += "/" + url.PathEscape(b.Builder.Host)
+	}
+	run.Metadata.InvocationID = b.RunID
+	run.Metadata.StartedOn = b.StartedOn.UTC().Format(time.RFC3339)
+	run.Metadata.FinishedOn = b.FinishedOn.UTC().Format(time.RFC3339)
+
+	return json.MarshalIndent(st, "", "  ")
+}
+
+// ReadCheckout returns the git commit a provenance statement written by
+// Generate records, and whether the tree had uncommitted changes. The
+// commit is empty if the build was not from a git checkout.
+func ReadCheckout(path string) (commit string, dirty bool, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	var st Statement
+	if err := json.Unmarshal(data, &st); err != nil {
+		return "", false, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	params := st.Predicate.BuildDefinition.InternalParameters
+	return params["gitCommit"], params["gitDirty"] == "true", nil
+}
+
+// lockFile is the part of flake.lock read for provenance.
+type lockFile struct {
+	Root  string `json:"root"`
+	Nodes map[string]struct {
+		Locked map[string]any `json:"locked"`
+	} `json:"nodes"`
+}
+
+// ReadLockFile returns the locked inputs in a flake.lock, sorted by name.
+// Nodes are named as in flake.lock; inputs of inputs are included.
+func ReadLockFile(path string) ([]Input, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	var lock lockFile
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	var inputs []Input
+	for name, node := range lock.Nodes {
+		if name == lock.Root || node.Locked == nil {
+			continue
+		}
+		inputs = append(inputs, Input{
+			Name:    name,
+			URL:     lockedURL(node.Locked),
+			Rev:     str(node.Locked["rev"]),
+			NarHash: str(node.Locked["narHash"]),
+		})
+	}
+	sort.Slice(inputs, func(i, j int) bool { return inputs[i].Name < inputs[j].Name })
+	return inputs, nil
+}
+
+// lockedURL returns the flake reference of a locked input.
+func lockedURL(locked map[string]any) string {
+	rev := str(locked["rev"])
+	switch typ := str(locked["type"]); typ {
+	case "github", "gitlab", "sourcehut":
+		ref := fmt.Sprintf("%s:%s/%s", typ, str(locked["owner"]), str(locked["repo"]))
+		if rev != "" {
+			ref += "/" + rev
+		}
+		return ref
+	case "git", "hg":
+		ref := typ + "+" + str(locked["url"])
+		if rev != "" {
+			ref += "?rev=" + rev
+		}
+		return ref
+	case "path":
+		return "path:" + str(locked["path"])
+	case "tarball", "file":
+		return typ + "+" + str(locked["url"])
+	default:
+		return typ + ":" + str(locked["url"])
+	}
+}
+
+// FlakeURL returns the reference of a flake in a git checkout at commit,
+// from the checkout's remote URL (https or scp-like ssh), or the checkout
+// directory if it has no remote. Credentials in the remote URL are left out;
+// only the user name of an ssh URL is kept, as ssh needs it.
+func FlakeURL(remote, dir, commit string) string {
+	var ref string
+	switch {
+	case strings.Contains(remote, "://"):
+		if u, err := url.Parse(remote); err == nil {
+			if u.User != nil && u.Scheme == "ssh" {
+				u.User = url.User(u.User.Username())
+			} else {
+				u.User = nil
+			}
+			remote = u.String()
+		}
+		ref = "git+" + remote
+	case remote != "":
+		// user@host:path
+		host, path, _ := strings.Cut(remote, ":")
+		ref = "git+ssh://" + host + "/" + strings.TrimPrefix(path, "/")
+	case commit != "":
+		ref = "git+file://" + dir
+	default:
+		return "path:" + dir
+	}
+	if commit != "" {
+		ref += "?rev=" + commit
+	}
+	return ref
+}
+
+// narSHA256 returns the hex digest of an SRI sha256 NAR hash.
+func narSHA256(sri string) (string, bool) {
+	b64, ok := strings.CutPrefix(sri, "sha256-")
+	if !ok {
+		return "", false
+	}
+	sum, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil || len(sum) != sha256.Size {
+		return "", false
+	}
+	return hex.EncodeToString(sum), true
+}
+
+// str returns v if it is a string, and "" otherwise.
+func str(v any) string {
+	s, _ := v.(string)
+	return s
+}
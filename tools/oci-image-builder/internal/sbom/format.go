@@ -0,0 +1,231 @@
+package sbom
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// toolName identifies this tool as the SBOM author.
+const toolName = "oci-image-builder"
+
+// cdxBOM is a CycloneDX 1.5 document.
+type cdxBOM struct {
+	BOMFormat    string         `json:"bomFormat"`
+	SpecVersion  string         `json:"specVersion"`
+	SerialNumber string         `json:"serialNumber"`
+	Version      int            `json:"version"`
+	Metadata     cdxMetadata    `json:"metadata"`
+	Components   []cdxComponent `json:"components"`
+}
+
+type cdxMetadata struct {
+	Timestamp string `json:"timestamp"`
+	Tools     struct {
+		Components []cdxComponent `json:"components"`
+	} `json:"tools"`
+	Component cdxComponent `json:"component"`
+}
+
+type cdxComponent struct {
+	Type               string           `json:"type"`
+	BOMRef             string           `json:"bom-ref,omitempty"`
+	Name               string           `json:"name"`
+	Version            string           `json:"version,omitempty"`
+	PURL               string           `json:"purl,omitempty"`
+	Licenses           []cdxLicense     `json:"licenses,omitempty"`
+	ExternalReferences []cdxExternalRef `json:"externalReferences,omitempty"`
+	Properties         []cdxProperty    `json:"properties,omitempty"`
+}
+
+type cdxLicense struct {
+	License struct {
+		ID   string `json:"id,omitempty"`
+		Name string `json:"name,omitempty"`
+	} `json:"license"`
+}
+
+type cdxExternalRef struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+}
+
+type cdxProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// encodeCycloneDX encodes components as a CycloneDX JSON document.
+func encodeCycloneDX(imageName string, components []Component) ([]byte, error) {
+	bom := cdxBOM{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.5",
+		SerialNumber: "urn:uuid:" + newUUID(),
+		Version:      1,
+		Components:   []cdxComponent{},
+	}
+	bom.Metadata.Timestamp = time.Now().UTC().Format(time.RFC3339)
+	bom.Metadata.Tools.Components = []cdxComponent{{Type: "application", Name: toolName}}
+	bom.Metadata.Component = cdxComponent{Type: "operating-system", BOMRef: imageName, Name: imageName}
+
+	for _, c := range components {
+		comp := cdxComponent{
+			Type:    "library",
+			BOMRef:  c.DrvPath,
+			Name:    c.Name,
+			Version: c.Version,
+			PURL:    purl(c),
+		}
+		for _, l := range c.Licenses {
+			var lic cdxLicense
+			lic.License.ID, lic.License.Name = l.ID, l.Name
+			comp.Licenses = append(comp.Licenses, lic)
+		}
+		for _, u := range c.SourceURLs {
+			comp.ExternalReferences = append(comp.ExternalReferences, cdxExternalRef{Type: "distribution", URL: u})
+		}
+		comp.Properties = append(comp.Properties, cdxProperty{Name: "nix:drv_path", Value: c.DrvPath})
+		for _, p := range c.StorePaths {
+			comp.Properties = append(comp.Properties, cdxProperty{Name: "nix:store_path", Value: p})
+		}
+		bom.Components = append(bom.Components, comp)
+	}
+
+	return json.MarshalIndent(bom, "", "  ")
+}
+
+// spdxDocument is an SPDX 2.3 document.
+type spdxDocument struct {
+	SPDXVersion       string `json:"spdxVersion"`
+	DataLicense       string `json:"dataLicense"`
+	SPDXID            string `json:"SPDXID"`
+	Name              string `json:"name"`
+	DocumentNamespace string `json:"documentNamespace"`
+	CreationInfo      struct {
+		Created  string   `json:"created"`
+		Creators []string `json:"creators"`
+	} `json:"creationInfo"`
+	Packages      []spdxPackage      `json:"packages"`
+	Relationships []spdxRelationship `json:"relationships"`
+}
+
+type spdxPackage struct {
+	SPDXID           string            `json:"SPDXID"`
+	Name             string            `json:"name"`
+	VersionInfo      string            `json:"versionInfo,omitempty"`
+	PackageFileName  string            `json:"packageFileName,omitempty"`
+	DownloadLocation string            `json:"downloadLocation"`
+	FilesAnalyzed    bool              `json:"filesAnalyzed"`
+	LicenseConcluded string            `json:"licenseConcluded"`
+	LicenseDeclared  string            `json:"licenseDeclared"`
+	CopyrightText    string            `json:"copyrightText"`
+	Comment          string            `json:"comment,omitempty"`
+	ExternalRefs     []spdxExternalRef `json:"externalRefs,omitempty"`
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+// encodeSPDX encodes components as an SPDX JSON document.
+func encodeSPDX(imageName string, components []Component) ([]byte, error) {
+	const noAssertion = "NOASSERTION"
+
+	doc := spdxDocument{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              imageName,
+		DocumentNamespace: fmt.Sprintf("https://%s.invalid/spdx/%s-%s", toolName, url.PathEscape(imageName), newUUID()),
+	}
+	doc.CreationInfo.Created = time.Now().UTC().Format(time.RFC3339)
+	doc.CreationInfo.Creators = []string{"Tool: " + toolName}
+
+	doc.Packages = append(doc.Packages, spdxPackage{
+		SPDXID:           "SPDXRef-Image",
+		Name:             imageName,
+		DownloadLocation: noAssertion,
+		LicenseConcluded: noAssertion,
+		LicenseDeclared:  noAssertion,
+		CopyrightText:    noAssertion,
+	})
+	doc.Relationships = append(doc.Relationships, spdxRelationship{
+		SPDXElementID: "SPDXRef-DOCUMENT", RelationshipType: "DESCRIBES", RelatedSPDXElement: "SPDXRef-Image",
+	})
+
+	for i, c := range components {
+		pkg := spdxPackage{
+			SPDXID:           fmt.Sprintf("SPDXRef-Package-%d", i+1),
+			Name:             c.Name,
+			VersionInfo:      c.Version,
+			PackageFileName:  c.DrvPath,
+			DownloadLocation: noAssertion,
+			LicenseConcluded: noAssertion,
+			LicenseDeclared:  spdxLicense(c.Licenses),
+			CopyrightText:    noAssertion,
+			ExternalRefs: []spdxExternalRef{{
+				ReferenceCategory: "PACKAGE-MANAGER", ReferenceType: "purl", ReferenceLocator: purl(c),
+			}},
+		}
+		// Prefer a URL over Nix mirror:// references
+		for _, u := range c.SourceURLs {
+			if pkg.DownloadLocation == noAssertion || strings.HasPrefix(u, "http") && !strings.HasPrefix(pkg.DownloadLocation, "http") {
+				pkg.DownloadLocation = u
+			}
+		}
+		if len(c.StorePaths) > 0 {
+			pkg.Comment = "Store paths: " + strings.Join(c.StorePaths, " ")
+		}
+		doc.Packages = append(doc.Packages, pkg)
+		doc.Relationships = append(doc.Relationships, spdxRelationship{
+			SPDXElementID: "SPDXRef-Image", RelationshipType: "CONTAINS", RelatedSPDXElement: pkg.SPDXID,
+		})
+	}
+
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+// spdxLicense returns an SPDX licence expression, or NOASSERTION if any
+// licence has no SPDX identifier.
+func spdxLicense(licenses []License) string {
+	var ids []string
+	for _, l := range licenses {
+		if l.ID == "" {
+			return "NOASSERTION"
+		}
+		ids = append(ids, l.ID)
+	}
+	if len(ids) == 0 {
+		return "NOASSERTION"
+	}
+	return strings.Join(ids, " AND ")
+}
+
+// purl returns the package URL of a component.
+func purl(c Component) string {
+	p := "pkg:nix/" + url.PathEscape(c.Name)
+	if c.Version != "" {
+		p += "@" + url.PathEscape(c.Version)
+	}
+	return p
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
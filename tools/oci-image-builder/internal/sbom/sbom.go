@@ -0,0 +1,306 @@
+// Package sbom generates software bills of materials for images from the
+// Nix derivations they are built from.
+package sbom
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"unicode"
+
+	"oci-image-builder/internal/config"
+	"oci-image-builder/internal/logger"
+)
+
+// storeDir prefixes store paths that Nix prints without it.
+const storeDir = "/nix/store/"
+
+// Component is a package in an image's build closure.
+type Component struct {
+	Name       string
+	Version    string
+	DrvPath    string
+	StorePaths []string  // Output paths
+	Licenses   []License // From nixpkgs meta.license, if known
+	SourceURLs []string  // URLs the package's sources are fetched from
+}
+
+// License is a package licence, by SPDX identifier if it has one.
+type License struct {
+	ID   string // SPDX identifier
+	Name string // Used when there is no SPDX identifier
+}
+
+// Generator produces SBOMs for the images of a flake.
+type Generator struct {
+	FlakeRef string
+	Logger   *logger.Logger
+
+	licenses map[string][]License // By package name and pname, loaded once
+}
+
+// NewGenerator creates a Generator for a flake reference such as ".".
+func NewGenerator(flakeRef string) *Generator {
+	return &Generator{
+		FlakeRef: flakeRef,
+		Logger:   logger.New(),
+	}
+}
+
+// SetLogFunc sets the logging function for progress output.
+func (g *Generator) SetLogFunc(fn func(string)) {
+	g.Logger.SetLogFunc(fn)
+}
+
+// Generate returns the SBOM of a flake target in format (config.SBOMCycloneDX
+// or config.SBOMSPDX). Licences are looked up in the flake's nixpkgs input;
+// if that fails they are left out with a warning.
+func (g *Generator) Generate(ctx context.Context, imageName, flakeTarget, format string) ([]byte, error) {
+	g.Logger.Logf("Generating %s SBOM for %s...", format, imageName)
+
+	components, err := g.components(ctx, flakeTarget)
+	if err != nil {
+		return nil, err
+	}
+
+	if g.licenses == nil {
+		g.licenses, err = g.loadLicenses(ctx)
+		if err != nil {
+			g.Logger.Logf("  Warning: SBOM will not include licences: %v", err)
+			g.licenses = make(map[string][]License)
+		}
+	}
+	for i := range components {
+		c := &components[i]
+		if l, ok := g.licenses[c.Name+"-"+c.Version]; ok {
+			c.Licenses = l
+		} else {
+			c.Licenses = g.licenses[c.Name]
+		}
+	}
+	g.Logger.Logf("  %d packages", len(components))
+
+	switch format {
+	case config.SBOMCycloneDX:
+		return encodeCycloneDX(imageName, components)
+	case config.SBOMSPDX:
+		return encodeSPDX(imageName, components)
+	}
+	return nil, fmt.Errorf("unknown SBOM format %q", format)
+}
+
+// derivation is an entry of 'nix derivation show' output.
+type derivation struct {
+	Name    string `json:"name"`
+	Outputs map[string]struct {
+		Path string `json:"path"`
+		Hash string `json:"hash"` // Set for fixed-output derivations
+	} `json:"outputs"`
+	Env map[string]string `json:"env"`
+}
+
+// components returns the packages of a flake target's derivation closure.
+// Fixed-output derivations are the fetched sources of other packages and
+// are reported as their source URLs.
+func (g *Generator) components(ctx context.Context, flakeTarget string) ([]Component, error) {
+	out, err := nixOutput(ctx, "nix", "derivation", "show", "--recursive",
+		"--extra-experimental-features", "nix-command flakes", g.FlakeRef+"#"+flakeTarget)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get derivations of %s: %w", flakeTarget, err)
+	}
+
+	var drvs map[string]derivation
+	var wrapped struct {
+		Derivations map[string]derivation `json:"derivations"`
+	}
+	if err := json.Unmarshal(out, &wrapped); err == nil && wrapped.Derivations != nil {
+		drvs = wrapped.Derivations // Newer Nix versions
+	} else if err := json.Unmarshal(out, &drvs); err != nil {
+		return nil, fmt.Errorf("failed to parse nix derivation show output: %w", err)
+	}
+
+	// URLs of fetched sources, by output path
+	sources := make(map[string][]string)
+	for _, drv := range drvs {
+		for _, o := range drv.Outputs {
+			if o.Hash == "" {
+				continue
+			}
+			urls := strings.Fields(drv.Env["urls"])
+			if u := drv.Env["url"]; u != "" {
+				urls = append(urls, u)
+			}
+			sources[storePath(o.Path)] = urls
+		}
+	}
+
+	var components []Component
+	for drvPath, drv := range drvs {
+		if isFixedOutput(drv) {
+			continue
+		}
+
+		c := Component{DrvPath: storePath(drvPath)}
+		c.Name, c.Version = drv.Env["pname"], drv.Env["version"]
+		if c.Name == "" {
+			c.Name, c.Version = splitName(drv.Name)
+		}
+		for _, o := range drv.Outputs {
+			c.StorePaths = append(c.StorePaths, storePath(o.Path))
+		}
+		sort.Strings(c.StorePaths)
+
+		for _, src := range append(strings.Fields(drv.Env["src"]), strings.Fields(drv.Env["srcs"])...) {
+			c.SourceURLs = append(c.SourceURLs, sources[storePath(src)]...)
+		}
+		components = append(components, c)
+	}
+
+	sort.Slice(components, func(i, j int) bool {
+		if components[i].Name != components[j].Name {
+			return components[i].Name < components[j].Name
+		}
+		return components[i].DrvPath < components[j].DrvPath
+	})
+	return components, nil
+}
+
+// isFixedOutput reports whether drv fetches content with a known hash.
+func isFixedOutput(drv derivation) bool {
+	for _, o := range drv.Outputs {
+		if o.Hash != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// loadLicenses reads the licences of all packages in the flake's nixpkgs
+// input, keyed by both name and pname.
+func (g *Generator) loadLicenses(ctx context.Context) (map[string][]License, error) {
+	out, err := nixOutput(ctx, "nix", "flake", "archive", "--json",
+		"--extra-experimental-features", "nix-command flakes", g.FlakeRef)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get flake inputs: %w", err)
+	}
+	var archive struct {
+		Inputs map[string]struct {
+			Path string `json:"path"`
+		} `json:"inputs"`
+	}
+	if err := json.Unmarshal(out, &archive); err != nil {
+		return nil, fmt.Errorf("failed to parse nix flake archive output: %w", err)
+	}
+	nixpkgs := archive.Inputs["nixpkgs"].Path
+	if nixpkgs == "" {
+		return nil, fmt.Errorf("flake has no nixpkgs input")
+	}
+
+	g.Logger.Log("  Reading licences from nixpkgs...")
+	out, err = nixOutput(ctx, "nix-env", "--query", "--available", "--meta", "--json",
+		"--file", nixpkgs, "--arg", "config", "{ allowAliases = false; allowUnfree = true; }")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query nixpkgs: %w", err)
+	}
+	var pkgs map[string]struct {
+		Name  string `json:"name"`
+		PName string `json:"pname"`
+		Meta  struct {
+			License json.RawMessage `json:"license"`
+		} `json:"meta"`
+	}
+	if err := json.Unmarshal(out, &pkgs); err != nil {
+		return nil, fmt.Errorf("failed to parse nixpkgs metadata: %w", err)
+	}
+
+	licenses := make(map[string][]License)
+	for _, pkg := range pkgs {
+		l := parseLicenses(pkg.Meta.License)
+		if len(l) == 0 {
+			continue
+		}
+		licenses[pkg.Name] = l
+		if pkg.PName != "" {
+			licenses[pkg.PName] = l
+		}
+	}
+	return licenses, nil
+}
+
+// parseLicenses parses a nixpkgs meta.license, which is a licence attribute
+// set, a list of them, or a free-form string.
+func parseLicenses(raw json.RawMessage) []License {
+	if len(raw) == 0 {
+		return nil
+	}
+
+	type attrs struct {
+		SpdxID    string `json:"spdxId"`
+		ShortName string `json:"shortName"`
+		FullName  string `json:"fullName"`
+	}
+	convert := func(a attrs) License {
+		if a.SpdxID != "" {
+			return License{ID: a.SpdxID}
+		}
+		if a.FullName != "" {
+			return License{Name: a.FullName}
+		}
+		return License{Name: a.ShortName}
+	}
+
+	var one attrs
+	if err := json.Unmarshal(raw, &one); err == nil {
+		return []License{convert(one)}
+	}
+	var list []attrs
+	if err := json.Unmarshal(raw, &list); err == nil {
+		var out []License
+		for _, a := range list {
+			out = append(out, convert(a))
+		}
+		return out
+	}
+	var name string
+	if err := json.Unmarshal(raw, &name); err == nil && name != "" {
+		return []License{{Name: name}}
+	}
+	return nil
+}
+
+// splitName splits a derivation name such as "openssl-3.0.13" into a name
+// and version at the first dash followed by a digit, as Nix does.
+func splitName(name string) (string, string) {
+	for i := 0; i+1 < len(name); i++ {
+		if name[i] == '-' && unicode.IsDigit(rune(name[i+1])) {
+			return name[:i], name[i+1:]
+		}
+	}
+	return name, ""
+}
+
+// storePath returns path with the store directory, which newer Nix
+// versions leave out of JSON output.
+func storePath(path string) string {
+	if path == "" || strings.HasPrefix(path, "/") {
+		return path
+	}
+	return storeDir + path
+}
+
+// nixOutput runs a Nix command and returns its stdout.
+func nixOutput(ctx context.Context, name string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
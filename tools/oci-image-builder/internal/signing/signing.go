@@ -0,0 +1,164 @@
+// Package signing signs and verifies the manifests that describe uploaded
+// image objects, so an object swapped in the bucket after upload is not
+// imported.
+package signing
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// AlgorithmEd25519 is the Signature algorithm of ed25519 keys.
+const AlgorithmEd25519 = "ed25519"
+
+// ErrBadSignature is returned by Verify when a signature does not match.
+var ErrBadSignature = errors.New("signature does not match")
+
+// Manifest describes an uploaded qcow2 object.
+type Manifest struct {
+	Image       string    `json:"image"`
+	ObjectName  string    `json:"object_name"`
+	SHA256      string    `json:"sha256"`
+	Size        int64     `json:"size"`
+	FlakeTarget string    `json:"flake_target"`
+	GitCommit   string    `json:"git_commit,omitempty"`
+	GitTags     []string  `json:"git_tags,omitempty"`  // Tags pointing at GitCommit at upload
+	GitDirty    bool      `json:"git_dirty,omitempty"` // The tree had uncommitted changes
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Signature is a detached signature of an encoded manifest.
+type Signature struct {
+	Algorithm    string `json:"algorithm"`                // AlgorithmEd25519 or a KMS signing algorithm
+	KeyID        string `json:"key_id"`                   // Public key fingerprint or KMS key OCID
+	KeyVersionID string `json:"key_version_id,omitempty"` // KMS key version that signed
+	Value        []byte `json:"signature"`
+}
+
+// Signer signs messages and verifies their signatures.
+type Signer interface {
+	Sign(ctx context.Context, message []byte) (*Signature, error)
+	Verify(ctx context.Context, message []byte, sig *Signature) error
+}
+
+// ed25519Signer signs with an ed25519 key. Without a private key it can
+// only verify.
+type ed25519Signer struct {
+	private ed25519.PrivateKey
+	public  ed25519.PublicKey
+	keyID   string
+}
+
+// LoadEd25519 loads an ed25519 PKCS#8 private key from privatePath, or only
+// a PKIX public key from publicPath if privatePath is empty.
+func LoadEd25519(privatePath, publicPath string) (Signer, error) {
+	s := &ed25519Signer{}
+
+	if privatePath != "" {
+		key, err := readPEM(privatePath, x509.ParsePKCS8PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		private, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%s is not an ed25519 private key", privatePath)
+		}
+		s.private = private
+		s.public = private.Public().(ed25519.PublicKey)
+	} else {
+		key, err := readPEM(publicPath, x509.ParsePKIXPublicKey)
+		if err != nil {
+			return nil, err
+		}
+		public, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("%s is not an ed25519 public key", publicPath)
+		}
+		s.public = public
+	}
+
+	sum := sha256.Sum256(s.public)
+	s.keyID = "SHA256:" + hex.EncodeToString(sum[:8])
+	return s, nil
+}
+
+// readPEM reads the first PEM block of a file and parses it.
+func readPEM(path string, parse func([]byte) (any, error)) (any, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM file", path)
+	}
+	key, err := parse(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return key, nil
+}
+
+// Sign implements Signer.
+func (s *ed25519Signer) Sign(ctx context.Context, message []byte) (*Signature, error) {
+	if s.private == nil {
+		return nil, fmt.Errorf("cannot sign without a private key (signing.key_path)")
+	}
+	return &Signature{
+		Algorithm: AlgorithmEd25519,
+		KeyID:     s.keyID,
+		Value:     ed25519.Sign(s.private, message),
+	}, nil
+}
+
+// Verify implements Signer.
+func (s *ed25519Signer) Verify(ctx context.Context, message []byte, sig *Signature) error {
+	if sig.Algorithm != AlgorithmEd25519 || sig.KeyID != s.keyID {
+		return fmt.Errorf("signed by %s key %s, expected %s key %s",
+			sig.Algorithm, sig.KeyID, AlgorithmEd25519, s.keyID)
+	}
+	if !ed25519.Verify(s.public, message, sig.Value) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// Encode returns the JSON encoding of a manifest, which is what is signed.
+func Encode(m *Manifest) ([]byte, error) {
+	return json.MarshalIndent(m, "", "  ")
+}
+
+// FileDigest returns the hex SHA-256 and size of a file.
+func FileDigest(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer f.Close()
+
+	sum, n, err := Digest(f)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to hash %s: %w", path, err)
+	}
+	return sum, n, nil
+}
+
+// Digest returns the hex SHA-256 and size of everything read from r.
+func Digest(r io.Reader) (string, int64, error) {
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return "", n, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
@@ -0,0 +1,231 @@
+package signing
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeKeys writes a new ed25519 key pair as PEM files in dir and returns
+// their paths.
+func writeKeys(t *testing.T, dir, name string) (privatePath, publicPath string) {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privatePath = filepath.Join(dir, name+".pem")
+	publicPath = filepath.Join(dir, name+".pub.pem")
+	writePEM(t, privatePath, "PRIVATE KEY", privateDER)
+	writePEM(t, publicPath, "PUBLIC KEY", publicDER)
+	return privatePath, publicPath
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadEd25519(t *testing.T) {
+	dir := t.TempDir()
+	privatePath, publicPath := writeKeys(t, dir, "key")
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPrivateDER, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPublicDER, err := x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPrivatePath := filepath.Join(dir, "ec.pem")
+	ecPublicPath := filepath.Join(dir, "ec.pub.pem")
+	writePEM(t, ecPrivatePath, "PRIVATE KEY", ecPrivateDER)
+	writePEM(t, ecPublicPath, "PUBLIC KEY", ecPublicDER)
+
+	notPEM := filepath.Join(dir, "not.pem")
+	if err := os.WriteFile(notPEM, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	garbage := filepath.Join(dir, "garbage.pem")
+	writePEM(t, garbage, "PRIVATE KEY", []byte("garbage"))
+
+	tests := []struct {
+		name        string
+		private     string
+		public      string
+		wantErr     string
+		wantCanSign bool
+	}{
+		{name: "private key", private: privatePath, wantCanSign: true},
+		{name: "private key wins over public key", private: privatePath, public: ecPublicPath, wantCanSign: true},
+		{name: "public key only", public: publicPath},
+		{name: "missing file", private: filepath.Join(dir, "missing.pem"), wantErr: "failed to read signing key"},
+		{name: "not PEM", private: notPEM, wantErr: "is not a PEM file"},
+		{name: "unparsable key", private: garbage, wantErr: "failed to parse"},
+		{name: "ECDSA private key", private: ecPrivatePath, wantErr: "is not an ed25519 private key"},
+		{name: "ECDSA public key", public: ecPublicPath, wantErr: "is not an ed25519 public key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signer, err := LoadEd25519(tt.private, tt.public)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("LoadEd25519() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadEd25519() error = %v", err)
+			}
+
+			_, err = signer.Sign(context.Background(), []byte("message"))
+			if canSign := err == nil; canSign != tt.wantCanSign {
+				t.Errorf("Sign() error = %v, want can sign %v", err, tt.wantCanSign)
+			}
+		})
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	privatePath, publicPath := writeKeys(t, dir, "key")
+	otherPath, _ := writeKeys(t, dir, "other")
+
+	signer, err := LoadEd25519(privatePath, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := LoadEd25519("", publicPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := LoadEd25519(otherPath, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message, err := Encode(&Manifest{Image: "derp", ObjectName: "derp-20240115-123456.qcow2", SHA256: "ab", Size: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := signer.Sign(ctx, message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig.Algorithm != AlgorithmEd25519 || !strings.HasPrefix(sig.KeyID, "SHA256:") {
+		t.Fatalf("Sign() = %s key %s", sig.Algorithm, sig.KeyID)
+	}
+
+	tampered := func(edit func(m []byte, s *Signature) []byte) ([]byte, *Signature) {
+		m := append([]byte(nil), message...)
+		s := *sig
+		s.Value = append([]byte(nil), sig.Value...)
+		return edit(m, &s), &s
+	}
+
+	tests := []struct {
+		name     string
+		verifier Signer
+		edit     func(m []byte, s *Signature) []byte
+		wantErr  string
+		wantBad  bool
+	}{
+		{name: "round trip", verifier: signer, edit: func(m []byte, s *Signature) []byte { return m }},
+		{name: "public key verifies", verifier: verifier, edit: func(m []byte, s *Signature) []byte { return m }},
+		{
+			name:     "tampered manifest",
+			verifier: verifier,
+			edit: func(m []byte, s *Signature) []byte {
+				return []byte(strings.Replace(string(m), `"size": 1`, `"size": 2`, 1))
+			},
+			wantBad: true,
+		},
+		{
+			name:     "tampered signature",
+			verifier: verifier,
+			edit:     func(m []byte, s *Signature) []byte { s.Value[0] ^= 0xff; return m },
+			wantBad:  true,
+		},
+		{
+			name:     "other key",
+			verifier: other,
+			edit:     func(m []byte, s *Signature) []byte { return m },
+			wantErr:  "expected ed25519 key",
+		},
+		{
+			name:     "key ID rewritten",
+			verifier: verifier,
+			edit:     func(m []byte, s *Signature) []byte { s.KeyID = "SHA256:0000000000000000"; return m },
+			wantErr:  "signed by ed25519 key SHA256:0000000000000000",
+		},
+		{
+			name:     "other algorithm",
+			verifier: verifier,
+			edit:     func(m []byte, s *Signature) []byte { s.Algorithm = "ECDSA_SHA_256"; return m },
+			wantErr:  "signed by ECDSA_SHA_256 key",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, s := tampered(tt.edit)
+			err := tt.verifier.Verify(ctx, m, s)
+			switch {
+			case tt.wantBad:
+				if !errors.Is(err, ErrBadSignature) {
+					t.Errorf("Verify() error = %v, want %v", err, ErrBadSignature)
+				}
+			case tt.wantErr != "":
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Verify() error = %v, want %q", err, tt.wantErr)
+				}
+			case err != nil:
+				t.Errorf("Verify() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestFileDigest(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "image.qcow2")
+	if err := os.WriteFile(path, []byte("hello\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	sum, size, err := FileDigest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03"; sum != want || size != 6 {
+		t.Errorf("FileDigest() = %s, %d, want %s, 6", sum, size, want)
+	}
+
+	if _, _, err := FileDigest(path + ".missing"); err == nil {
+		t.Error("FileDigest() of a missing file succeeded")
+	}
+}
@@ -0,0 +1,61 @@
+package state
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+
+	"oci-image-builder/internal/fsutil"
+)
+
+// Export records an export started by 'export' that has not finished, so
+// that running 'export' again for the image waits for its work request or
+// releases its write request.
+type Export struct {
+	DisplayName   string    `toml:"display_name"`
+	ObjectName    string    `toml:"object_name"`
+	WorkRequestID string    `toml:"work_request_id,omitempty"`
+	PARID         string    `toml:"par_id,omitempty"` // Write request in import mode "par"
+	StartedAt     time.Time `toml:"started_at"`
+}
+
+// Exports holds the unfinished exports, keyed by image OCID.
+type Exports struct {
+	Images map[string]Export `toml:"images"`
+}
+
+// LoadExports reads the unfinished exports, returning none if no record
+// exists.
+func (m *Manager) LoadExports() (*Exports, error) {
+	exports := &Exports{Images: make(map[string]Export)}
+
+	data, err := os.ReadFile(m.exportsPath)
+	if os.IsNotExist(err) {
+		return exports, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read exports: %w", err)
+	}
+
+	if err := toml.Unmarshal(data, exports); err != nil {
+		return nil, fmt.Errorf("failed to parse exports %s: %w", m.exportsPath, err)
+	}
+	if exports.Images == nil {
+		exports.Images = make(map[string]Export)
+	}
+	return exports, nil
+}
+
+// SaveExports writes the unfinished exports atomically.
+func (m *Manager) SaveExports(exports *Exports) error {
+	data, err := toml.Marshal(exports)
+	if err != nil {
+		return fmt.Errorf("failed to marshal exports: %w", err)
+	}
+	if err := fsutil.WriteFileAtomic(m.exportsPath, data); err != nil {
+		return fmt.Errorf("failed to write exports: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package state
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+
+	"oci-image-builder/internal/fsutil"
+)
+
+// RunSummary is the index entry for a saved run.
+type RunSummary struct {
+	RunID       string        `toml:"run_id"`
+	StartedAt   time.Time     `toml:"started_at"`
+	UpdatedAt   time.Time     `toml:"updated_at"`
+	CompletedAt time.Time     `toml:"completed_at,omitzero"`
+	Stage       PipelineStage `toml:"stage"`
+	Complete    bool          `toml:"complete"`
+	Interrupted bool          `toml:"interrupted,omitempty"`
+	Images      []string      `toml:"images"`
+}
+
+// runIndex is the on-disk index of saved runs, ordered by start time.
+type runIndex struct {
+	Runs []RunSummary `toml:"runs"`
+}
+
+// upsert adds or replaces the summary for a run, keeping runs ordered.
+func (idx *runIndex) upsert(summary RunSummary) {
+	for i := range idx.Runs {
+		if idx.Runs[i].RunID == summary.RunID {
+			idx.Runs[i] = summary
+			return
+		}
+	}
+	idx.Runs = append(idx.Runs, summary)
+	sort.SliceStable(idx.Runs, func(i, j int) bool {
+		return idx.Runs[i].StartedAt.Before(idx.Runs[j].StartedAt)
+	})
+}
+
+// remove deletes the summary for a run, reporting whether it was present.
+func (idx *runIndex) remove(runID string) bool {
+	for i := range idx.Runs {
+		if idx.Runs[i].RunID == runID {
+			idx.Runs = append(idx.Runs[:i], idx.Runs[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// summary returns the index entry for a run.
+func (p *PipelineState) summary() RunSummary {
+	images := make([]string, len(p.Images))
+	for i, img := range p.Images {
+		images[i] = img.Name
+	}
+
+	return RunSummary{
+		RunID:       p.RunID,
+		StartedAt:   p.StartedAt,
+		UpdatedAt:   p.UpdatedAt,
+		CompletedAt: p.CompletedAt,
+		Stage:       p.Stage,
+		Complete:    p.Complete,
+		Interrupted: p.Interrupted,
+		Images:      images,
+	}
+}
+
+// runPath returns the state file path for a run.
+func (m *Manager) runPath(runID string) string {
+	return filepath.Join(m.runsDir, runID+".toml")
+}
+
+// readIndex reads the run index, returning an empty index if none exists.
+func (m *Manager) readIndex() (*runIndex, error) {
+	data, err := os.ReadFile(m.indexPath)
+	if os.IsNotExist(err) {
+		return &runIndex{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read run index: %w", err)
+	}
+
+	var idx runIndex
+	if err := toml.Unmarshal(data, &idx); err != nil {
+		return nil, fmt.Errorf("failed to parse run index %s: %w", m.indexPath, err)
+	}
+	return &idx, nil
+}
+
+// updateIndex applies fn to the run index and writes it back atomically.
+func (m *Manager) updateIndex(fn func(*runIndex)) error {
+	idx, err := m.readIndex()
+	if err != nil {
+		return err
+	}
+
+	fn(idx)
+
+	data, err := toml.Marshal(idx)
+	if err != nil {
+		return fmt.Errorf("failed to marshal run index: %w", err)
+	}
+	if err := fsutil.WriteFileAtomic(m.indexPath, data); err != nil {
+		return fmt.Errorf("failed to write run index: %w", err)
+	}
+	return nil
+}
+
+// migrateLegacy moves a state.toml written before run history into the
+// runs directory, so its run shows up in 'state list'.
+func (m *Manager) migrateLegacy() error {
+	data, err := os.ReadFile(m.legacyPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read legacy state file: %w", err)
+	}
+
+	var state PipelineState
+	if err := toml.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("failed to parse legacy state file %s: %w", m.legacyPath, err)
+	}
+
+	if state.RunID != "" {
+		if err := fsutil.WriteFileAtomic(m.runPath(state.RunID), data); err != nil {
+			return fmt.Errorf("failed to migrate legacy state file: %w", err)
+		}
+		if err := m.updateIndex(func(idx *runIndex) { idx.upsert(state.summary()) }); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Remove(m.legacyPath); err != nil {
+		return fmt.Errorf("failed to remove legacy state file: %w", err)
+	}
+	return nil
+}
+
+// ListRuns returns summaries of all saved runs, oldest first.
+func (m *Manager) ListRuns() ([]RunSummary, error) {
+	if err := m.migrateLegacy(); err != nil {
+		return nil, err
+	}
+
+	idx, err := m.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	return idx.Runs, nil
+}
+
+// RemoveRun deletes a saved run and its index entry.
+func (m *Manager) RemoveRun(runID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	found := false
+	if err := m.updateIndex(func(idx *runIndex) { found = idx.remove(runID) }); err != nil {
+		return err
+	}
+
+	err := os.Remove(m.runPath(runID))
+	if os.IsNotExist(err) {
+		if !found {
+			return fmt.Errorf("run %s not found", runID)
+		}
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to remove state file: %w", err)
+	}
+
+	if m.state != nil && m.state.RunID == runID {
+		m.state = nil
+	}
+	return nil
+}
+
+// ImageComparison holds per-image deltas between two runs. Deltas are
+// current minus baseline, so a negative duration delta means faster.
+type ImageComparison struct {
+	Name                    string
+	Current                 ImageStatistics
+	Baseline                ImageStatistics
+	InBaseline              bool
+	TotalDurationDelta      time.Duration
+	BuildDurationDelta      time.Duration
+	UploadDurationDelta     time.Duration
+	ImportDurationDelta     time.Duration
+	UploadThroughputMBDelta float64
+}
+
+// CompareStatistics compares each image of current against the image of the
+// same name in baseline.
+func CompareStatistics(current, baseline *PipelineStatistics) []ImageComparison {
+	base := make(map[string]ImageStatistics, len(baseline.ImageStats))
+	for _, img := range baseline.ImageStats {
+		base[img.Name] = img
+	}
+
+	comparisons := make([]ImageComparison, 0, len(current.ImageStats))
+	for _, img := range current.ImageStats {
+		cmp := ImageComparison{Name: img.Name, Current: img}
+		if b, ok := base[img.Name]; ok {
+			cmp.Baseline = b
+			cmp.InBaseline = true
+			cmp.TotalDurationDelta = img.TotalDuration - b.TotalDuration
+			cmp.BuildDurationDelta = img.BuildDuration - b.BuildDuration
+			cmp.UploadDurationDelta = img.UploadDuration - b.UploadDuration
+			cmp.ImportDurationDelta = img.ImportDuration - b.ImportDuration
+			cmp.UploadThroughputMBDelta = img.UploadThroughputMB - b.UploadThroughputMB
+		}
+		comparisons = append(comparisons, cmp)
+	}
+
+	return comparisons
+}
+
+// FormatDurationDelta formats a signed duration difference (e.g., "+1m5s").
+func FormatDurationDelta(d time.Duration) string {
+	if d < 0 {
+		return "-" + FormatDuration(-d)
+	}
+	return "+" + FormatDuration(d)
+}
@@ -0,0 +1,81 @@
+package state
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+
+	"oci-image-builder/internal/fsutil"
+)
+
+// Pointer records the live image of an image definition and the one it
+// replaced, which 'rollback' returns to.
+type Pointer struct {
+	Current    string    `toml:"current"`
+	Previous   string    `toml:"previous,omitempty"`
+	PromotedAt time.Time `toml:"promoted_at,omitzero"`
+}
+
+// Registry is the local record of promoted images, keyed by image name. The
+// image tags in OCI are authoritative; the registry keeps the history on
+// this machine and avoids listing images for every lookup.
+type Registry struct {
+	Images map[string]Pointer `toml:"images"`
+}
+
+// Promote makes imageID the current image of name, moving the current one
+// to previous. It returns the pointer as it was before.
+func (r *Registry) Promote(name, imageID string) Pointer {
+	old := r.Images[name]
+	r.Images[name] = Pointer{Current: imageID, Previous: old.Current, PromotedAt: time.Now()}
+	return old
+}
+
+// Rollback makes the previous image of name current again, so that a second
+// rollback undoes the first. It returns the pointer as it was before.
+func (r *Registry) Rollback(name string) (Pointer, error) {
+	old, ok := r.Images[name]
+	if !ok || old.Current == "" {
+		return old, fmt.Errorf("no image of %s has been promoted", name)
+	}
+	if old.Previous == "" {
+		return old, fmt.Errorf("%s has no previous image to roll back to", name)
+	}
+	r.Images[name] = Pointer{Current: old.Previous, Previous: old.Current, PromotedAt: time.Now()}
+	return old, nil
+}
+
+// LoadRegistry reads the registry, returning an empty one if none exists.
+func (m *Manager) LoadRegistry() (*Registry, error) {
+	reg := &Registry{Images: make(map[string]Pointer)}
+
+	data, err := os.ReadFile(m.registryPath)
+	if os.IsNotExist(err) {
+		return reg, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read registry: %w", err)
+	}
+
+	if err := toml.Unmarshal(data, reg); err != nil {
+		return nil, fmt.Errorf("failed to parse registry %s: %w", m.registryPath, err)
+	}
+	if reg.Images == nil {
+		reg.Images = make(map[string]Pointer)
+	}
+	return reg, nil
+}
+
+// SaveRegistry writes the registry atomically.
+func (m *Manager) SaveRegistry(reg *Registry) error {
+	data, err := toml.Marshal(reg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal registry: %w", err)
+	}
+	if err := fsutil.WriteFileAtomic(m.registryPath, data); err != nil {
+		return fmt.Errorf("failed to write registry: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package state
+
+import (
+	"fmt"
+	"os"
+)
+
+// Stage is the progress of a single image through the pipeline.
+type Stage string
+
+const (
+	StagePending        Stage = "pending"         // Not built yet
+	StageBuildComplete  Stage = "build_complete"  // Built, LocalPath set
+	StageUploading      Stage = "uploading"       // Multipart upload preserved after an interruption
+	StageUploadComplete Stage = "upload_complete" // Uploaded, ObjectName set
+	StageImporting      Stage = "importing"       // Import initiated, ImageID set
+	StageComplete       Stage = "complete"        // Image AVAILABLE
+	StageError          Stage = "error"           // Last attempt failed, see Error
+)
+
+// imageTransitions lists the stages each stage may move to. Staying in the
+// same stage is always allowed. An image in StageError may be retried from
+// any stage its recorded artifacts allow.
+var imageTransitions = map[Stage][]Stage{
+	StagePending:        {StageBuildComplete, StageError},
+	StageBuildComplete:  {StagePending, StageUploading, StageUploadComplete, StageError},
+	StageUploading:      {StageBuildComplete, StageUploadComplete, StageError},
+	StageUploadComplete: {StageImporting, StageError},
+	StageImporting:      {StageComplete, StageError},
+	StageComplete:       {},
+	StageError:          {StagePending, StageBuildComplete, StageUploading, StageUploadComplete, StageImporting},
+}
+
+// Valid reports whether s is a known image stage.
+func (s Stage) Valid() bool {
+	_, ok := imageTransitions[s]
+	return ok
+}
+
+// CanTransition reports whether an image may move from stage s to next.
+func (s Stage) CanTransition(next Stage) bool {
+	if s == next {
+		return true
+	}
+	for _, allowed := range imageTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// PipelineStage is the pipeline step a run is currently executing.
+type PipelineStage string
+
+const (
+	PipelineBuild    PipelineStage = "build"
+	PipelineUpload   PipelineStage = "upload"
+	PipelineImport   PipelineStage = "import"
+	PipelineComplete PipelineStage = "complete"
+)
+
+// Valid reports whether s is a known pipeline stage.
+func (s PipelineStage) Valid() bool {
+	switch s {
+	case PipelineBuild, PipelineUpload, PipelineImport, PipelineComplete:
+		return true
+	}
+	return false
+}
+
+// ResumeStage returns the pipeline step this image needs next, based on its
+// own stage and recorded artifacts rather than the run's overall stage.
+func (img *ImageState) ResumeStage() PipelineStage {
+	switch img.Stage {
+	case StageComplete:
+		return PipelineComplete
+	case StageImporting, StageUploadComplete:
+		return PipelineImport
+	case StageUploading:
+		if img.hasLocalImage() {
+			return PipelineUpload
+		}
+		return PipelineBuild
+	case StageBuildComplete:
+		if img.hasLocalImage() {
+			return PipelineUpload
+		}
+		return PipelineBuild
+	case StageError:
+		// Retry from the furthest point the artifacts allow
+		switch {
+		case img.ObjectName != "" && img.UploadID == "":
+			return PipelineImport
+		case img.hasLocalImage():
+			return PipelineUpload
+		}
+	}
+	return PipelineBuild
+}
+
+// hasLocalImage reports whether the image's built qcow2 still exists.
+func (img *ImageState) hasLocalImage() bool {
+	if img.LocalPath == "" {
+		return false
+	}
+	_, err := os.Stat(img.LocalPath)
+	return err == nil
+}
+
+// Validate checks that a loaded run only uses known stages and that each
+// image has the artifacts its stage requires.
+func (p *PipelineState) Validate() error {
+	if !p.Stage.Valid() {
+		return fmt.Errorf("run %s has unknown stage %q", p.RunID, p.Stage)
+	}
+
+	for _, img := range p.Images {
+		if !img.Stage.Valid() {
+			return fmt.Errorf("image %s has unknown stage %q", img.Name, img.Stage)
+		}
+
+		switch img.Stage {
+		case StageUploading:
+			if img.ObjectName == "" || img.UploadID == "" {
+				return fmt.Errorf("image %s is %s but has no object name or upload ID", img.Name, img.Stage)
+			}
+		case StageUploadComplete:
+			if img.ObjectName == "" {
+				return fmt.Errorf("image %s is %s but has no object name", img.Name, img.Stage)
+			}
+		case StageImporting, StageComplete:
+			if img.ImageID == "" {
+				return fmt.Errorf("image %s is %s but has no image ID", img.Name, img.Stage)
+			}
+		}
+	}
+
+	return nil
+}
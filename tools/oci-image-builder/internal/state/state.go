@@ -2,31 +2,40 @@
 package state
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/gofrs/flock"
 	"github.com/pelletier/go-toml/v2"
+
+	"oci-image-builder/internal/fsutil"
+	"oci-image-builder/internal/logger"
+	"oci-image-builder/internal/progress"
 )
 
 // StageTimings tracks timing for all stages of an image build.
 // Note: Using time.Time (not *time.Time) because go-toml/v2 serializes pointer
 // times as quoted strings which fail to deserialize. Zero value means "not set".
 type StageTimings struct {
-	BuildStartedAt    time.Time `toml:"build_started_at,omitzero"`
-	BuildCompletedAt  time.Time `toml:"build_completed_at,omitzero"`
-	UploadStartedAt   time.Time `toml:"upload_started_at,omitzero"`
-	UploadCompletedAt time.Time `toml:"upload_completed_at,omitzero"`
-	ImportStartedAt   time.Time `toml:"import_started_at,omitzero"`
-	ImportCompletedAt time.Time `toml:"import_completed_at,omitzero"`
+	BuildStartedAt    time.Time `toml:"build_started_at,omitzero" json:"build_started_at,omitzero"`
+	BuildCompletedAt  time.Time `toml:"build_completed_at,omitzero" json:"build_completed_at,omitzero"`
+	UploadStartedAt   time.Time `toml:"upload_started_at,omitzero" json:"upload_started_at,omitzero"`
+	UploadCompletedAt time.Time `toml:"upload_completed_at,omitzero" json:"upload_completed_at,omitzero"`
+	ImportStartedAt   time.Time `toml:"import_started_at,omitzero" json:"import_started_at,omitzero"`
+	ImportCompletedAt time.Time `toml:"import_completed_at,omitzero" json:"import_completed_at,omitzero"`
 }
 
 // ImageMetrics tracks size and throughput metrics for an image.
 type ImageMetrics struct {
-	BuildSizeBytes  int64 `toml:"build_size_bytes,omitempty"`
-	UploadSizeBytes int64 `toml:"upload_size_bytes,omitempty"`
-	UploadParts     int   `toml:"upload_parts,omitempty"`
+	BuildSizeBytes  int64 `toml:"build_size_bytes,omitempty" json:"build_size_bytes,omitempty"`
+	UploadSizeBytes int64 `toml:"upload_size_bytes,omitempty" json:"upload_size_bytes,omitempty"`
+	UploadParts     int   `toml:"upload_parts,omitempty" json:"upload_parts,omitempty"`
 }
 
 // PipelineStatistics holds computed statistics for display.
@@ -54,55 +63,187 @@ type ImageStatistics struct {
 
 // ImageState tracks the state of a single image through the pipeline.
 type ImageState struct {
-	Name       string       `toml:"name"`
-	LocalPath  string       `toml:"local_path,omitempty"`  // Path to local qcow2
-	ObjectName string       `toml:"object_name,omitempty"` // Name in Object Storage
-	ImageID    string       `toml:"image_id,omitempty"`    // OCI Custom Image OCID
-	Stage      string       `toml:"stage"`                 // pending, build, upload, import, complete, error
-	Error      string       `toml:"error,omitempty"`
-	Timings    StageTimings `toml:"timings"`
-	Metrics    ImageMetrics `toml:"metrics"`
+	Name             string       `toml:"name" json:"name"`
+	LocalPath        string       `toml:"local_path,omitempty" json:"local_path,omitempty"`               // Path to local qcow2
+	ObjectName       string       `toml:"object_name,omitempty" json:"object_name,omitempty"`             // Name in Object Storage
+	SBOMPath         string       `toml:"sbom_path,omitempty" json:"sbom_path,omitempty"`                 // Local SBOM, if generated
+	SBOMObject       string       `toml:"sbom_object,omitempty" json:"sbom_object,omitempty"`             // SBOM in Object Storage
+	ProvenancePath   string       `toml:"provenance_path,omitempty" json:"provenance_path,omitempty"`     // Local in-toto provenance statement
+	ProvenanceObject string       `toml:"provenance_object,omitempty" json:"provenance_object,omitempty"` // Provenance statement in Object Storage
+	UploadID         string       `toml:"upload_id,omitempty" json:"upload_id,omitempty"`                 // Preserved multipart upload, if interrupted
+	ImageID          string       `toml:"image_id,omitempty" json:"image_id,omitempty"`                   // OCI Custom Image OCID
+	WorkRequestID    string       `toml:"work_request_id,omitempty" json:"work_request_id,omitempty"`     // Work request tracking the import
+	PARID            string       `toml:"par_id,omitempty" json:"par_id,omitempty"`                       // Pre-authenticated request for the import, until deleted
+	ObjectETag       string       `toml:"object_etag,omitempty" json:"object_etag,omitempty"`             // ETag of the verified object, checked again once imported
+	Stage            Stage        `toml:"stage" json:"stage"`
+	Error            string       `toml:"error,omitempty" json:"error,omitempty"`
+	Timings          StageTimings `toml:"timings" json:"timings"`
+	Metrics          ImageMetrics `toml:"metrics" json:"metrics"`
+
+	// Git is the checkout the image was rebuilt from on resume, if it
+	// differs from the run's.
+	Git *GitState `toml:"git,omitempty" json:"git,omitempty"`
 }
 
 // PipelineState tracks the overall pipeline state.
 type PipelineState struct {
-	RunID       string       `toml:"run_id"`
-	StartedAt   time.Time    `toml:"started_at"`
-	UpdatedAt   time.Time    `toml:"updated_at"`
-	CompletedAt time.Time    `toml:"completed_at,omitzero"`
-	Stage       string       `toml:"stage"` // Current overall stage
-	Images      []ImageState `toml:"images"`
-	Complete    bool         `toml:"complete"`
+	RunID       string        `toml:"run_id"`
+	Environment string        `toml:"environment,omitempty"`
+	StartedAt   time.Time     `toml:"started_at"`
+	UpdatedAt   time.Time     `toml:"updated_at"`
+	CompletedAt time.Time     `toml:"completed_at,omitzero"`
+	Stage       PipelineStage `toml:"stage"` // Current pipeline step
+	Images      []ImageState  `toml:"images"`
+	Complete    bool          `toml:"complete"`
+	Interrupted bool          `toml:"interrupted,omitempty"` // Run was canceled during Stage
+	LocalOnly   bool          `toml:"local_only,omitempty"`  // Images are built on this machine only
+
+	// Git is the checkout the run was started from. Nil for runs not built
+	// from a checkout, such as downloads registered by export.
+	Git *GitState `toml:"git,omitempty"`
+}
+
+// GitState records the git checkout a run was started from.
+type GitState struct {
+	Commit      string   `toml:"commit,omitempty" json:"commit,omitempty"`
+	ShortCommit string   `toml:"short_commit,omitempty" json:"short_commit,omitempty"`
+	Branch      string   `toml:"branch,omitempty" json:"branch,omitempty"` // Empty if HEAD is detached
+	Tags        []string `toml:"tags,omitempty" json:"tags,omitempty"`     // Tags pointing at Commit
+	Dirty       bool     `toml:"dirty,omitempty" json:"dirty,omitempty"`   // Tracked files had uncommitted changes
+	AllowDirty  bool     `toml:"allow_dirty,omitempty" json:"allow_dirty,omitempty"`
 }
 
-// Manager handles loading and saving pipeline state.
+// ErrLocked is returned by Lock when another run holds the state lock.
+var ErrLocked = errors.New("state is locked by another oci-image-builder run")
+
+// Manager handles loading and saving pipeline state. Each run is stored in
+// its own file under runs/, with an index summarizing all runs. It is safe
+// for concurrent use; state returned by its getters is a copy.
 type Manager struct {
-	statePath string
-	state     *PipelineState
+	Logger *logger.Logger
+
+	mu           sync.Mutex
+	environment  string
+	runsDir      string
+	indexPath    string
+	legacyPath   string // Single state.toml used before run history
+	lockPath     string
+	registryPath string // Promoted images, see Registry
+	exportsPath  string // Unfinished exports, see Exports
+	lock         *flock.Flock
+	state        *PipelineState
+
+	saverOnce    sync.Once
+	saveRequests chan struct{} // Pending background save, see saveLater
+	unsaved      bool          // Updates from HandleEvent not saved yet
 }
 
-// NewManager creates a new state manager.
-func NewManager() (*Manager, error) {
+// NewManager creates a new state manager. Each environment keeps its own
+// runs and lock; an empty environment uses the top-level state directory.
+func NewManager(environment string) (*Manager, error) {
 	cacheDir, err := os.UserCacheDir()
 	if err != nil {
 		cacheDir = "/tmp"
 	}
 
 	stateDir := filepath.Join(cacheDir, "oci-image-builder")
-	if err := os.MkdirAll(stateDir, 0755); err != nil {
+	if environment != "" {
+		stateDir = filepath.Join(stateDir, "environments", environment)
+	}
+	runsDir := filepath.Join(stateDir, "runs")
+	if err := os.MkdirAll(runsDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create state directory: %w", err)
 	}
 
 	return &Manager{
-		statePath: filepath.Join(stateDir, "state.toml"),
+		environment:  environment,
+		runsDir:      runsDir,
+		indexPath:    filepath.Join(runsDir, "index.toml"),
+		legacyPath:   filepath.Join(stateDir, "state.toml"),
+		lockPath:     filepath.Join(stateDir, "state.lock"),
+		registryPath: filepath.Join(stateDir, "registry.toml"),
+		exportsPath:  filepath.Join(stateDir, "exports.toml"),
+		Logger:       logger.New(),
 	}, nil
 }
 
-// Load loads the pipeline state from disk.
+// Lock acquires an advisory lock on the state directory, to be held for the
+// duration of a run. It fails with ErrLocked if another run holds it.
+func (m *Manager) Lock() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.lock != nil {
+		return nil
+	}
+
+	lock := flock.New(m.lockPath)
+	locked, err := lock.TryLock()
+	if err != nil {
+		return fmt.Errorf("failed to lock state directory: %w", err)
+	}
+	if !locked {
+		holder := "unknown pid"
+		if data, err := os.ReadFile(m.lockPath); err == nil && len(data) > 0 {
+			holder = "pid " + strings.TrimSpace(string(data))
+		}
+		return fmt.Errorf("%w (%s, lock file %s)", ErrLocked, holder, m.lockPath)
+	}
+
+	// Record our PID for the error message above; the lock is on the file
+	// itself, not its contents.
+	_ = os.WriteFile(m.lockPath, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+
+	m.lock = lock
+	return nil
+}
+
+// Unlock saves updates still waiting for a background save, then releases
+// the state directory lock acquired by Lock.
+func (m *Manager) Unlock() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.lock == nil {
+		return nil
+	}
+
+	// Callers defer Unlock and drop its error, so log it too
+	var err error
+	if m.unsaved {
+		if err = m.save(); err != nil {
+			m.Logger.Logf("Warning: failed to save stage timings: %v", err)
+		}
+	}
+	err = errors.Join(err, m.lock.Unlock())
+	m.lock = nil
+	return err
+}
+
+// Load loads the most recent run from disk. It returns nil if there are
+// no saved runs.
 func (m *Manager) Load() (*PipelineState, error) {
-	data, err := os.ReadFile(m.statePath)
+	runs, err := m.ListRuns()
+	if err != nil {
+		return nil, err
+	}
+	if len(runs) == 0 {
+		return nil, nil // No saved runs, fresh start
+	}
+
+	return m.LoadRun(runs[len(runs)-1].RunID)
+}
+
+// LoadRun loads the run with the given ID from disk and makes it the
+// manager's active run.
+func (m *Manager) LoadRun(runID string) (*PipelineState, error) {
+	if err := m.migrateLegacy(); err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(m.runPath(runID))
 	if os.IsNotExist(err) {
-		return nil, nil // No state file, fresh start
+		return nil, fmt.Errorf("run %s not found. Run 'state list' to see saved runs", runID)
 	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to read state file: %w", err)
@@ -112,36 +253,80 @@ func (m *Manager) Load() (*PipelineState, error) {
 	if err := toml.Unmarshal(data, &state); err != nil {
 		return nil, fmt.Errorf("failed to parse state file: %w", err)
 	}
+	if err := state.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid state file %s: %w", m.runPath(runID), err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
 	m.state = &state
-	return &state, nil
+	return state.clone(), nil
+}
+
+// clone returns a copy of the state that shares no mutable data with it.
+func (p *PipelineState) clone() *PipelineState {
+	c := *p
+	c.Images = append([]ImageState(nil), p.Images...)
+	if p.Git != nil {
+		git := *p.Git
+		git.Tags = append([]string(nil), p.Git.Tags...)
+		c.Git = &git
+	}
+	return &c
 }
 
-// NewRun creates a new pipeline run.
-func (m *Manager) NewRun(imageNames []string) *PipelineState {
+// NewRun creates a new pipeline run and saves it. Its ID is the start time
+// to the millisecond; a run file that already exists with that ID is never
+// overwritten.
+func (m *Manager) NewRun(imageNames []string) (*PipelineState, error) {
 	now := time.Now()
 	images := make([]ImageState, len(imageNames))
 	for i, name := range imageNames {
 		images[i] = ImageState{
 			Name:  name,
-			Stage: "pending",
+			Stage: StagePending,
 		}
 	}
 
+	runID := now.Format("20060102-150405.000")
+	if _, err := os.Stat(m.runPath(runID)); err == nil {
+		return nil, fmt.Errorf("run %s already exists", runID)
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to check for run %s: %w", runID, err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	m.state = &PipelineState{
-		RunID:     now.Format("20060102-150405"),
-		StartedAt: now,
-		UpdatedAt: now,
-		Stage:     "build",
-		Images:    images,
-		Complete:  false,
+		RunID:       runID,
+		Environment: m.environment,
+		StartedAt:   now,
+		UpdatedAt:   now,
+		Stage:       PipelineBuild,
+		Images:      images,
+		Complete:    false,
+	}
+	if err := m.save(); err != nil {
+		return nil, err
 	}
 
-	return m.state
+	return m.state.clone(), nil
 }
 
 // Save persists the current state to disk.
 func (m *Manager) Save() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.save()
+}
+
+// save writes the active run's file atomically and updates the run index,
+// so a crash never leaves a partially written state file.
+// The caller must hold m.mu.
+func (m *Manager) save() error {
 	if m.state == nil {
 		return nil
 	}
@@ -153,85 +338,161 @@ func (m *Manager) Save() error {
 		return fmt.Errorf("failed to marshal state: %w", err)
 	}
 
-	if err := os.WriteFile(m.statePath, data, 0644); err != nil {
+	if err := fsutil.WriteFileAtomic(m.runPath(m.state.RunID), data); err != nil {
 		return fmt.Errorf("failed to write state file: %w", err)
 	}
 
-	return nil
+	m.unsaved = false
+
+	return m.updateIndex(func(idx *runIndex) {
+		idx.upsert(m.state.summary())
+	})
 }
 
-// GetState returns the current state.
+// GetState returns a copy of the current state.
 func (m *Manager) GetState() *PipelineState {
-	return m.state
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.state == nil {
+		return nil
+	}
+	return m.state.clone()
 }
 
 // SetState sets the current state (for resuming).
 func (m *Manager) SetState(state *PipelineState) {
-	m.state = state
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.state = state.clone()
 }
 
 // CanResume checks if there's a resumable state.
 func (m *Manager) CanResume() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	return m.state != nil && !m.state.Complete
 }
 
-// GetImageState returns the state of a specific image.
+// GetImageState returns a copy of the state of a specific image.
 func (m *Manager) GetImageState(name string) *ImageState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	if m.state == nil {
 		return nil
 	}
 	for i := range m.state.Images {
 		if m.state.Images[i].Name == name {
-			return &m.state.Images[i]
+			img := m.state.Images[i]
+			return &img
 		}
 	}
 	return nil
 }
 
-// UpdateImage updates the state of a specific image.
+// UpdateImage updates the state of a specific image and saves it. It may be
+// called concurrently; updates are applied one at a time. An update that
+// moves the image to a stage not allowed from its current one is discarded
+// and an error returned.
 func (m *Manager) UpdateImage(name string, update func(*ImageState)) error {
+	return m.update(func(state *PipelineState) error {
+		for i := range state.Images {
+			if state.Images[i].Name == name {
+				before := state.Images[i]
+				update(&state.Images[i])
+				if next := state.Images[i].Stage; !before.Stage.CanTransition(next) {
+					state.Images[i] = before
+					return fmt.Errorf("image %s cannot move from stage %s to %s", name, before.Stage, next)
+				}
+				return nil
+			}
+		}
+		return fmt.Errorf("unknown image: %s", name)
+	})
+}
+
+// update applies fn to the active run under the lock and saves the result.
+func (m *Manager) update(fn func(*PipelineState) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	if m.state == nil {
 		return fmt.Errorf("no active run")
 	}
 
-	for i := range m.state.Images {
-		if m.state.Images[i].Name == name {
-			update(&m.state.Images[i])
-			return m.Save()
-		}
+	if err := fn(m.state); err != nil {
+		return err
 	}
-
-	return fmt.Errorf("unknown image: %s", name)
+	return m.save()
 }
 
 // SetStage sets the current pipeline stage.
-func (m *Manager) SetStage(stage string) error {
-	if m.state == nil {
-		return fmt.Errorf("no active run")
-	}
+func (m *Manager) SetStage(stage PipelineStage) error {
+	return m.update(func(state *PipelineState) error {
+		state.Stage = stage
+		return nil
+	})
+}
 
-	m.state.Stage = stage
-	return m.Save()
+// SetGit records the git checkout of the run.
+func (m *Manager) SetGit(git *GitState) error {
+	return m.update(func(state *PipelineState) error {
+		state.Git = git
+		return nil
+	})
+}
+
+// SetLocalOnly records whether images are built on this machine only, so
+// that a resumed run builds them the same way.
+func (m *Manager) SetLocalOnly(localOnly bool) error {
+	return m.update(func(state *PipelineState) error {
+		state.LocalOnly = localOnly
+		return nil
+	})
 }
 
 // MarkComplete marks the pipeline as complete.
 func (m *Manager) MarkComplete() error {
-	if m.state == nil {
-		return fmt.Errorf("no active run")
-	}
+	return m.update(func(state *PipelineState) error {
+		state.Complete = true
+		state.CompletedAt = time.Now()
+		return nil
+	})
+}
+
+// MarkInterrupted records that the run was canceled during its current
+// stage, so resume knows where to pick up.
+func (m *Manager) MarkInterrupted() error {
+	return m.update(func(state *PipelineState) error {
+		state.Interrupted = true
+		return nil
+	})
+}
 
-	m.state.Complete = true
-	m.state.CompletedAt = time.Now()
-	return m.Save()
+// ClearInterrupted clears the interrupted marker when a run is resumed.
+func (m *Manager) ClearInterrupted() error {
+	return m.update(func(state *PipelineState) error {
+		state.Interrupted = false
+		return nil
+	})
 }
 
-// Clear removes the state file.
+// Clear removes the active run from disk.
 func (m *Manager) Clear() error {
-	if err := os.Remove(m.statePath); err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("failed to remove state file: %w", err)
+	m.mu.Lock()
+	runID := ""
+	if m.state != nil {
+		runID = m.state.RunID
 	}
-	m.state = nil
-	return nil
+	m.mu.Unlock()
+
+	if runID == "" {
+		return nil
+	}
+	return m.RemoveRun(runID)
 }
 
 // ShouldSkipBuild checks if build can be skipped for an image.
@@ -240,26 +501,18 @@ func (m *Manager) ShouldSkipBuild(name string) bool {
 	if img == nil {
 		return false
 	}
-
-	// Skip if we have a local path and it exists
-	if img.LocalPath != "" {
-		if _, err := os.Stat(img.LocalPath); err == nil {
-			return true
-		}
-	}
-
-	return false
+	return img.ResumeStage() != PipelineBuild
 }
 
-// ShouldSkipUpload checks if upload can be skipped for an image.
+// ShouldSkipUpload checks if upload can be skipped for an image. Images that
+// still need building are not skipped; build them first.
 func (m *Manager) ShouldSkipUpload(name string) bool {
 	img := m.GetImageState(name)
 	if img == nil {
 		return false
 	}
-
-	// Skip if we have an object name (already uploaded)
-	return img.ObjectName != ""
+	stage := img.ResumeStage()
+	return stage != PipelineBuild && stage != PipelineUpload
 }
 
 // ShouldSkipImport checks if import can be skipped for an image.
@@ -268,13 +521,14 @@ func (m *Manager) ShouldSkipImport(name string) bool {
 	if img == nil {
 		return false
 	}
-
-	// Skip if we have an image ID (already imported or importing)
-	return img.ImageID != ""
+	return img.ResumeStage() == PipelineComplete
 }
 
 // GetObjectNames returns object names for images that have been uploaded.
 func (m *Manager) GetObjectNames() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	if m.state == nil {
 		return nil
 	}
@@ -290,6 +544,9 @@ func (m *Manager) GetObjectNames() []string {
 
 // GetImageIDs returns image IDs for images that have been imported.
 func (m *Manager) GetImageIDs() map[string]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	if m.state == nil {
 		return nil
 	}
@@ -303,78 +560,189 @@ func (m *Manager) GetImageIDs() map[string]string {
 	return ids
 }
 
-// StatePath returns the path to the state file.
+// StatePath returns the path to the active run's state file, or the runs
+// directory if no run is active.
 func (m *Manager) StatePath() string {
-	return m.statePath
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.state == nil {
+		return m.runsDir
+	}
+	return m.runPath(m.state.RunID)
 }
 
 // RecordStageStart records the start time for a stage.
-func (m *Manager) RecordStageStart(imageName, stage string) error {
-	now := time.Now()
-	return m.UpdateImage(imageName, func(img *ImageState) {
+func (m *Manager) RecordStageStart(imageName string, stage PipelineStage) error {
+	return m.UpdateImage(imageName, stageStarted(stage, time.Now()))
+}
+
+// RecordStageComplete records the completion time for a stage.
+func (m *Manager) RecordStageComplete(imageName string, stage PipelineStage) error {
+	return m.UpdateImage(imageName, stageCompleted(stage, time.Now()))
+}
+
+// RecordUploadMetrics records upload size and part count.
+func (m *Manager) RecordUploadMetrics(imageName string, sizeBytes int64, parts int) error {
+	return m.UpdateImage(imageName, uploadMetrics(sizeBytes, parts))
+}
+
+// RecordBuildMetrics records build output size.
+func (m *Manager) RecordBuildMetrics(imageName string, sizeBytes int64) error {
+	return m.UpdateImage(imageName, buildMetrics(sizeBytes))
+}
+
+func stageStarted(stage PipelineStage, at time.Time) func(*ImageState) {
+	return func(img *ImageState) {
 		switch stage {
-		case "build":
-			img.Timings.BuildStartedAt = now
-		case "upload":
-			img.Timings.UploadStartedAt = now
-		case "import":
-			img.Timings.ImportStartedAt = now
+		case PipelineBuild:
+			img.Timings.BuildStartedAt = at
+		case PipelineUpload:
+			img.Timings.UploadStartedAt = at
+		case PipelineImport:
+			img.Timings.ImportStartedAt = at
 		}
-	})
+	}
 }
 
-// RecordStageComplete records the completion time for a stage.
-func (m *Manager) RecordStageComplete(imageName, stage string) error {
-	now := time.Now()
-	return m.UpdateImage(imageName, func(img *ImageState) {
+func stageCompleted(stage PipelineStage, at time.Time) func(*ImageState) {
+	return func(img *ImageState) {
 		switch stage {
-		case "build":
-			img.Timings.BuildCompletedAt = now
-		case "upload":
-			img.Timings.UploadCompletedAt = now
-		case "import":
-			img.Timings.ImportCompletedAt = now
+		case PipelineBuild:
+			img.Timings.BuildCompletedAt = at
+		case PipelineUpload:
+			img.Timings.UploadCompletedAt = at
+		case PipelineImport:
+			img.Timings.ImportCompletedAt = at
 		}
-	})
+	}
 }
 
-// RecordUploadMetrics records upload size and part count.
-func (m *Manager) RecordUploadMetrics(imageName string, sizeBytes int64, parts int) error {
-	return m.UpdateImage(imageName, func(img *ImageState) {
+func uploadMetrics(sizeBytes int64, parts int) func(*ImageState) {
+	return func(img *ImageState) {
 		img.Metrics.UploadSizeBytes = sizeBytes
 		img.Metrics.UploadParts = parts
-	})
+	}
 }
 
-// RecordBuildMetrics records build output size.
-func (m *Manager) RecordBuildMetrics(imageName string, sizeBytes int64) error {
-	return m.UpdateImage(imageName, func(img *ImageState) {
+func buildMetrics(sizeBytes int64) func(*ImageState) {
+	return func(img *ImageState) {
 		img.Metrics.BuildSizeBytes = sizeBytes
+	}
+}
+
+// HandleEvent records stage timings and metrics from a progress event, so
+// statistics come from the same events as the progress display. Events for
+// images not in the active run are ignored. The state is saved in the
+// background rather than while the event bus waits; failures are logged.
+func (m *Manager) HandleEvent(e progress.Event) {
+	var updates []func(*ImageState)
+	var name string
+	switch e := e.(type) {
+	case *progress.StageStarted:
+		name = e.Image
+		updates = append(updates, stageStarted(PipelineStage(e.Stage), e.Time))
+	case *progress.StageCompleted:
+		name = e.Image
+		updates = append(updates, stageCompleted(PipelineStage(e.Stage), e.Time))
+		if e.Stage == progress.StageBuild {
+			updates = append(updates, buildMetrics(e.Bytes))
+		}
+	case *progress.UploadStarted:
+		name = e.Image
+		updates = append(updates, uploadMetrics(e.TotalBytes, e.TotalParts))
+	}
+	if len(updates) == 0 {
+		return
+	}
+
+	m.mu.Lock()
+	found := false
+	if m.state != nil {
+		for i := range m.state.Images {
+			if m.state.Images[i].Name == name {
+				for _, update := range updates {
+					update(&m.state.Images[i])
+				}
+				found = true
+				break
+			}
+		}
+	}
+	m.unsaved = m.unsaved || found
+	m.mu.Unlock()
+
+	if found {
+		m.saveLater()
+	}
+}
+
+// saveLater saves the state in a background goroutine. Saves requested
+// while one is in progress are coalesced into the next; Unlock saves any
+// still pending.
+func (m *Manager) saveLater() {
+	m.saverOnce.Do(func() {
+		m.saveRequests = make(chan struct{}, 1)
+		go func() {
+			for range m.saveRequests {
+				if err := m.saveUnsaved(); err != nil {
+					m.Logger.Logf("Warning: failed to save stage timings: %v", err)
+				}
+			}
+		}()
 	})
+	select {
+	case m.saveRequests <- struct{}{}:
+	default:
+	}
+}
+
+// saveUnsaved saves the state if it has updates not saved yet, which
+// Unlock or another save may already have written.
+func (m *Manager) saveUnsaved() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.unsaved {
+		return nil
+	}
+	return m.save()
+}
+
+// SetLogFunc sets the logging function for warnings.
+func (m *Manager) SetLogFunc(fn func(string)) {
+	m.Logger.SetLogFunc(fn)
 }
 
 // GetStatistics computes statistics from the current state.
 func (m *Manager) GetStatistics() *PipelineStatistics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	if m.state == nil {
 		return nil
 	}
+	return m.state.Statistics()
+}
 
+// Statistics computes statistics for a pipeline run.
+func (p *PipelineState) Statistics() *PipelineStatistics {
 	stats := &PipelineStatistics{
-		RunID:      m.state.RunID,
-		ImageStats: make([]ImageStatistics, 0, len(m.state.Images)),
+		RunID:      p.RunID,
+		ImageStats: make([]ImageStatistics, 0, len(p.Images)),
 	}
 
 	// Calculate total duration
-	if !m.state.CompletedAt.IsZero() {
-		stats.TotalDuration = m.state.CompletedAt.Sub(m.state.StartedAt)
+	if !p.CompletedAt.IsZero() {
+		stats.TotalDuration = p.CompletedAt.Sub(p.StartedAt)
 	} else {
-		stats.TotalDuration = m.state.UpdatedAt.Sub(m.state.StartedAt)
+		stats.TotalDuration = p.UpdatedAt.Sub(p.StartedAt)
 	}
 
 	var totalUploadBytes int64
 	var totalUploadDuration time.Duration
 
-	for _, img := range m.state.Images {
+	for _, img := range p.Images {
 		imgStats := ImageStatistics{Name: img.Name}
 
 		// Build duration
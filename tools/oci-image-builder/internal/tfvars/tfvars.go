@@ -0,0 +1,136 @@
+// Package tfvars updates variable assignments in terraform.tfvars files.
+package tfvars
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"oci-image-builder/internal/fsutil"
+)
+
+// assignment matches a `name = ...` line; it is only an assignment of a
+// variable when not nested in a map, list or heredoc.
+var assignment = regexp.MustCompile(`^\s*([A-Za-z_][A-Za-z0-9_-]*)\s*=`)
+
+// heredocStart matches the opening of a heredoc, e.g. `<<EOT` or `<<-EOT`.
+var heredocStart = regexp.MustCompile(`^<<-?([A-Za-z_][A-Za-z0-9_]*)\s*$`)
+
+// Update sets each variable in values to a quoted string in the tfvars file
+// at path. Existing top-level assignments are replaced in place, keeping a
+// trailing comment; other lines are kept as is, and new variables are
+// appended. The file is created if missing and replaced atomically.
+func Update(path string, values map[string]string) error {
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	var lines []string
+	if len(data) > 0 {
+		lines = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	}
+
+	var (
+		out     []string
+		s       scanner
+		written = make(map[string]bool, len(values))
+	)
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		topLevel := s.depth == 0 && s.heredoc == ""
+		comment := s.scan(line)
+
+		m := assignment.FindStringSubmatch(line)
+		value, ok := "", false
+		if topLevel && m != nil {
+			value, ok = values[m[1]]
+		}
+		if !ok {
+			out = append(out, line)
+			continue
+		}
+
+		// Drop the rest of a value that spans several lines
+		for (s.depth > 0 || s.heredoc != "") && i+1 < len(lines) {
+			i++
+			s.scan(lines[i])
+		}
+
+		replaced := fmt.Sprintf("%s = %q", m[1], value)
+		if comment >= 0 {
+			replaced += " " + line[comment:]
+		}
+		out = append(out, replaced)
+		written[m[1]] = true
+	}
+
+	var missing []string
+	for name := range values {
+		if !written[name] {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	for _, name := range missing {
+		out = append(out, fmt.Sprintf("%s = %q", name, values[name]))
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %w", path, err)
+	}
+	if err := fsutil.WriteFileAtomic(path, []byte(strings.Join(out, "\n")+"\n")); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+// scanner tracks the nesting of maps, lists and heredocs across lines.
+type scanner struct {
+	depth   int
+	heredoc string // Closing marker of the heredoc being read, if any
+}
+
+// scan advances over a line and returns the index of the comment at its
+// end, or -1 if there is none.
+func (s *scanner) scan(line string) int {
+	if s.heredoc != "" {
+		if strings.TrimSpace(line) == s.heredoc {
+			s.heredoc = ""
+		}
+		return -1
+	}
+
+	inString := false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		if inString {
+			switch c {
+			case '\\':
+				i++
+			case '"':
+				inString = false
+			}
+			continue
+		}
+		switch {
+		case c == '"':
+			inString = true
+		case c == '#', strings.HasPrefix(line[i:], "//"), strings.HasPrefix(line[i:], "/*"):
+			return i
+		case c == '{', c == '[':
+			s.depth++
+		case c == '}', c == ']':
+			s.depth = max(s.depth-1, 0)
+		case c == '<':
+			if m := heredocStart.FindStringSubmatch(line[i:]); m != nil {
+				s.heredoc = m[1]
+				return -1
+			}
+		}
+	}
+	return -1
+}
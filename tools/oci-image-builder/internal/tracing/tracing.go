@@ -0,0 +1,122 @@
+// Package tracing exports OpenTelemetry traces of pipeline runs over
+// OTLP/HTTP. Until Setup is called, spans are discarded.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/oracle/oci-go-sdk/v65/common"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ServiceName is the service.name resource attribute of exported spans.
+const ServiceName = "oci-image-builder"
+
+// Setup installs a global tracer provider exporting to an OTLP/HTTP
+// collector at endpoint, e.g. http://localhost:4318. Spans are sent to
+// /v1/traces unless the endpoint has another path. The returned function
+// flushes pending spans and must be called before exiting.
+func Setup(ctx context.Context, endpoint string) (func(context.Context) error, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trace endpoint: %w", err)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(u.String()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace exporter: %w", err)
+	}
+
+	res := resource.NewSchemaless(attribute.String("service.name", ServiceName))
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+
+	return func(ctx context.Context) error {
+		if err := provider.Shutdown(ctx); err != nil {
+			return fmt.Errorf("failed to export traces: %w", err)
+		}
+		return nil
+	}, nil
+}
+
+// Start starts a span as a child of the span in ctx, if any.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(ServiceName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End records err, if any, on span and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Image returns the attribute naming the image a span belongs to.
+func Image(name string) attribute.KeyValue {
+	return attribute.String("image.name", name)
+}
+
+// dispatcher traces each HTTP request an OCI SDK client makes.
+type dispatcher struct {
+	next common.HTTPRequestDispatcher
+}
+
+// Dispatcher wraps an OCI SDK client's HTTP dispatcher so each request,
+// including each retry of an operation, gets its own span.
+func Dispatcher(next common.HTTPRequestDispatcher) common.HTTPRequestDispatcher {
+	return &dispatcher{next: next}
+}
+
+// Do implements common.HTTPRequestDispatcher.
+func (d *dispatcher) Do(req *http.Request) (*http.Response, error) {
+	// Hosts are <service>.<region>.oraclecloud.com
+	service, _, _ := strings.Cut(req.URL.Hostname(), ".")
+	name := service + " " + req.Method
+	attrs := []attribute.KeyValue{
+		attribute.String("http.request.method", req.Method),
+		attribute.String("server.address", req.URL.Hostname()),
+		attribute.String("url.path", req.URL.Path),
+	}
+	if part := req.URL.Query().Get("uploadPartNum"); part != "" {
+		name += " part " + part
+		attrs = append(attrs, attribute.String("oci.upload_part_num", part))
+	}
+
+	ctx, span := otel.Tracer(ServiceName).Start(req.Context(), name,
+		trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+	defer span.End()
+
+	resp, err := d.next.Do(req.WithContext(ctx))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return resp, err
+	}
+
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	if id := resp.Header.Get("opc-request-id"); id != "" {
+		span.SetAttributes(attribute.String("oci.request_id", id))
+	}
+	if resp.StatusCode >= 400 {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+	return resp, nil
+}
@@ -3,26 +3,97 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/spf13/cobra"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/term"
 
 	"oci-image-builder/internal/build"
 	"oci-image-builder/internal/config"
+	"oci-image-builder/internal/dashboard"
+	"oci-image-builder/internal/git"
+	"oci-image-builder/internal/hooks"
+	"oci-image-builder/internal/logger"
+	"oci-image-builder/internal/metrics"
 	"oci-image-builder/internal/oci"
+	"oci-image-builder/internal/progress"
+	"oci-image-builder/internal/provenance"
 	"oci-image-builder/internal/state"
+	"oci-image-builder/internal/tfvars"
+	"oci-image-builder/internal/tracing"
 )
 
 var (
 	cfgFile string
+	envName string
 	verbose bool
 	logFile string
+	sets    []string
 )
 
+// metricsPushTimeout bounds pushing metrics to the Pushgateway.
+const metricsPushTimeout = 30 * time.Second
+
+// tracingFlushTimeout bounds exporting the remaining spans of a run.
+const tracingFlushTimeout = 30 * time.Second
+
+// events carries progress from the Builder and oci.Client to the CLI, the
+// run state and the dashboard.
+var events = progress.NewBus()
+
+// console prints the log of pipeline runs: the CLI's own messages and the
+// logs of the Builder, oci.Client and hooks. The dashboard takes it over
+// while it is shown.
+var console = newConsole()
+
+// newConsole returns a logger that prints to stdout.
+func newConsole() *logger.Logger {
+	l := logger.New()
+	l.SetLogFunc(printLine)
+	return l
+}
+
+// printLine prints a log message to stdout.
+func printLine(msg string) {
+	fmt.Println(msg)
+}
+
+// overrideFlags maps the root command's shortcut flags to config keys.
+var overrideFlags = []struct{ flag, key, usage string }{
+	{"compartment", "oci.compartment_ocid", "compartment OCID (overrides oci.compartment_ocid)"},
+	{"bucket", "oci.bucket_name", "Object Storage bucket (overrides oci.bucket_name)"},
+	{"region", "oci.region", "OCI region (overrides oci.region)"},
+	{"profile", "oci.profile", "OCI CLI profile (overrides oci.profile)"},
+}
+
 func main() {
-	if err := rootCmd.Execute(); err != nil {
+	// Cancel the root context on Ctrl-C or SIGTERM so builds, uploads and
+	// waits can stop cleanly and save state. Once canceled, the default
+	// handlers are restored so a second signal exits immediately.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	events.Subscribe(renderEvent)
+
+	err := rootCmd.ExecuteContext(ctx)
+	stop()
+	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
@@ -43,18 +114,66 @@ func init() {
 	rootCmd.PersistentFlags().StringVarP(&cfgFile, "config", "c", "", "config file (default: ~/.config/oci-image-builder/config.toml)")
 	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "verbose output")
 	rootCmd.PersistentFlags().StringVarP(&logFile, "log-file", "l", "", "log file path")
+	rootCmd.PersistentFlags().StringVarP(&envName, "env", "e", "", "environment from [environments] (default: default_environment)")
+	rootCmd.PersistentFlags().StringArrayVar(&sets, "set", nil, "set a config field, e.g. --set oci.poll_interval_secs=10 (repeatable)")
+	for _, f := range overrideFlags {
+		rootCmd.PersistentFlags().String(f.flag, "", f.usage)
+	}
 
 	buildCmd.Flags().Bool("local-only", false, "build all images locally (skip remote ARM64 builder)")
 	buildCmd.Flags().Bool("build-only", false, "skip upload after build")
+	buildCmd.Flags().Bool("allow-dirty", false, "upload from a dirty tree or untagged commit")
+	uploadCmd.Flags().Bool("allow-dirty", false, "upload from a dirty tree or untagged commit")
+	importCmd.Flags().Bool("allow-dirty", false, "import objects built from a dirty tree or untagged commit")
+	verifyReproCmd.Flags().Bool("remote", false, "build the second time on the remote builder instead of rebuilding locally")
 	allCmd.Flags().Bool("local-only", false, "build all images locally")
-	listCmd.Flags().String("prefix", "", "filter by name prefix")
+	allCmd.Flags().Bool("dashboard", false, "show a full-screen progress dashboard (only when stdout is a terminal)")
+	allCmd.Flags().Bool("allow-dirty", false, "upload and import from a dirty tree or untagged commit")
+	resumeCmd.Flags().Bool("dashboard", false, "show a full-screen progress dashboard (only when stdout is a terminal)")
+	resumeCmd.Flags().Bool("allow-dirty", false, "upload and import even though the run was started from a dirty tree or untagged commit, and rebuild from a changed checkout")
+	listCmd.Flags().String("prefix", "", "filter by display name prefix")
+	listCmd.Flags().String("match", "", "filter by display name glob, e.g. 'derp-*-2024*'")
+	listCmd.Flags().StringArray("tag", nil, "filter by freeform tag, as key=value or key (repeatable)")
+	listCmd.Flags().String("sort", "created", "sort by \"created\" (newest first) or \"name\"")
+	listCmd.Flags().Bool("reverse", false, "reverse the sort order")
+	listCmd.Flags().Bool("in-use", false, "show the instances launched from each image")
+	listCmd.Flags().StringArray("compartment", nil, "also look for instances in this compartment OCID with --in-use (repeatable)")
+	listCmd.Flags().Bool("shapes", false, "show the shapes each image is compatible with")
+	statsCmd.Flags().String("compare", "", "compare against another run ID")
+	exportCmd.Flags().String("object", "", "object name in the bucket (default: exports/<display name>.qcow2)")
+	exportCmd.Flags().Bool("download", false, "download the exported qcow2 and register it in state as a build result")
+	exportCmd.Flags().String("output-dir", "exports", "directory to download exported images into")
+	exportCmd.Flags().String("name", "", "image name to register the download under (default: from the display name)")
+	promoteCmd.Flags().String("name", "", "image name to promote for (default: from the display name)")
+	statusCmd.Flags().Bool("watch", false, "refresh until all images are AVAILABLE or failed")
+	statusCmd.Flags().Duration("interval", 10*time.Second, "refresh interval for --watch")
+	pruneCmd.Flags().Int("keep", 3, "number of newest images to keep per image name")
+	pruneCmd.Flags().Bool("dry-run", false, "show which images would be deleted without deleting them")
+	configShowCmd.Flags().Bool("resolved", false, "show the effective value and source of every field")
+
+	configValidateCmd.Flags().Bool("no-flake", false, "skip checking flake targets with 'nix flake show'")
+	configValidateCmd.Flags().String("flake", ".", "flake reference the image flake targets belong to")
+
+	configCmd.AddCommand(configShowCmd)
+	configCmd.AddCommand(configValidateCmd)
+
+	stateCmd.AddCommand(stateListCmd)
+	stateCmd.AddCommand(stateShowCmd)
+	stateCmd.AddCommand(stateRmCmd)
 
 	rootCmd.AddCommand(initCmd)
+	rootCmd.AddCommand(configCmd)
 	rootCmd.AddCommand(buildCmd)
+	rootCmd.AddCommand(verifyReproCmd)
+	rootCmd.AddCommand(ensureBucketCmd)
 	rootCmd.AddCommand(uploadCmd)
 	rootCmd.AddCommand(importCmd)
 	rootCmd.AddCommand(allCmd)
+	rootCmd.AddCommand(exportCmd)
 	rootCmd.AddCommand(listCmd)
+	rootCmd.AddCommand(pruneCmd)
+	rootCmd.AddCommand(promoteCmd)
+	rootCmd.AddCommand(rollbackCmd)
 	rootCmd.AddCommand(statusCmd)
 	rootCmd.AddCommand(stateCmd)
 	rootCmd.AddCommand(resumeCmd)
@@ -75,6 +194,113 @@ var initCmd = &cobra.Command{
 	},
 }
 
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect configuration",
+}
+
+var configShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Show the configuration file",
+	Long: `Show the configuration file. With --resolved, show the effective value of
+every field after applying defaults, the config file, the selected
+environment, OCI_IMAGE_BUILDER_* environment variables and flags, along
+with where each value came from. Secret values are redacted in both forms.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		resolved, _ := cmd.Flags().GetBool("resolved")
+
+		cfg, err := loadConfig()
+		if err != nil {
+			return err
+		}
+
+		path := cfg.Path()
+		if path == "" {
+			path = "(none)"
+		}
+
+		if !resolved {
+			if cfg.Path() == "" {
+				return fmt.Errorf("no config file found. Run 'oci-image-builder init' to create one")
+			}
+			data, err := os.ReadFile(cfg.Path())
+			if err != nil {
+				return fmt.Errorf("failed to read config file: %w", err)
+			}
+			fmt.Printf("# %s\n%s", path, config.RedactFile(data))
+			return nil
+		}
+
+		fmt.Printf("Config file: %s\n", path)
+		if cfg.Environment != "" {
+			fmt.Printf("Environment: %s\n", cfg.Environment)
+		}
+		fmt.Println()
+
+		fields := cfg.Fields()
+		width := 0
+		for _, f := range fields {
+			width = max(width, len(f.Key))
+		}
+		for _, f := range fields {
+			fmt.Printf("%-*s = %-40s # %s\n", width, f.Key, f.Value, f.Source)
+		}
+
+		return nil
+	},
+}
+
+var configValidateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Validate the configuration",
+	Long: `Validate the resolved configuration and report every problem found, with
+file and line positions. Unless --no-flake is given, also checks that each
+image's flake target exists using 'nix flake show'. Exits non-zero if the
+configuration is invalid, for use in CI.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		noFlake, _ := cmd.Flags().GetBool("no-flake")
+		flakeRef, _ := cmd.Flags().GetString("flake")
+
+		cfg, err := loadConfig()
+		if err != nil {
+			return reportInvalidConfig(err)
+		}
+
+		if !noFlake {
+			outputs, err := build.FlakeOutputs(cmd.Context(), flakeRef)
+			if err != nil {
+				return err
+			}
+			if err := cfg.CheckFlakeTargets(outputs); err != nil {
+				return reportInvalidConfig(err)
+			}
+		}
+
+		path := cfg.Path()
+		if path == "" {
+			path = "(no config file)"
+		}
+		fmt.Printf("%s: OK (%d images)\n", path, len(cfg.Images))
+		return nil
+	},
+}
+
+// reportInvalidConfig prints each configuration problem on its own line and
+// returns a short error, or returns err unchanged if it is not a validation
+// error.
+func reportInvalidConfig(err error) error {
+	var verr *config.ValidationError
+	if !errors.As(err, &verr) {
+		return err
+	}
+	for _, d := range verr.Diagnostics {
+		fmt.Println(d)
+	}
+	return fmt.Errorf("configuration is invalid (%d problems)", len(verr.Diagnostics))
+}
+
 var buildCmd = &cobra.Command{
 	Use:   "build [IMAGE...]",
 	Short: "Build NixOS images",
@@ -82,8 +308,9 @@ var buildCmd = &cobra.Command{
 	RunE: func(cmd *cobra.Command, args []string) error {
 		localOnly, _ := cmd.Flags().GetBool("local-only")
 		buildOnly, _ := cmd.Flags().GetBool("build-only")
+		allowDirty, _ := cmd.Flags().GetBool("allow-dirty")
 
-		cfg, err := config.Load(cfgFile)
+		cfg, err := loadConfig()
 		if err != nil {
 			return err
 		}
@@ -95,7 +322,66 @@ var buildCmd = &cobra.Command{
 			return err
 		}
 
-		return runBuild(cfg, imageNames, localOnly, buildOnly)
+		return runBuild(cmd.Context(), cfg, imageNames, localOnly, buildOnly, allowDirty)
+	},
+}
+
+var verifyReproCmd = &cobra.Command{
+	Use:   "verify-repro IMAGE",
+	Short: "Check that an image builds reproducibly",
+	Long: `Build an image twice and compare the SHA-256 of the qcow2 files and the
+Nix output hashes. The first build is local. By default the image derivation
+is then rebuilt locally with 'nix build --rebuild', against the dependencies
+already in the store; with --remote the image is built again on the remote
+builder and the NAR hashes of the whole closures are compared. The builds
+are linked as result-<image>-repro, leaving the result-<image> that upload
+reads untouched.
+
+If the builds differ, the differing store paths are listed, and for a local
+rebuild the two qcow2 files are compared with diffoscope when it is in PATH.
+The command fails if the builds differ.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		remote, _ := cmd.Flags().GetBool("remote")
+
+		cfg, err := loadConfig()
+		if err != nil {
+			return err
+		}
+		if cfg.GetImage(args[0]) == nil {
+			return fmt.Errorf("unknown image: %s", args[0])
+		}
+		if err := build.CheckPrerequisites(remote); err != nil {
+			return err
+		}
+
+		mode := build.ReproRebuild
+		if remote {
+			mode = build.ReproRemote
+		}
+		return runVerifyRepro(cmd.Context(), cfg, args[0], mode)
+	},
+}
+
+var ensureBucketCmd = &cobra.Command{
+	Use:   "ensure-bucket",
+	Short: "Create or update the upload bucket",
+	Long: `Create the upload bucket if it does not exist, and bring it in line with
+the [bucket] settings: storage tier (on creation), versioning off, the Vault
+encryption key, and the lifecycle rule for objects of imported images.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := loadConfig()
+		if err != nil {
+			return err
+		}
+
+		client, err := newClient(cfg)
+		if err != nil {
+			return err
+		}
+
+		return client.EnsureBucket(cmd.Context(), true)
 	},
 }
 
@@ -103,31 +389,34 @@ var uploadCmd = &cobra.Command{
 	Use:   "upload [IMAGE...]",
 	Short: "Upload previously built images to OCI",
 	RunE: func(cmd *cobra.Command, args []string) error {
-		cfg, err := config.Load(cfgFile)
+		allowDirty, _ := cmd.Flags().GetBool("allow-dirty")
+
+		cfg, err := loadConfig()
 		if err != nil {
 			return err
 		}
 
 		imageNames := normalizeImages(args, cfg)
-		return runUpload(cfg, imageNames)
+		return runUpload(cmd.Context(), cfg, imageNames, allowDirty)
 	},
 }
 
 var importCmd = &cobra.Command{
 	Use:   "import [OBJECT...]",
 	Short: "Import images from Object Storage to OCI Compute",
-	Long:  "Import images from Object Storage (e.g., headscale-20240115.qcow2)",
+	Long:  "Import images from Object Storage (e.g., headscale-20240115.qcow2). With [signing] configured, each object's signed manifest and SHA-256 are checked first and unsigned or mismatched objects are refused. Objects built from a dirty tree or an untagged commit are refused unless --allow-dirty is given; without signing, the commit in the object name is looked up in this clone and must be tagged.",
 	RunE: func(cmd *cobra.Command, args []string) error {
 		if len(args) == 0 {
 			return fmt.Errorf("at least one object name is required")
 		}
+		allowDirty, _ := cmd.Flags().GetBool("allow-dirty")
 
-		cfg, err := config.Load(cfgFile)
+		cfg, err := loadConfig()
 		if err != nil {
 			return err
 		}
 
-		return runImport(cfg, args)
+		return runImport(cmd.Context(), cfg, args, allowDirty)
 	},
 }
 
@@ -136,8 +425,10 @@ var allCmd = &cobra.Command{
 	Short: "Run all stages: build, upload, import",
 	RunE: func(cmd *cobra.Command, args []string) error {
 		localOnly, _ := cmd.Flags().GetBool("local-only")
+		dash, _ := cmd.Flags().GetBool("dashboard")
+		allowDirty, _ := cmd.Flags().GetBool("allow-dirty")
 
-		cfg, err := config.Load(cfgFile)
+		cfg, err := loadConfig()
 		if err != nil {
 			return err
 		}
@@ -149,63 +440,181 @@ var allCmd = &cobra.Command{
 			return err
 		}
 
-		return runAll(cfg, imageNames, localOnly)
+		return runAll(cmd.Context(), cfg, imageNames, localOnly, dash, allowDirty)
+	},
+}
+
+var exportCmd = &cobra.Command{
+	Use:   "export IMAGE_OCID",
+	Short: "Export a custom image to Object Storage and optionally download it",
+	Long: `Export a custom image as a qcow2 object in the upload bucket and wait for
+the export to finish. An export that was interrupted or timed out is
+resumed when the command is run again for the same image. With --download
+the object is also downloaded into --output-dir; an interrupted download
+continues where it stopped when the command is run again. The downloaded
+image is registered as a new run with the image built, so 'resume' uploads
+and imports it, e.g. into another environment.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		objectName, _ := cmd.Flags().GetString("object")
+		download, _ := cmd.Flags().GetBool("download")
+		outputDir, _ := cmd.Flags().GetString("output-dir")
+		name, _ := cmd.Flags().GetString("name")
+
+		cfg, err := loadConfig()
+		if err != nil {
+			return err
+		}
+
+		return runExport(cmd.Context(), cfg, args[0], objectName, download, outputDir, name)
 	},
 }
 
 var listCmd = &cobra.Command{
 	Use:   "list",
 	Short: "List images in OCI compartment",
+	Long: `List custom images of the selected environment, newest first, with their
+size, operating system, tags and whether they are the current or previous
+image set by promote. --shapes adds the shapes each image is compatible
+with. --in-use adds the instances launched from each image, to show which
+images are safe to delete; instances are looked for in the compartments of
+[oci], [import] and every environment, and in those given by --compartment.`,
+	Args: cobra.NoArgs,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		prefix, _ := cmd.Flags().GetString("prefix")
+		var opts listOptions
+		opts.prefix, _ = cmd.Flags().GetString("prefix")
+		opts.match, _ = cmd.Flags().GetString("match")
+		opts.tags, _ = cmd.Flags().GetStringArray("tag")
+		opts.sortBy, _ = cmd.Flags().GetString("sort")
+		opts.reverse, _ = cmd.Flags().GetBool("reverse")
+		opts.inUse, _ = cmd.Flags().GetBool("in-use")
+		opts.compartments, _ = cmd.Flags().GetStringArray("compartment")
+		opts.shapes, _ = cmd.Flags().GetBool("shapes")
+
+		if opts.sortBy != "created" && opts.sortBy != "name" {
+			return fmt.Errorf("--sort must be \"created\" or \"name\", got %q", opts.sortBy)
+		}
+		if opts.match != "" {
+			if _, err := path.Match(opts.match, ""); err != nil {
+				return fmt.Errorf("invalid --match pattern %q: %w", opts.match, err)
+			}
+		}
 
-		cfg, err := config.Load(cfgFile)
+		cfg, err := loadConfig()
 		if err != nil {
 			return err
 		}
 
-		client, err := oci.NewClient(cfg)
+		return runList(cmd.Context(), cfg, opts)
+	},
+}
+
+var promoteCmd = &cobra.Command{
+	Use:   "promote IMAGE_OCID",
+	Short: "Make an image the current one for its image name",
+	Long: `Make an AVAILABLE image the current image of its image name. The image is
+tagged current and the image it replaces is tagged previous, in OCI and in
+the local registry, and the terraform variable is updated.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name, _ := cmd.Flags().GetString("name")
+
+		cfg, err := loadConfig()
 		if err != nil {
 			return err
 		}
 
-		images, err := client.ListImages(context.Background(), prefix)
+		return runPromote(cmd.Context(), cfg, args[0], name)
+	},
+}
+
+var rollbackCmd = &cobra.Command{
+	Use:   "rollback NAME",
+	Short: "Make the previous image of an image name current again",
+	Long: `Swap the current and previous images of an image name, so the previous
+image is live again, and update the terraform variable. Running rollback
+twice returns to the original image.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := loadConfig()
 		if err != nil {
 			return err
 		}
 
-		for _, img := range images {
-			fmt.Printf("%s\t%s\t%s\n", img.ID, img.DisplayName, img.LifecycleState)
-		}
-
-		return nil
+		return runRollback(cmd.Context(), cfg, args[0])
 	},
 }
 
-var statusCmd = &cobra.Command{
-	Use:   "status [OCID...]",
-	Short: "Check image lifecycle states",
+var pruneCmd = &cobra.Command{
+	Use:   "prune [IMAGE...]",
+	Short: "Delete old custom images, keeping the newest of each",
+	Long:  "Delete old custom images of the selected environment, keeping the newest --keep AVAILABLE images per image name and environment tag and the current and previous images set by promote. With [environments] configured, an environment must be selected with --env or default_environment, so that prune never deletes images of another environment. If no images specified, prunes all.",
 	RunE: func(cmd *cobra.Command, args []string) error {
-		if len(args) == 0 {
-			return fmt.Errorf("at least one image OCID is required")
+		keep, _ := cmd.Flags().GetInt("keep")
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		if keep < 1 {
+			return fmt.Errorf("--keep must be at least 1")
 		}
 
-		cfg, err := config.Load(cfgFile)
+		cfg, err := loadConfig()
 		if err != nil {
 			return err
 		}
 
+		if names := cfg.EnvironmentNames(); cfg.Environment == "" && len(names) > 0 {
+			return fmt.Errorf("no environment selected; use --env to choose which images to prune (configured: %s)", strings.Join(names, ", "))
+		}
+
 		client, err := oci.NewClient(cfg)
 		if err != nil {
 			return err
 		}
 
-		for _, id := range args {
-			status, err := client.GetImageStatus(context.Background(), id)
-			if err != nil {
-				fmt.Printf("%s: error - %v\n", id, err)
-			} else {
-				fmt.Printf("%s: %s\n", id, status)
+		ctx := cmd.Context()
+		images, err := client.ListImages(ctx, "")
+		if err != nil {
+			return err
+		}
+
+		// Newest first, so everything past the first keep images goes
+		sort.SliceStable(images, func(i, j int) bool {
+			ti, tj := images[i].TimeCreated, images[j].TimeCreated
+			if ti == nil || tj == nil {
+				return ti != nil
+			}
+			return ti.After(*tj)
+		})
+
+		if cfg.Environment != "" {
+			fmt.Printf("Environment: %s\n", cfg.Environment)
+		}
+
+		for _, name := range normalizeImages(args, cfg) {
+			prefix := name + "-nixos-"
+			// Images tagged by an environment since removed from the
+			// config are counted separately
+			kept := make(map[string]int)
+			for _, img := range images {
+				if !strings.HasPrefix(img.DisplayName, prefix) || img.LifecycleState != "AVAILABLE" {
+					continue
+				}
+				if env := img.FreeformTags[config.EnvironmentTagKey]; kept[env] < keep {
+					kept[env]++
+					continue
+				}
+				if pointer := img.FreeformTags[oci.PointerTagKey]; pointer != "" {
+					fmt.Printf("Keeping %s\t%s (%s)\n", img.ID, img.DisplayName, pointer)
+					continue
+				}
+
+				if dryRun {
+					fmt.Printf("Would delete %s\t%s\n", img.ID, img.DisplayName)
+					continue
+				}
+				if err := client.DeleteImage(ctx, img.ID); err != nil {
+					return err
+				}
+				fmt.Printf("Deleted %s\t%s\n", img.ID, img.DisplayName)
 			}
 		}
 
@@ -213,11 +622,37 @@ var statusCmd = &cobra.Command{
 	},
 }
 
+var statusCmd = &cobra.Command{
+	Use:   "status [IMAGE|OCID...]",
+	Short: "Check image lifecycle states and import progress",
+	Long: `Show the lifecycle state, import progress and work request status of
+images. Images may be given as OCIDs or image names; a name is resolved to
+its image in the last run, else its current image set by promote, else its
+newest image. Without arguments, the images of the last run are shown.
+--watch refreshes the table until every image has settled.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		watch, _ := cmd.Flags().GetBool("watch")
+		interval, _ := cmd.Flags().GetDuration("interval")
+		if interval <= 0 {
+			return fmt.Errorf("--interval must be positive")
+		}
+
+		cfg, err := loadConfig()
+		if err != nil {
+			return err
+		}
+
+		return runStatus(cmd.Context(), cfg, args, watch, interval)
+	},
+}
+
 var stateCmd = &cobra.Command{
 	Use:   "state",
-	Short: "Show current pipeline state",
+	Short: "Show pipeline state of the most recent run",
+	Long:  "Show pipeline state of the most recent run. Use the subcommands to list, show or remove saved runs.",
+	Args:  cobra.NoArgs,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		mgr, err := state.NewManager()
+		mgr, err := openState()
 		if err != nil {
 			return err
 		}
@@ -232,49 +667,181 @@ var stateCmd = &cobra.Command{
 			return nil
 		}
 
-		fmt.Printf("Run ID:    %s\n", pstate.RunID)
-		fmt.Printf("Started:   %s\n", pstate.StartedAt.Format("2006-01-02 15:04:05"))
-		fmt.Printf("Updated:   %s\n", pstate.UpdatedAt.Format("2006-01-02 15:04:05"))
-		fmt.Printf("Stage:     %s\n", pstate.Stage)
-		fmt.Printf("Complete:  %v\n", pstate.Complete)
-		fmt.Printf("\nImages:\n")
-		for _, img := range pstate.Images {
-			fmt.Printf("  %s:\n", img.Name)
-			fmt.Printf("    Stage:      %s\n", img.Stage)
-			if img.LocalPath != "" {
-				fmt.Printf("    LocalPath:  %s\n", img.LocalPath)
-			}
-			if img.ObjectName != "" {
-				fmt.Printf("    ObjectName: %s\n", img.ObjectName)
+		printRunState(mgr, pstate)
+		return nil
+	},
+}
+
+var stateListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List saved pipeline runs",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		mgr, err := openState()
+		if err != nil {
+			return err
+		}
+
+		runs, err := mgr.ListRuns()
+		if err != nil {
+			return err
+		}
+
+		if len(runs) == 0 {
+			fmt.Println("No saved runs found.")
+			return nil
+		}
+
+		fmt.Printf("%-16s %-19s %-10s %-12s %s\n", "RUN ID", "STARTED", "DURATION", "STATUS", "IMAGES")
+		for _, run := range runs {
+			end := run.UpdatedAt
+			if !run.CompletedAt.IsZero() {
+				end = run.CompletedAt
 			}
-			if img.ImageID != "" {
-				fmt.Printf("    ImageID:    %s\n", img.ImageID)
+
+			status := string(run.Stage)
+			switch {
+			case run.Complete:
+				status = "complete"
+			case run.Interrupted:
+				status = "interrupted"
 			}
-			if img.Error != "" {
-				fmt.Printf("    Error:      %s\n", img.Error)
+
+			fmt.Printf("%-16s %-19s %-10s %-12s %s\n",
+				run.RunID,
+				run.StartedAt.Format("2006-01-02 15:04:05"),
+				state.FormatDuration(end.Sub(run.StartedAt)),
+				status,
+				strings.Join(run.Images, ","))
+		}
+
+		return nil
+	},
+}
+
+var stateShowCmd = &cobra.Command{
+	Use:   "show RUNID",
+	Short: "Show pipeline state of a saved run",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		mgr, err := openState()
+		if err != nil {
+			return err
+		}
+
+		pstate, err := mgr.LoadRun(args[0])
+		if err != nil {
+			return err
+		}
+
+		printRunState(mgr, pstate)
+		return nil
+	},
+}
+
+var stateRmCmd = &cobra.Command{
+	Use:   "rm RUNID...",
+	Short: "Remove saved pipeline runs",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		mgr, err := openState()
+		if err != nil {
+			return err
+		}
+		if err := mgr.Lock(); err != nil {
+			return err
+		}
+		defer mgr.Unlock()
+
+		for _, runID := range args {
+			if err := mgr.RemoveRun(runID); err != nil {
+				return err
 			}
+			fmt.Printf("Removed run %s\n", runID)
 		}
 
-		fmt.Printf("\nState file: %s\n", mgr.StatePath())
 		return nil
 	},
 }
 
+// printRunState prints the state of a pipeline run and its images.
+func printRunState(mgr *state.Manager, pstate *state.PipelineState) {
+	fmt.Printf("Run ID:    %s\n", pstate.RunID)
+	if pstate.Environment != "" {
+		fmt.Printf("Env:       %s\n", pstate.Environment)
+	}
+	fmt.Printf("Started:   %s\n", pstate.StartedAt.Format("2006-01-02 15:04:05"))
+	fmt.Printf("Updated:   %s\n", pstate.UpdatedAt.Format("2006-01-02 15:04:05"))
+	if pstate.Git != nil {
+		fmt.Printf("Git:       %s\n", describeGit(pstate.Git))
+	}
+	fmt.Printf("Stage:     %s\n", pstate.Stage)
+	fmt.Printf("Complete:  %v\n", pstate.Complete)
+	if pstate.Interrupted {
+		fmt.Printf("Interrupted during %s stage (run 'resume %s' to continue)\n", pstate.Stage, pstate.RunID)
+	}
+	fmt.Printf("\nImages:\n")
+	for _, img := range pstate.Images {
+		fmt.Printf("  %s:\n", img.Name)
+		fmt.Printf("    Stage:      %s\n", img.Stage)
+		if img.LocalPath != "" {
+			fmt.Printf("    LocalPath:  %s\n", img.LocalPath)
+		}
+		if img.ObjectName != "" {
+			fmt.Printf("    ObjectName: %s\n", img.ObjectName)
+		}
+		if img.UploadID != "" {
+			fmt.Printf("    UploadID:   %s (preserved)\n", img.UploadID)
+		}
+		if img.SBOMObject != "" {
+			fmt.Printf("    SBOM:       %s\n", img.SBOMObject)
+		} else if img.SBOMPath != "" {
+			fmt.Printf("    SBOM:       %s\n", img.SBOMPath)
+		}
+		if img.ProvenanceObject != "" {
+			fmt.Printf("    Provenance: %s\n", img.ProvenanceObject)
+		} else if img.ProvenancePath != "" {
+			fmt.Printf("    Provenance: %s\n", img.ProvenancePath)
+		}
+		if img.ImageID != "" {
+			fmt.Printf("    ImageID:    %s\n", img.ImageID)
+		}
+		if img.WorkRequestID != "" {
+			fmt.Printf("    WorkReqID:  %s\n", img.WorkRequestID)
+		}
+		if img.Error != "" {
+			lines := strings.Split(img.Error, "\n")
+			fmt.Printf("    Error:      %s\n", lines[0])
+			for _, line := range lines[1:] {
+				fmt.Printf("                %s\n", line)
+			}
+		}
+	}
+
+	fmt.Printf("\nState file: %s\n", mgr.StatePath())
+}
+
 var resumeCmd = &cobra.Command{
-	Use:   "resume",
+	Use:   "resume [RUNID]",
 	Short: "Resume an interrupted pipeline from saved state",
+	Long:  "Resume an interrupted pipeline from saved state. Resumes the most recent run unless a run ID is given.",
+	Args:  cobra.MaximumNArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		cfg, err := config.Load(cfgFile)
+		cfg, err := loadConfig()
 		if err != nil {
 			return err
 		}
 
-		mgr, err := state.NewManager()
+		mgr, err := state.NewManager(cfg.Environment)
 		if err != nil {
 			return err
 		}
+		if err := mgr.Lock(); err != nil {
+			return err
+		}
+		defer mgr.Unlock()
 
-		pstate, err := mgr.Load()
+		pstate, err := loadRun(mgr, args)
 		if err != nil {
 			return err
 		}
@@ -289,39 +856,53 @@ var resumeCmd = &cobra.Command{
 			return nil
 		}
 
-		fmt.Printf("Resuming from stage: %s\n", pstate.Stage)
-
+		if pstate.Interrupted {
+			fmt.Printf("Previous run was interrupted during the %s stage.\n", pstate.Stage)
+			if err := mgr.ClearInterrupted(); err != nil {
+				return err
+			}
+		}
+		if allowDirty, _ := cmd.Flags().GetBool("allow-dirty"); allowDirty && pstate.Git != nil && !pstate.Git.AllowDirty {
+			git := *pstate.Git
+			git.AllowDirty = true
+			if err := mgr.SetGit(&git); err != nil {
+				return err
+			}
+		}
+		// Each image resumes from its own stage, so a run where one image
+		// was imported and another never finished building resumes both.
 		var imageNames []string
 		for _, img := range pstate.Images {
 			imageNames = append(imageNames, img.Name)
+			fmt.Printf("  %-12s %-16s -> %s\n", img.Name, img.Stage, img.ResumeStage())
 		}
 
-		switch pstate.Stage {
-		case "build":
-			fmt.Println("Resuming from build stage...")
-			return resumeFromBuild(cfg, mgr, imageNames)
-		case "upload":
-			fmt.Println("Resuming from upload stage...")
-			return resumeFromUpload(cfg, mgr, imageNames)
-		case "import":
-			fmt.Println("Resuming from import stage...")
-			return resumeFromImport(cfg, mgr)
-		default:
-			return fmt.Errorf("unknown stage: %s", pstate.Stage)
-		}
+		mgr.SetLogFunc(console.Log)
+		events.Subscribe(mgr.HandleEvent)
+
+		dash, _ := cmd.Flags().GetBool("dashboard")
+		ctx, stop := startDashboard(cmd.Context(), mgr, dash)
+		defer stop()
+
+		console.Log("")
+		return runPipeline(ctx, cfg, mgr, imageNames, pstate.LocalOnly)
 	},
 }
 
 var statsCmd = &cobra.Command{
-	Use:   "stats",
+	Use:   "stats [RUNID]",
 	Short: "Display build statistics from last pipeline run",
+	Long:  "Display build statistics from the most recent pipeline run, or the given run. Use --compare to show per-image deltas against another run.",
+	Args:  cobra.MaximumNArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		mgr, err := state.NewManager()
+		compareID, _ := cmd.Flags().GetString("compare")
+
+		mgr, err := openState()
 		if err != nil {
 			return err
 		}
 
-		pstate, err := mgr.Load()
+		pstate, err := loadRun(mgr, args)
 		if err != nil {
 			return err
 		}
@@ -336,6 +917,7 @@ var statsCmd = &cobra.Command{
 			fmt.Println("No statistics available.")
 			return nil
 		}
+		statePath := mgr.StatePath()
 
 		fmt.Printf("=== Pipeline Statistics (Run: %s) ===\n\n", stats.RunID)
 		fmt.Printf("Total Duration:     %s\n\n", state.FormatDuration(stats.TotalDuration))
@@ -371,175 +953,763 @@ var statsCmd = &cobra.Command{
 			}
 		}
 
-		fmt.Printf("\nState file: %s\n", mgr.StatePath())
+		if compareID != "" {
+			baseline, err := mgr.LoadRun(compareID)
+			if err != nil {
+				return err
+			}
+			printComparison(stats, baseline.Statistics())
+		}
+
+		fmt.Printf("\nState file: %s\n", statePath)
 		return nil
 	},
 }
 
-func resumeFromBuild(cfg *config.Config, mgr *state.Manager, imageNames []string) error {
+func resumeFromBuild(ctx context.Context, cfg *config.Config, mgr *state.Manager, imageNames []string, localOnly bool) error {
 	var needBuild []string
 	for _, name := range imageNames {
 		if !mgr.ShouldSkipBuild(name) {
 			needBuild = append(needBuild, name)
 		} else {
-			fmt.Printf("  Skipping build for %s (already built)\n", name)
+			console.Logf("  Skipping build for %s (already built)", name)
 		}
 	}
 
 	if len(needBuild) == 0 {
-		fmt.Println("All images already built, proceeding to upload...")
-		mgr.SetStage("upload")
-		return resumeFromUpload(cfg, mgr, imageNames)
+		console.Log("All images already built, proceeding to upload...")
+		mgr.SetStage(state.PipelineUpload)
+		console.Log("\n=== Upload Stage ===")
+		return resumeFromUpload(ctx, cfg, mgr, imageNames)
 	}
 
-	builder := build.NewBuilder(cfg, false)
-	builder.SetLogFunc(func(msg string) {
-		fmt.Println(msg)
-	})
-
-	results, err := builder.Build(context.Background(), needBuild)
-	if err != nil {
-		return err
+	// Images are rebuilt from the tree as it is now, which may no longer be
+	// the checkout the run was started from
+	run := mgr.GetState()
+	builder := newBuilder(cfg, localOnly)
+	builder.RunID = run.RunID
+	var changed *state.GitState // Checkout recorded for rebuilt images, if not the run's
+	if run.Git != nil {
+		g := inspectGit(ctx, run.Git.AllowDirty)
+		if g.Commit != run.Git.Commit || g.Dirty != run.Git.Dirty {
+			if !run.Git.AllowDirty {
+				return fmt.Errorf("checkout is now %s, but the run was started from %s; use --allow-dirty to rebuild from it anyway",
+					describeGit(g), describeGit(run.Git))
+			}
+			console.Logf("Rebuilding from %s, not %s as the run was started from", describeGit(g), describeGit(run.Git))
+			changed = g
+		}
+		builder.GitCommit = g.Commit
+		builder.GitDirty = g.Dirty
 	}
 
-	for name, result := range results {
+	results, err := builder.Build(ctx, needBuild)
+
+	// Record images that finished before any failure so resume skips them.
+	// Images are built in order, so the first without a result failed.
+	var hookErrs []error
+	for _, name := range needBuild {
+		result, ok := results[name]
+		if !ok {
+			if err != nil {
+				return errors.Join(failImage(ctx, cfg, mgr, name, err), errors.Join(hookErrs...))
+			}
+			continue
+		}
 		mgr.UpdateImage(name, func(img *state.ImageState) {
 			img.LocalPath = result.OutputPath
-			img.Stage = "build_complete"
+			img.SBOMPath = result.SBOMPath
+			img.ProvenancePath = result.ProvenancePath
+			img.Git = changed
+			img.Stage = state.StageBuildComplete
 		})
+		hookErrs = append(hookErrs, fireHooks(ctx, cfg, mgr, config.HookBuildComplete, name, nil))
+	}
+
+	if err != nil {
+		return err
+	}
+	if err := errors.Join(hookErrs...); err != nil {
+		return err
 	}
 
-	mgr.SetStage("upload")
-	return resumeFromUpload(cfg, mgr, imageNames)
+	mgr.SetStage(state.PipelineUpload)
+	console.Log("\n=== Upload Stage ===")
+	return resumeFromUpload(ctx, cfg, mgr, imageNames)
 }
 
-func resumeFromUpload(cfg *config.Config, mgr *state.Manager, imageNames []string) error {
-	var needUpload []string
+func resumeFromUpload(ctx context.Context, cfg *config.Config, mgr *state.Manager, imageNames []string) error {
+	run := mgr.GetState()
+	if err := checkGit(run.Git); err != nil {
+		return err
+	}
+
+	var needUpload, preserved []string
 	for _, name := range imageNames {
-		if !mgr.ShouldSkipUpload(name) {
+		img := mgr.GetImageState(name)
+		switch {
+		case mgr.ShouldSkipUpload(name):
+			console.Logf("  Skipping upload for %s (already uploaded)", name)
+		case img != nil && img.UploadID != "":
+			preserved = append(preserved, name)
+		default:
 			needUpload = append(needUpload, name)
-		} else {
-			fmt.Printf("  Skipping upload for %s (already uploaded)\n", name)
 		}
 	}
 
-	client, err := oci.NewClient(cfg)
+	client, err := newClient(cfg)
 	if err != nil {
 		return err
 	}
-	client.SetLogFunc(func(msg string) {
-		fmt.Println(msg)
-	})
-
-	if len(needUpload) > 0 {
-		objects, err := client.Upload(context.Background(), needUpload)
-		if err != nil {
+	setClientCheckouts(client, mgr, imageNames)
+	if len(needUpload)+len(preserved) > 0 {
+		if err := client.CheckCanSign(); err != nil {
 			return err
 		}
+	}
+	client.LocalPaths = make(map[string]string)
+	client.SBOMPaths = make(map[string]string)
+	client.ProvenancePaths = make(map[string]string)
+	for _, name := range imageNames {
+		if img := mgr.GetImageState(name); img != nil && img.LocalPath != "" {
+			client.LocalPaths[name] = img.LocalPath
+			client.SBOMPaths[name] = img.SBOMPath
+			client.ProvenancePaths[name] = img.ProvenancePath
+		}
+	}
 
-		for i, name := range needUpload {
+	for _, name := range preserved {
+		img := mgr.GetImageState(name)
+		err := client.ResumeUpload(ctx, name, img.ObjectName, img.UploadID)
+		if errors.Is(err, oci.ErrUploadNotFound) {
+			console.Logf("  Preserved upload for %s no longer exists, uploading again", name)
 			mgr.UpdateImage(name, func(img *state.ImageState) {
-				img.ObjectName = objects[i]
-				img.Stage = "upload_complete"
+				img.ObjectName = ""
+				img.UploadID = ""
+				img.Stage = state.StageBuildComplete
 			})
+			needUpload = append(needUpload, name)
+			continue
 		}
-	}
-
-	mgr.SetStage("import")
-	return resumeFromImport(cfg, mgr)
+		if err != nil {
+			recordInterruptedUpload(mgr, err)
+			return failImage(ctx, cfg, mgr, name, err)
+		}
+
+		mgr.UpdateImage(name, func(img *state.ImageState) {
+			img.UploadID = ""
+			img.SBOMObject = sbomObject(img)
+			img.ProvenanceObject = provenanceObject(img)
+			img.Stage = state.StageUploadComplete
+		})
+		if err := fireHooks(ctx, cfg, mgr, config.HookUploadComplete, name, nil); err != nil {
+			return err
+		}
+	}
+
+	if len(needUpload) > 0 {
+		objects, err := client.Upload(ctx, needUpload)
+
+		var hookErrs []error
+		for i, object := range objects {
+			mgr.UpdateImage(needUpload[i], func(img *state.ImageState) {
+				img.ObjectName = object
+				img.SBOMObject = sbomObject(img)
+				img.ProvenanceObject = provenanceObject(img)
+				img.Stage = state.StageUploadComplete
+			})
+			hookErrs = append(hookErrs, fireHooks(ctx, cfg, mgr, config.HookUploadComplete, needUpload[i], nil))
+		}
+
+		if err != nil {
+			recordInterruptedUpload(mgr, err)
+			return errors.Join(failImage(ctx, cfg, mgr, needUpload[len(objects)], err), errors.Join(hookErrs...))
+		}
+		if err := errors.Join(hookErrs...); err != nil {
+			return err
+		}
+	}
+
+	mgr.SetStage(state.PipelineImport)
+	console.Log("\n=== Import Stage ===")
+	return resumeFromImport(ctx, cfg, mgr)
 }
 
-func resumeFromImport(cfg *config.Config, mgr *state.Manager) error {
-	client, err := oci.NewClient(cfg)
+// sbomObject returns the object name an image's SBOM was uploaded under,
+// or "" if it has none.
+func sbomObject(img *state.ImageState) string {
+	if img.SBOMPath == "" {
+		return ""
+	}
+	return oci.SBOMObjectName(img.ObjectName, img.SBOMPath)
+}
+
+// provenanceObject returns the object name an image's provenance statement
+// was uploaded under, or "" if it has none.
+func provenanceObject(img *state.ImageState) string {
+	if img.ProvenancePath == "" {
+		return ""
+	}
+	return oci.ProvenanceObjectName(img.ObjectName)
+}
+
+// inspectGit returns the state of the checkout images are built from,
+// recording allowDirty. Outside a git checkout only AllowDirty is set.
+func inspectGit(ctx context.Context, allowDirty bool) *state.GitState {
+	g := &state.GitState{AllowDirty: allowDirty}
+	info, err := git.Inspect(ctx)
+	if err != nil {
+		return g
+	}
+	g.Commit = info.Commit
+	g.ShortCommit = info.ShortCommit
+	g.Branch = info.Branch
+	g.Tags = info.Tags
+	g.Dirty = info.Dirty
+	return g
+}
+
+// buildCheckout returns the checkout result-<name> was built from, as
+// recorded in its provenance statement, with the tags now pointing at its
+// commit.
+func buildCheckout(ctx context.Context, name string, allowDirty bool) (*state.GitState, error) {
+	g := &state.GitState{AllowDirty: allowDirty}
+	path := fmt.Sprintf("result-%s%s", name, provenance.Extension)
+	commit, dirty, err := provenance.ReadCheckout(path)
 	if err != nil {
+		if allowDirty {
+			return g, nil
+		}
+		return nil, fmt.Errorf("no build record for %s: %w; rebuild it, or use --allow-dirty", name, err)
+	}
+
+	g.Commit = commit
+	g.ShortCommit = git.Short(commit)
+	g.Dirty = dirty
+	if commit == "" {
+		return g, nil
+	}
+	// The commit may not be in this clone; it then counts as untagged
+	if info, err := git.Describe(ctx, commit); err == nil {
+		g.Tags = info.Tags
+	}
+	return g, nil
+}
+
+// checkGit refuses to upload or import images built from a dirty tree or an
+// untagged commit unless --allow-dirty was given. Runs without a recorded
+// checkout are not checked.
+func checkGit(g *state.GitState) error {
+	if g == nil || g.AllowDirty {
+		return nil
+	}
+	if err := gitInfo(g).CheckPublishable(); err != nil {
+		return fmt.Errorf("%w; use --allow-dirty to upload and import anyway", err)
+	}
+	return nil
+}
+
+// gitInfo converts a recorded checkout for the git and oci packages.
+func gitInfo(g *state.GitState) *git.Info {
+	return &git.Info{
+		Commit:      g.Commit,
+		ShortCommit: g.ShortCommit,
+		Branch:      g.Branch,
+		Tags:        g.Tags,
+		Dirty:       g.Dirty,
+	}
+}
+
+// describeGit returns a one-line description of a checkout, e.g.
+// "1a2b3c4 on main (v1.2, dirty)".
+func describeGit(g *state.GitState) string {
+	if g.Commit == "" {
+		return "not a git checkout"
+	}
+
+	desc := g.ShortCommit
+	if g.Branch != "" {
+		desc += " on " + g.Branch
+	}
+	notes := append([]string(nil), g.Tags...)
+	if g.Dirty {
+		notes = append(notes, "dirty")
+	}
+	if g.AllowDirty {
+		notes = append(notes, "--allow-dirty")
+	}
+	if len(notes) > 0 {
+		desc += " (" + strings.Join(notes, ", ") + ")"
+	}
+	return desc
+}
+
+// setClientCheckouts records the checkout each image of the run was built
+// from, so their uploads are named after and signed with its commit.
+func setClientCheckouts(client *oci.Client, mgr *state.Manager, imageNames []string) {
+	client.Checkouts = make(map[string]*git.Info)
+	run := mgr.GetState()
+	for _, name := range imageNames {
+		g := run.Git
+		if img := mgr.GetImageState(name); img != nil && img.Git != nil {
+			g = img.Git
+		}
+		if g != nil {
+			client.Checkouts[name] = gitInfo(g)
+		}
+	}
+}
+
+func resumeFromImport(ctx context.Context, cfg *config.Config, mgr *state.Manager) error {
+	run := mgr.GetState()
+	if err := checkGit(run.Git); err != nil {
 		return err
 	}
-	client.SetLogFunc(func(msg string) {
-		fmt.Println(msg)
-	})
+
+	client, err := newClient(cfg)
+	if err != nil {
+		return err
+	}
+	client.AllowDirty = run.Git == nil || run.Git.AllowDirty
+	hookErrs := trackImports(ctx, cfg, client, mgr)
 
 	pstate := mgr.GetState()
 
-	existingIDs := mgr.GetImageIDs()
-	if len(existingIDs) > 0 {
-		fmt.Println("Checking status of previously initiated imports...")
-		if err := client.WaitForImages(context.Background(), existingIDs); err != nil {
-			return err
-		}
+	pending := importsFromState(pstate)
+	if len(pending) > 0 {
+		console.Log("Resuming wait for previously initiated imports...")
 	}
 
 	var needImport []string
 	for _, img := range pstate.Images {
-		if img.ImageID == "" && img.ObjectName != "" {
+		if img.ResumeStage() == state.PipelineImport && img.Stage != state.StageImporting {
 			needImport = append(needImport, img.ObjectName)
+
+			// A read request made before the run stopped, without an image
+			if img.PARID != "" {
+				parID := img.PARID
+				client.ReleasePAR(ctx, img.Name, &parID)
+				mgr.UpdateImage(img.Name, func(img *state.ImageState) { img.PARID = parID })
+			}
 		}
 	}
 
 	if len(needImport) > 0 {
-		imageIDs, err := client.Import(context.Background(), needImport)
+		imported, err := client.Import(ctx, needImport)
 		if err != nil {
-			return err
-		}
-
-		for name, id := range imageIDs {
-			mgr.UpdateImage(name, func(img *state.ImageState) {
-				img.ImageID = id
-				img.Stage = "importing"
-			})
-		}
-
-		if err := client.WaitForImages(context.Background(), imageIDs); err != nil {
-			return err
+			return errors.Join(err, hookErrs())
 		}
-
-		for name := range imageIDs {
-			mgr.UpdateImage(name, func(img *state.ImageState) {
-				img.Stage = "complete"
-			})
+		for name, image := range imported {
+			pending[name] = image
 		}
 	}
 
-	for _, img := range pstate.Images {
-		mgr.UpdateImage(img.Name, func(s *state.ImageState) {
-			s.Stage = "complete"
-		})
+	if err := client.WaitForImages(ctx, pending); err != nil {
+		return errors.Join(err, hookErrs())
+	}
+	if err := hookErrs(); err != nil {
+		return err
 	}
 
-	mgr.SetStage("complete")
+	mgr.SetStage(state.PipelineComplete)
 	mgr.MarkComplete()
 
-	fmt.Println("\n=== Pipeline Complete ===")
+	console.Log("\n=== Pipeline Complete ===")
 
 	if stats := mgr.GetStatistics(); stats != nil {
-		fmt.Println("\n=== Build Statistics ===")
-		fmt.Printf("Total Duration: %s\n", state.FormatDuration(stats.TotalDuration))
-		fmt.Printf("  Build: %s | Upload: %s | Import: %s\n",
+		console.Log("\n=== Build Statistics ===")
+		console.Logf("Total Duration: %s", state.FormatDuration(stats.TotalDuration))
+		console.Logf("  Build: %s | Upload: %s | Import: %s",
 			state.FormatDuration(stats.BuildDuration),
 			state.FormatDuration(stats.UploadDuration),
 			state.FormatDuration(stats.ImportDuration))
 		if stats.TotalBytesUploaded > 0 {
-			fmt.Printf("Upload: %.2f GB at %.2f MB/s\n",
+			console.Logf("Upload: %.2f GB at %.2f MB/s",
 				float64(stats.TotalBytesUploaded)/(1024*1024*1024),
 				stats.UploadThroughputMB)
 		}
 	}
 
-	fmt.Println("\n=== Add to terraform.tfvars ===")
-	imageIDs := mgr.GetImageIDs()
+	if err := printTfvars(cfg, mgr.GetImageIDs()); err != nil {
+		return err
+	}
+	return fireHooks(ctx, cfg, mgr, config.HookRunComplete, "", nil)
+}
+
+// Helper functions
+
+// loadRun loads the run named by the optional RUNID argument, or the most
+// recent run if none is given.
+func loadRun(mgr *state.Manager, args []string) (*state.PipelineState, error) {
+	if len(args) > 0 {
+		return mgr.LoadRun(args[0])
+	}
+	return mgr.Load()
+}
+
+// printComparison prints per-image duration and throughput deltas between
+// two runs.
+func printComparison(current, baseline *state.PipelineStatistics) {
+	fmt.Printf("\nCompared to run %s (total %s, %s):\n",
+		baseline.RunID,
+		state.FormatDuration(baseline.TotalDuration),
+		state.FormatDurationDelta(current.TotalDuration-baseline.TotalDuration))
+	fmt.Printf("  %-12s %10s %10s %10s %10s %10s\n",
+		"Image", "Build", "Upload", "Import", "Total", "MB/s")
+	fmt.Println("  " + strings.Repeat("-", 64))
+
+	for _, cmp := range state.CompareStatistics(current, baseline) {
+		if !cmp.InBaseline {
+			fmt.Printf("  %-12s %10s\n", cmp.Name, "(new)")
+			continue
+		}
+
+		throughput := "-"
+		if cmp.Current.UploadThroughputMB > 0 && cmp.Baseline.UploadThroughputMB > 0 {
+			throughput = fmt.Sprintf("%+.2f", cmp.UploadThroughputMBDelta)
+		}
+		fmt.Printf("  %-12s %10s %10s %10s %10s %10s\n",
+			cmp.Name,
+			state.FormatDurationDelta(cmp.BuildDurationDelta),
+			state.FormatDurationDelta(cmp.UploadDurationDelta),
+			state.FormatDurationDelta(cmp.ImportDurationDelta),
+			state.FormatDurationDelta(cmp.TotalDurationDelta),
+			throughput)
+	}
+}
+
+// importsFromState returns the imports recorded in the pipeline state that
+// are still in progress, keyed by image name.
+func importsFromState(pstate *state.PipelineState) map[string]oci.ImportedImage {
+	imports := make(map[string]oci.ImportedImage)
+	for _, img := range pstate.Images {
+		if img.Stage != state.StageImporting {
+			continue
+		}
+		imports[img.Name] = oci.ImportedImage{
+			ImageID:       img.ImageID,
+			WorkRequestID: img.WorkRequestID,
+			ObjectName:    img.ObjectName,
+			PARID:         img.PARID,
+			ObjectETag:    img.ObjectETag,
+		}
+	}
+	return imports
+}
+
+// trackImports persists import progress reported by the client, so an
+// interrupted wait can be resumed without re-importing and failures keep
+// their work request diagnostics for 'state'. Hooks fire as each import
+// finishes, one at a time in the background, since updates are delivered
+// with the waits for all imports held up. The returned function must be
+// called once no more updates can arrive; it waits for the hooks and
+// reports the failures of those that fail the pipeline.
+func trackImports(ctx context.Context, cfg *config.Config, client *oci.Client, mgr *state.Manager) func() error {
+	type hookCall struct {
+		event, imageName string
+		cause            error
+	}
+	// Each image fires at most one hook, so sends never block
+	calls := make(chan hookCall, len(mgr.GetState().Images))
+	done := make(chan error)
+	go func() {
+		var errs []error
+		for c := range calls {
+			errs = append(errs, fireHooks(ctx, cfg, mgr, c.event, c.imageName, c.cause))
+		}
+		done <- errors.Join(errs...)
+	}()
+
+	client.SetImportUpdateFunc(func(u oci.ImportUpdate) {
+		if u.State == "PENDING" {
+			mgr.UpdateImage(u.ImageName, func(img *state.ImageState) {
+				img.PARID = u.Image.PARID
+			})
+			return
+		}
+		mgr.UpdateImage(u.ImageName, func(img *state.ImageState) {
+			img.ImageID = u.Image.ImageID
+			img.WorkRequestID = u.Image.WorkRequestID
+			img.PARID = u.Image.PARID
+			img.ObjectETag = u.Image.ObjectETag
+			if u.Image.ObjectName != "" {
+				img.ObjectName = u.Image.ObjectName
+			}
+			switch {
+			case u.Err != nil:
+				img.Stage = state.StageError
+				img.Error = u.Err.Detail()
+			case u.State == "AVAILABLE":
+				img.Stage = state.StageComplete
+				img.Error = ""
+			default:
+				img.Stage = state.StageImporting
+				img.Error = ""
+			}
+		})
+
+		switch {
+		case u.Err != nil:
+			calls <- hookCall{config.HookImageFailed, u.ImageName, u.Err}
+		case u.State == "AVAILABLE":
+			calls <- hookCall{config.HookImportComplete, u.ImageName, nil}
+		}
+	})
+	return func() error {
+		close(calls)
+		return <-done
+	}
+}
+
+// recordInterruptedUpload stores a preserved multipart upload in state so
+// resume can finish it instead of starting over.
+func recordInterruptedUpload(mgr *state.Manager, err error) {
+	var interrupted *oci.UploadInterruptedError
+	if !errors.As(err, &interrupted) {
+		return
+	}
+
+	mgr.UpdateImage(interrupted.ImageName, func(img *state.ImageState) {
+		img.ObjectName = interrupted.ObjectName
+		img.UploadID = interrupted.UploadID
+		img.Stage = state.StageUploading
+	})
+}
+
+// handleInterrupt marks the run as interrupted when err was caused by
+// cancellation (Ctrl-C or SIGTERM), so 'resume' continues from the same stage.
+func handleInterrupt(ctx context.Context, mgr *state.Manager, err error) error {
+	if err == nil || ctx.Err() == nil {
+		return err
+	}
+
+	if saveErr := mgr.MarkInterrupted(); saveErr != nil {
+		console.Logf("Warning: failed to save state: %v", saveErr)
+	}
+
+	return fmt.Errorf("interrupted during %s stage, run 'resume' to continue (state: %s)",
+		mgr.GetState().Stage, mgr.StatePath())
+}
+
+// runPipeline runs the active run from each image's resume stage, firing
+// the run_start and run_failed hooks around it and exporting metrics and
+// traces when it ends.
+func runPipeline(ctx context.Context, cfg *config.Config, mgr *state.Manager, imageNames []string, localOnly bool) (err error) {
+	defer startTracing(ctx, cfg)()
+	run := mgr.GetState()
+	ctx, span := tracing.Start(ctx, "run",
+		attribute.String("run.id", run.RunID),
+		attribute.String("environment", run.Environment),
+		attribute.StringSlice("images", imageNames))
+	defer func() { tracing.End(span, err) }()
+
+	collector := metrics.NewCollector()
+	events.Subscribe(collector.HandleEvent)
+	defer exportMetrics(ctx, cfg, mgr, collector)
+
+	err = fireHooks(ctx, cfg, mgr, config.HookRunStart, "", nil)
+	if err == nil {
+		console.Log("=== Build Stage ===")
+		err = resumeFromBuild(ctx, cfg, mgr, imageNames, localOnly)
+	}
+
+	if err != nil && ctx.Err() == nil && !mgr.GetState().Complete {
+		err = errors.Join(err, fireHooks(ctx, cfg, mgr, config.HookRunFailed, "", err))
+	}
+	return handleInterrupt(ctx, mgr, err)
+}
+
+// startTracing sets up trace export if tracing.endpoint is set. The returned
+// function flushes the spans of the run; failures are only warnings.
+func startTracing(ctx context.Context, cfg *config.Config) func() {
+	if cfg.Tracing.Endpoint == "" {
+		return func() {}
+	}
+
+	shutdown, err := tracing.Setup(ctx, cfg.Tracing.Endpoint)
+	if err != nil {
+		console.Logf("Warning: %v", err)
+		return func() {}
+	}
+
+	return func() {
+		// Flush even if the run was interrupted
+		flushCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), tracingFlushTimeout)
+		defer cancel()
+		if err := shutdown(flushCtx); err != nil {
+			console.Logf("Warning: %v", err)
+		}
+	}
+}
+
+// exportMetrics writes the run's metrics to the configured textfile and
+// Pushgateway. Failures are only warnings, since the run itself is over.
+func exportMetrics(ctx context.Context, cfg *config.Config, mgr *state.Manager, collector *metrics.Collector) {
+	m := cfg.Metrics
+	run := mgr.GetState()
+	if (m.TextfilePath == "" && m.PushgatewayURL == "") || run == nil {
+		return
+	}
+
+	data := collector.Format(run)
+	if m.TextfilePath != "" {
+		if err := metrics.WriteTextfile(m.TextfilePath, data); err != nil {
+			console.Logf("Warning: %v", err)
+		} else {
+			console.Logf("Metrics written to %s", m.TextfilePath)
+		}
+	}
+	if m.PushgatewayURL != "" {
+		// Push even if the run was interrupted
+		pushCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), metricsPushTimeout)
+		defer cancel()
+		if err := metrics.Push(pushCtx, m.PushgatewayURL, m.Job, run.Environment, data); err != nil {
+			console.Logf("Warning: %v", err)
+		} else {
+			console.Log("Metrics pushed to Pushgateway")
+		}
+	}
+}
+
+// fireHooks runs the hooks for an event in the active run. imageName is
+// empty for run events and cause is set for failures. It returns the
+// failures of hooks that fail the pipeline.
+func fireHooks(ctx context.Context, cfg *config.Config, mgr *state.Manager, event, imageName string, cause error) error {
+	run := mgr.GetState()
+	if len(cfg.Hooks) == 0 || run == nil {
+		return nil
+	}
+
+	runner := hooks.NewRunner(cfg.Hooks)
+	runner.SetLogFunc(console.Log)
+	return runner.Fire(ctx, hooks.NewPayload(event, run, imageName, cause))
+}
+
+// failImage fires image_failed for an image whose stage failed with err,
+// unless the run was interrupted, and returns err with any hook failures.
+func failImage(ctx context.Context, cfg *config.Config, mgr *state.Manager, imageName string, err error) error {
+	if ctx.Err() != nil {
+		return err
+	}
+	return errors.Join(err, fireHooks(ctx, cfg, mgr, config.HookImageFailed, imageName, err))
+}
+
+// startDashboard takes over the terminal with the progress dashboard if
+// enabled and stdout is a terminal. It returns the context to run the
+// pipeline with, canceled by Ctrl-C in the dashboard, and a function that
+// restores the terminal.
+func startDashboard(ctx context.Context, mgr *state.Manager, enabled bool) (context.Context, func()) {
+	if !enabled || !dashboard.Enabled() {
+		return ctx, func() {}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	d := dashboard.New(mgr.GetState, cancel)
+	events.Subscribe(d.HandleEvent)
+	console.SetLogFunc(d.Log)
+	d.Start()
+	return ctx, func() {
+		console.SetLogFunc(printLine)
+		d.Stop()
+		cancel()
+	}
+}
+
+// newClient creates an OCI client that logs to the console and reports
+// progress on the shared event bus.
+func newClient(cfg *config.Config) (*oci.Client, error) {
+	client, err := oci.NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	client.SetLogFunc(console.Log)
+	client.Events = events
+	return client, nil
+}
+
+// newBuilder creates a Builder that logs to the console and reports
+// progress on the shared event bus.
+func newBuilder(cfg *config.Config, localOnly bool) *build.Builder {
+	builder := build.NewBuilder(cfg, localOnly)
+	builder.SetLogFunc(console.Log)
+	builder.Events = events
+	return builder
+}
+
+// renderEvent prints the progress events that are not already logged.
+func renderEvent(e progress.Event) {
+	switch e := e.(type) {
+	case *progress.PartUploaded:
+		reused := ""
+		if e.Reused {
+			reused = ", already uploaded"
+		}
+		console.Logf("  Part %d/%d complete (%.1f%%%s)", e.PartNum, e.TotalParts,
+			float64(e.BytesSent)/float64(e.TotalBytes)*100, reused)
+	}
+}
+
+// loadConfig resolves the configuration for the selected environment, with
+// --set and the shortcut flags applied on top.
+func loadConfig() (*config.Config, error) {
+	var overrides []config.Override
+	for _, set := range sets {
+		key, value, ok := strings.Cut(set, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid --set %q: expected key=value", set)
+		}
+		overrides = append(overrides, config.Override{Key: key, Value: value, Source: "flag --set"})
+	}
+	for _, f := range overrideFlags {
+		if rootCmd.PersistentFlags().Changed(f.flag) {
+			value, _ := rootCmd.PersistentFlags().GetString(f.flag)
+			overrides = append(overrides, config.Override{Key: f.key, Value: value, Source: "flag --" + f.flag})
+		}
+	}
+	return config.Load(cfgFile, envName, overrides...)
+}
+
+// openState returns the state manager for the selected environment. Without
+// --env, state commands keep working when no config file is found.
+func openState() (*state.Manager, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		if envName != "" {
+			return nil, err
+		}
+		return state.NewManager("")
+	}
+	return state.NewManager(cfg.Environment)
+}
+
+// printTfvars prints terraform variable assignments for the imported image
+// OCIDs and writes them to the configured tfvars file, if any.
+func printTfvars(cfg *config.Config, imageIDs map[string]string) error {
+	vars := make(map[string]string, len(imageIDs))
 	for name, id := range imageIDs {
 		img := cfg.GetImage(name)
 		if img != nil && img.TerraformVar != "" {
-			fmt.Printf("%s = \"%s\"\n", img.TerraformVar, id)
+			vars[img.TerraformVar] = id
 		} else {
-			fmt.Printf("%s_image_ocid = \"%s\"\n", name, id)
+			vars[name+"_image_ocid"] = id
 		}
 	}
 
+	console.Log("\n=== Add to terraform.tfvars ===")
+	for name, id := range vars {
+		console.Logf("%s = \"%s\"", name, id)
+	}
+
+	if cfg.TfvarsPath == "" || len(vars) == 0 {
+		return nil
+	}
+	if err := tfvars.Update(cfg.TfvarsPath, vars); err != nil {
+		return err
+	}
+	console.Logf("\nUpdated %s", cfg.TfvarsPath)
 	return nil
 }
 
-// Helper functions
-
 func normalizeImages(args []string, cfg *config.Config) []string {
 	if len(args) == 0 {
 		return cfg.GetAllImageNames()
@@ -557,13 +1727,20 @@ func needsRemoteBuild(cfg *config.Config, imageNames []string) bool {
 	return false
 }
 
-func runBuild(cfg *config.Config, imageNames []string, localOnly bool, buildOnly bool) error {
-	builder := build.NewBuilder(cfg, localOnly)
-	builder.SetLogFunc(func(msg string) {
-		fmt.Println(msg)
-	})
+func runBuild(ctx context.Context, cfg *config.Config, imageNames []string, localOnly, buildOnly, allowDirty bool) error {
+	g := inspectGit(ctx, allowDirty)
+	if !buildOnly {
+		// Fail before building what could not be uploaded
+		if err := checkGit(g); err != nil {
+			return err
+		}
+	}
 
-	results, err := builder.Build(context.Background(), imageNames)
+	builder := newBuilder(cfg, localOnly)
+	builder.GitCommit = g.Commit
+	builder.GitDirty = g.Dirty
+
+	results, err := builder.Build(ctx, imageNames)
 	if err != nil {
 		return err
 	}
@@ -580,19 +1757,76 @@ func runBuild(cfg *config.Config, imageNames []string, localOnly bool, buildOnly
 		return nil
 	}
 
-	return runUpload(cfg, imageNames)
+	return runUpload(ctx, cfg, imageNames, allowDirty)
 }
 
-func runUpload(cfg *config.Config, imageNames []string) error {
-	client, err := oci.NewClient(cfg)
+// runVerifyRepro builds an image twice and reports whether the outputs match.
+func runVerifyRepro(ctx context.Context, cfg *config.Config, imageName string, mode build.ReproMode) error {
+	builder := newBuilder(cfg, true)
+
+	result, err := builder.VerifyRepro(ctx, imageName, mode)
 	if err != nil {
 		return err
 	}
-	client.SetLogFunc(func(msg string) {
-		fmt.Println(msg)
-	})
 
-	objects, err := client.Upload(context.Background(), imageNames)
+	fmt.Printf("\n=== Reproducibility of %s ===\n", imageName)
+	for i, b := range []build.BuildOutput{result.First, result.Second} {
+		fmt.Printf("%s build (%s):\n", [...]string{"First", "Second"}[i], b.Where)
+		fmt.Printf("  Output:       %s\n", b.OutPath)
+		fmt.Printf("  NAR hash:     %s\n", b.NarHash)
+		fmt.Printf("  qcow2 SHA256: %s\n", b.QcowSHA256)
+	}
+
+	if result.Reproducible() {
+		fmt.Printf("\n%s is reproducible: both builds are identical\n", imageName)
+		return nil
+	}
+
+	fmt.Printf("\n%s is NOT reproducible. Differing store paths:\n", imageName)
+	orMissing := func(hash string) string {
+		if hash == "" {
+			return "(not in closure)"
+		}
+		return hash
+	}
+	for _, d := range result.Differences {
+		fmt.Printf("  %s\n", d.Path)
+		fmt.Printf("    %-14s %s\n", result.First.Where+":", orMissing(d.First))
+		fmt.Printf("    %-14s %s\n", result.Second.Where+":", orMissing(d.Second))
+	}
+	if result.Diffoscope != "" {
+		fmt.Println("\ndiffoscope:")
+		fmt.Println(result.Diffoscope)
+	}
+
+	return fmt.Errorf("%s is not reproducible", imageName)
+}
+
+func runUpload(ctx context.Context, cfg *config.Config, imageNames []string, allowDirty bool) error {
+	// Images may have been built before HEAD moved, so check what each
+	// was built from rather than the current checkout
+	checkouts := make(map[string]*git.Info)
+	for _, name := range imageNames {
+		g, err := buildCheckout(ctx, name, allowDirty)
+		if err != nil {
+			return err
+		}
+		if err := checkGit(g); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		checkouts[name] = gitInfo(g)
+	}
+
+	client, err := newClient(cfg)
+	if err != nil {
+		return err
+	}
+	client.Checkouts = checkouts
+	if err := client.CheckCanSign(); err != nil {
+		return err
+	}
+
+	objects, err := client.Upload(ctx, imageNames)
 	if err != nil {
 		return err
 	}
@@ -605,84 +1839,678 @@ func runUpload(cfg *config.Config, imageNames []string) error {
 	return nil
 }
 
-func runImport(cfg *config.Config, objects []string) error {
-	client, err := oci.NewClient(cfg)
+func runImport(ctx context.Context, cfg *config.Config, objects []string, allowDirty bool) error {
+	client, err := newClient(cfg)
 	if err != nil {
 		return err
 	}
-	client.SetLogFunc(func(msg string) {
-		fmt.Println(msg)
-	})
+	client.AllowDirty = allowDirty
 
-	imageIDs, err := client.Import(context.Background(), objects)
+	imported, err := client.Import(ctx, objects)
 	if err != nil {
 		return err
 	}
 
 	fmt.Println("\nWaiting for images to be available...")
-	if err := client.WaitForImages(context.Background(), imageIDs); err != nil {
+	if err := client.WaitForImages(ctx, imported); err != nil {
 		return err
 	}
 
-	fmt.Println("\n=== Add to terraform.tfvars ===")
-	for name, id := range imageIDs {
-		img := cfg.GetImage(name)
-		if img != nil && img.TerraformVar != "" {
-			fmt.Printf("%s = \"%s\"\n", img.TerraformVar, id)
+	imageIDs := make(map[string]string, len(imported))
+	for name, image := range imported {
+		imageIDs[name] = image.ImageID
+	}
+	return printTfvars(cfg, imageIDs)
+}
+
+func runExport(ctx context.Context, cfg *config.Config, imageID, objectName string, download bool, outputDir, name string) error {
+	client, err := newClient(cfg)
+	if err != nil {
+		return err
+	}
+	mgr, err := state.NewManager(cfg.Environment)
+	if err != nil {
+		return err
+	}
+
+	// Record the export's write request and work request as soon as they
+	// exist, so that running export again resumes it
+	exports, err := mgr.LoadExports()
+	if err != nil {
+		return err
+	}
+	var prev *oci.ExportedImage
+	if e, ok := exports.Images[imageID]; ok {
+		prev = &oci.ExportedImage{
+			ImageID:       imageID,
+			DisplayName:   e.DisplayName,
+			ObjectName:    e.ObjectName,
+			WorkRequestID: e.WorkRequestID,
+			PARID:         e.PARID,
+		}
+	}
+	client.SetExportUpdateFunc(func(image oci.ExportedImage, done bool) {
+		if done {
+			delete(exports.Images, image.ImageID)
 		} else {
-			fmt.Printf("%s_image_ocid = \"%s\"\n", name, id)
+			e := exports.Images[image.ImageID]
+			if e.StartedAt.IsZero() {
+				e.StartedAt = time.Now()
+			}
+			e.DisplayName = image.DisplayName
+			e.ObjectName = image.ObjectName
+			e.WorkRequestID = image.WorkRequestID
+			e.PARID = image.PARID
+			exports.Images[image.ImageID] = e
+		}
+		if err := mgr.SaveExports(exports); err != nil {
+			console.Logf("Warning: %v", err)
 		}
+	})
+
+	exported, err := client.Export(ctx, imageID, objectName, prev)
+	if err != nil {
+		return err
+	}
+	if !download {
+		return nil
+	}
+
+	if name == "" {
+		name = imageNameFromDisplayName(exported.DisplayName)
+	}
+	localPath := filepath.Join(outputDir, path.Base(exported.ObjectName))
+
+	// Hold the state lock for the download so a concurrent run does not
+	// replace the run this image is registered in
+	if err := mgr.Lock(); err != nil {
+		return err
+	}
+	defer mgr.Unlock()
+
+	sizeBytes, err := client.Download(ctx, exported.ObjectName, localPath)
+	if err != nil {
+		return err
+	}
+
+	if _, err := mgr.NewRun([]string{name}); err != nil {
+		return err
+	}
+	if err := mgr.UpdateImage(name, func(img *state.ImageState) {
+		img.LocalPath = localPath
+		img.Stage = state.StageBuildComplete
+		img.Metrics.BuildSizeBytes = sizeBytes
+	}); err != nil {
+		return err
+	}
+	if err := mgr.SetStage(state.PipelineUpload); err != nil {
+		return err
 	}
 
+	fmt.Printf("\nRegistered %s as %s in run %s (run 'resume' to upload and import it)\n",
+		localPath, name, mgr.GetState().RunID)
 	return nil
 }
 
-func runAll(cfg *config.Config, imageNames []string, localOnly bool) error {
-	fmt.Println("=== Build Stage ===")
-	builder := build.NewBuilder(cfg, localOnly)
-	builder.SetLogFunc(func(msg string) {
-		fmt.Println(msg)
+// imageNameFromDisplayName returns the image name of a display name created
+// by import, e.g. "headscale" for "headscale-nixos-20240115-123456".
+func imageNameFromDisplayName(displayName string) string {
+	name, _, _ := strings.Cut(displayName, "-nixos-")
+	return name
+}
+
+// listOptions are the filters and columns of the list command.
+type listOptions struct {
+	prefix  string
+	match   string
+	tags    []string
+	sortBy  string
+	reverse bool
+	inUse   bool
+	shapes  bool
+
+	compartments []string // Extra compartments to look for instances in
+}
+
+func runList(ctx context.Context, cfg *config.Config, opts listOptions) error {
+	client, err := oci.NewClient(cfg)
+	if err != nil {
+		return err
+	}
+
+	images, err := client.ListImages(ctx, opts.prefix)
+	if err != nil {
+		return err
+	}
+
+	var filtered []oci.OciImage
+	for _, img := range images {
+		if opts.match != "" {
+			if ok, _ := path.Match(opts.match, img.DisplayName); !ok {
+				continue
+			}
+		}
+		if !hasTags(img.FreeformTags, opts.tags) {
+			continue
+		}
+		filtered = append(filtered, img)
+	}
+	images = filtered
+
+	sort.SliceStable(images, func(i, j int) bool {
+		if opts.reverse {
+			i, j = j, i
+		}
+		if opts.sortBy == "name" {
+			return images[i].DisplayName < images[j].DisplayName
+		}
+		ti, tj := images[i].TimeCreated, images[j].TimeCreated
+		if ti == nil || tj == nil {
+			return ti != nil && tj == nil
+		}
+		return ti.After(*tj)
 	})
 
-	_, err := builder.Build(context.Background(), imageNames)
+	instances := make(map[string][]string)
+	if opts.inUse {
+		compartments := cfg.InstanceCompartments()
+		for _, id := range opts.compartments {
+			if !slices.Contains(compartments, id) {
+				compartments = append(compartments, id)
+			}
+		}
+		for _, id := range compartments {
+			found, err := client.InstancesByImage(ctx, id)
+			if err != nil {
+				return err
+			}
+			for imageID, names := range found {
+				instances[imageID] = append(instances[imageID], names...)
+			}
+		}
+	}
+
+	var shapes [][]string
+	if opts.shapes {
+		if shapes, err = imageShapes(ctx, client, images); err != nil {
+			return err
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	header := "ID\tNAME\tSTATE\tLIVE\tCREATED\tSIZE\tOS\tTAGS"
+	if opts.shapes {
+		header += "\tSHAPES"
+	}
+	if opts.inUse {
+		header += "\tIN USE BY"
+	}
+	fmt.Fprintln(w, header)
+
+	for i, img := range images {
+		created := "-"
+		if img.TimeCreated != nil {
+			created = img.TimeCreated.Local().Format("2006-01-02 15:04")
+		}
+		row := []string{
+			img.ID,
+			img.DisplayName,
+			img.LifecycleState,
+			orDash(img.FreeformTags[oci.PointerTagKey]),
+			created,
+			fmt.Sprintf("%d MB", img.SizeMB),
+			strings.TrimSpace(img.OperatingSystem + " " + img.OperatingSystemVersion),
+			orDash(formatTags(img.FreeformTags)),
+		}
+		if opts.shapes {
+			row = append(row, orDash(strings.Join(shapes[i], ",")))
+		}
+		if opts.inUse {
+			row = append(row, orDash(strings.Join(instances[img.ID], ",")))
+		}
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+
+	return w.Flush()
+}
+
+// imageShapes returns the compatible shapes of each image, looked up a few
+// images at a time.
+func imageShapes(ctx context.Context, client *oci.Client, images []oci.OciImage) ([][]string, error) {
+	shapes := make([][]string, len(images))
+	errs := make([]error, len(images))
+	sem := make(chan struct{}, 8)
+	var wg sync.WaitGroup
+	for i, img := range images {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			shapes[i], errs[i] = client.ImageShapes(ctx, img.ID)
+		}()
+	}
+	wg.Wait()
+	return shapes, errors.Join(errs...)
+}
+
+// hasTags reports whether tags match every filter, each either key=value or
+// a bare key that must be present.
+func hasTags(tags map[string]string, filters []string) bool {
+	for _, f := range filters {
+		key, value, hasValue := strings.Cut(f, "=")
+		got, ok := tags[key]
+		if !ok || (hasValue && got != value) {
+			return false
+		}
+	}
+	return true
+}
+
+// formatTags formats freeform tags as sorted key=value pairs.
+func formatTags(tags map[string]string) string {
+	pairs := make([]string, 0, len(tags))
+	for k, v := range tags {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// orDash returns s, or "-" if it is empty, for table cells.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// statusTarget is an image shown by the status command.
+type statusTarget struct {
+	name          string
+	imageID       string
+	workRequestID string
+}
+
+func runStatus(ctx context.Context, cfg *config.Config, args []string, watch bool, interval time.Duration) error {
+	client, err := oci.NewClient(cfg)
 	if err != nil {
 		return err
 	}
 
-	fmt.Println("\n=== Upload Stage ===")
+	targets, err := statusTargets(ctx, client, cfg, args)
+	if err != nil {
+		return err
+	}
+
+	tty := term.IsTerminal(int(os.Stdout.Fd()))
+	for {
+		if watch && tty {
+			fmt.Print("\033[H\033[2J") // Clear the screen for the refreshed table
+		}
+		if watch {
+			fmt.Printf("%s (every %s, Ctrl-C to stop)\n\n", time.Now().Format("15:04:05"), interval)
+		}
+
+		settled, err := printStatus(ctx, client, targets)
+		if err != nil {
+			return err
+		}
+		if !watch || settled {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+		if !tty {
+			fmt.Println()
+		}
+	}
+}
+
+// statusTargets resolves the status command's arguments to images.
+func statusTargets(ctx context.Context, client *oci.Client, cfg *config.Config, args []string) ([]statusTarget, error) {
+	mgr, err := state.NewManager(cfg.Environment)
+	if err != nil {
+		return nil, err
+	}
+	pstate, err := mgr.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(args) == 0 {
+		if pstate == nil {
+			return nil, fmt.Errorf("no saved runs; pass image names or OCIDs")
+		}
+		var targets []statusTarget
+		for _, img := range pstate.Images {
+			if img.ImageID != "" {
+				targets = append(targets, statusTarget{img.Name, img.ImageID, img.WorkRequestID})
+			}
+		}
+		if len(targets) == 0 {
+			return nil, fmt.Errorf("run %s has not imported any images yet", pstate.RunID)
+		}
+		return targets, nil
+	}
+
+	var targets []statusTarget
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "ocid1.") {
+			targets = append(targets, statusTarget{name: "-", imageID: arg})
+			continue
+		}
+
+		if pstate != nil {
+			if img := findImage(pstate, arg); img != nil && img.ImageID != "" {
+				targets = append(targets, statusTarget{arg, img.ImageID, img.WorkRequestID})
+				continue
+			}
+		}
+
+		current, _, err := client.TaggedPointers(ctx, arg)
+		if err != nil {
+			return nil, err
+		}
+		if current == "" {
+			images, err := client.ListImages(ctx, arg+"-nixos-")
+			if err != nil {
+				return nil, err
+			}
+			if len(images) == 0 {
+				return nil, fmt.Errorf("no images found for %s", arg)
+			}
+			current = images[0].ID
+		}
+		targets = append(targets, statusTarget{name: arg, imageID: current})
+	}
+	return targets, nil
+}
+
+// findImage returns the state of the named image in a run, or nil.
+func findImage(pstate *state.PipelineState, name string) *state.ImageState {
+	for i := range pstate.Images {
+		if pstate.Images[i].Name == name {
+			return &pstate.Images[i]
+		}
+	}
+	return nil
+}
+
+// printStatus prints a status table and reports whether every image has
+// settled, i.e. is no longer importing.
+func printStatus(ctx context.Context, client *oci.Client, targets []statusTarget) (bool, error) {
+	settled := true
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tIMAGE\tSTATE\tPROGRESS\tWORK REQUEST")
+
+	for _, t := range targets {
+		status, err := client.GetImageStatus(ctx, t.imageID)
+		if err != nil {
+			if ctx.Err() != nil {
+				return true, nil
+			}
+			status = "error: " + err.Error()
+		}
+
+		progress, wrStatus := "-", "-"
+		if t.workRequestID != "" {
+			wr, err := client.GetWorkRequest(ctx, t.workRequestID)
+			switch {
+			case err != nil && ctx.Err() != nil:
+				return true, nil
+			case err != nil:
+				wrStatus = "error: " + err.Error()
+			default:
+				wrStatus = wr.Status
+				progress = fmt.Sprintf("%.0f%%", wr.PercentComplete)
+				if wr.Status == "ACCEPTED" || wr.Status == "IN_PROGRESS" {
+					settled = false
+				}
+			}
+		}
+		switch status {
+		case "IMPORTING", "PROVISIONING", "EXPORTING":
+			settled = false
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", t.name, t.imageID, status, progress, wrStatus)
+	}
+
+	return settled, w.Flush()
+}
+
+func runPromote(ctx context.Context, cfg *config.Config, imageID, name string) error {
 	client, err := oci.NewClient(cfg)
 	if err != nil {
 		return err
 	}
-	client.SetLogFunc(func(msg string) {
-		fmt.Println(msg)
-	})
 
-	objects, err := client.Upload(context.Background(), imageNames)
+	img, err := client.GetImage(ctx, imageID)
 	if err != nil {
 		return err
 	}
+	if img.LifecycleState != "AVAILABLE" {
+		return fmt.Errorf("image %s is %s, only AVAILABLE images can be promoted", img.DisplayName, img.LifecycleState)
+	}
+	if name == "" {
+		name = imageNameFromDisplayName(img.DisplayName)
+	}
+	if cfg.GetImage(name) == nil {
+		return fmt.Errorf("unknown image: %s (use --name to choose the image name)", name)
+	}
 
-	fmt.Println("\n=== Import Stage ===")
-	imageIDs, err := client.Import(context.Background(), objects)
+	mgr, reg, stray, err := openRegistry(ctx, client, cfg, name)
 	if err != nil {
 		return err
 	}
+	defer mgr.Unlock()
 
-	fmt.Println("\nWaiting for images to be available...")
-	if err := client.WaitForImages(context.Background(), imageIDs); err != nil {
+	if reg.Images[name].Current == imageID {
+		fmt.Printf("%s is already the current %s image\n", img.DisplayName, name)
+		return nil
+	}
+
+	old := reg.Promote(name, imageID)
+	if err := retagPointers(ctx, client, mgr, reg, name, old, stray); err != nil {
 		return err
 	}
 
-	fmt.Println("\n=== Add to terraform.tfvars ===")
-	for name, id := range imageIDs {
-		img := cfg.GetImage(name)
-		if img != nil && img.TerraformVar != "" {
-			fmt.Printf("%s = \"%s\"\n", img.TerraformVar, id)
-		} else {
-			fmt.Printf("%s_image_ocid = \"%s\"\n", name, id)
+	fmt.Printf("Promoted %s (%s) to current %s image\n", img.DisplayName, imageID, name)
+	if old.Current != "" {
+		fmt.Printf("Previous: %s\n", old.Current)
+	}
+	return printTfvars(cfg, map[string]string{name: imageID})
+}
+
+func runRollback(ctx context.Context, cfg *config.Config, name string) error {
+	if cfg.GetImage(name) == nil {
+		return fmt.Errorf("unknown image: %s", name)
+	}
+
+	client, err := oci.NewClient(cfg)
+	if err != nil {
+		return err
+	}
+
+	mgr, reg, stray, err := openRegistry(ctx, client, cfg, name)
+	if err != nil {
+		return err
+	}
+	defer mgr.Unlock()
+
+	old, err := reg.Rollback(name)
+	if err != nil {
+		return err
+	}
+
+	status, err := client.GetImageStatus(ctx, old.Previous)
+	if err != nil {
+		return err
+	}
+	if status != "AVAILABLE" {
+		return fmt.Errorf("previous %s image %s is %s, cannot roll back to it", name, old.Previous, status)
+	}
+
+	if err := retagPointers(ctx, client, mgr, reg, name, old, stray); err != nil {
+		return err
+	}
+
+	fmt.Printf("Rolled back %s to %s (was %s)\n", name, old.Previous, old.Current)
+	return printTfvars(cfg, map[string]string{name: old.Previous})
+}
+
+// openRegistry locks the state of the selected environment and loads the
+// image registry, with the pointer of name brought in line with the pointer
+// tags in OCI, e.g. after a promote from another machine. It also returns
+// the other images of name left with a pointer tag. The caller must unlock
+// the returned manager.
+func openRegistry(ctx context.Context, client *oci.Client, cfg *config.Config, name string) (*state.Manager, *state.Registry, []string, error) {
+	mgr, err := state.NewManager(cfg.Environment)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err := mgr.Lock(); err != nil {
+		return nil, nil, nil, err
+	}
+
+	reg, err := mgr.LoadRegistry()
+	if err != nil {
+		mgr.Unlock()
+		return nil, nil, nil, err
+	}
+
+	stray, err := syncRegistry(ctx, client, mgr, reg, name, reg.Images[name])
+	if err != nil {
+		mgr.Unlock()
+		return nil, nil, nil, err
+	}
+	return mgr, reg, stray, nil
+}
+
+// syncRegistry sets the pointer of name in the registry to the one the
+// pointer tags in OCI record, saving the registry if it changed, and
+// returns the other images of name left with a pointer tag. Where several
+// images have the same tag, the one in preferred wins, or else the newest.
+func syncRegistry(ctx context.Context, client *oci.Client, mgr *state.Manager, reg *state.Registry, name string, preferred state.Pointer) ([]string, error) {
+	tagged, err := client.PointerTagged(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	pick := func(pointer, preferred string) string {
+		var ids []string
+		for _, img := range tagged {
+			if img.FreeformTags[oci.PointerTagKey] == pointer {
+				ids = append(ids, img.ID)
+			}
 		}
+		if slices.Contains(ids, preferred) {
+			return preferred
+		}
+		if len(ids) > 0 {
+			return ids[0]
+		}
+		return ""
+	}
+	ptr := state.Pointer{
+		Current:  pick(oci.PointerCurrent, preferred.Current),
+		Previous: pick(oci.PointerPrevious, preferred.Previous),
 	}
 
-	return nil
+	var stray []string
+	for _, img := range tagged {
+		if img.ID != ptr.Current && img.ID != ptr.Previous {
+			stray = append(stray, img.ID)
+		}
+	}
+
+	recorded, ok := reg.Images[name]
+	if ptr.Current == recorded.Current && ptr.Previous == recorded.Previous {
+		return stray, nil
+	}
+	if ptr.Current == "" && ptr.Previous == "" {
+		delete(reg.Images, name)
+	} else {
+		reg.Images[name] = ptr
+	}
+	if ok {
+		fmt.Printf("Updated the %s pointer from the image tags in OCI\n", name)
+	}
+	return stray, mgr.SaveRegistry(reg)
+}
+
+// retagPointers moves the pointer tags in OCI from the old pointer of name
+// to the one now in the registry, tagging the new current image first.
+// Images in old or stray that are in neither role any more lose their tag.
+// If a tag cannot be moved, the registry is saved with the pointer the tags
+// reached.
+func retagPointers(ctx context.Context, client *oci.Client, mgr *state.Manager, reg *state.Registry, name string, old state.Pointer, stray []string) error {
+	updated := reg.Images[name]
+
+	type retag struct{ id, pointer string }
+	retags := []retag{{updated.Current, oci.PointerCurrent}}
+	if updated.Previous != "" {
+		retags = append(retags, retag{updated.Previous, oci.PointerPrevious})
+	}
+	for _, id := range append([]string{old.Current, old.Previous}, stray...) {
+		if id != "" && id != updated.Current && id != updated.Previous {
+			retags = append(retags, retag{id, ""})
+		}
+	}
+
+	for _, r := range retags {
+		if err := client.SetPointerTag(ctx, r.id, r.pointer); err != nil {
+			if _, syncErr := syncRegistry(ctx, client, mgr, reg, name, updated); syncErr != nil {
+				return errors.Join(err, syncErr)
+			}
+			return err
+		}
+	}
+	return mgr.SaveRegistry(reg)
+}
+
+func runAll(ctx context.Context, cfg *config.Config, imageNames []string, localOnly, dash, allowDirty bool) error {
+	// Fail before building what could not be uploaded
+	g := inspectGit(ctx, allowDirty)
+	if err := checkGit(g); err != nil {
+		return err
+	}
+
+	mgr, err := state.NewManager(cfg.Environment)
+	if err != nil {
+		return err
+	}
+	if err := mgr.Lock(); err != nil {
+		return err
+	}
+	defer mgr.Unlock()
+
+	if cfg.Environment != "" {
+		fmt.Printf("Environment: %s (compartment %s, bucket %s)\n",
+			cfg.Environment, cfg.OCI.CompartmentOCID, cfg.OCI.BucketName)
+	}
+
+	fmt.Printf("Git: %s\n", describeGit(g))
+
+	if _, err := mgr.NewRun(imageNames); err != nil {
+		return err
+	}
+	if err := mgr.SetGit(g); err != nil {
+		return err
+	}
+	if err := mgr.SetLocalOnly(localOnly); err != nil {
+		return err
+	}
+	mgr.SetLogFunc(console.Log)
+	events.Subscribe(mgr.HandleEvent)
+
+	ctx, stop := startDashboard(ctx, mgr, dash)
+	defer stop()
+
+	return runPipeline(ctx, cfg, mgr, imageNames, localOnly)
 }